@@ -0,0 +1,182 @@
+// egress-router-agent keeps the redirect rules of a running egress router pod in
+// sync with the ipConfig ConfigMap of its network configuration. It runs in the
+// egress router pod, watches the ConfigMap and re-applies the egress_cni nftables
+// table whenever it changes, so that destinations can be updated without
+// recreating the pod. It can also export the counters of the egress_cni rules as
+// Prometheus metrics.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/macvlan"
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+// retryInterval is how long the agent waits before watching the ConfigMap again
+// after an API error.
+const retryInterval = 10 * time.Second
+
+func main() {
+	configFile := flag.String("config", "/etc/egress-router/config.json", "path to the egress router network configuration")
+	ifName := flag.String("interface", "net1", "egress interface of the pod")
+	clusterIfName := flag.String("cluster-interface", "eth0", "cluster interface of the pod, unless the configuration sets clusterInterface")
+	podNamespace := flag.String("pod-namespace", os.Getenv("POD_NAMESPACE"), "namespace of the egress router pod")
+	podName := flag.String("pod-name", os.Getenv("POD_NAME"), "name of the egress router pod, used to select its 'podIP' entry")
+	metricsAddress := flag.String("metrics-address", "", "address to serve Prometheus metrics on at /metrics, e.g. \":9101\"; disabled if empty")
+	logLevel := flag.String("log-level", "verbose", "log level: error, verbose or debug")
+	flag.Parse()
+
+	logging.SetLogStderr(true)
+	logging.SetLogLevel(*logLevel)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if err := run(ctx, *configFile, *ifName, *clusterIfName, *podNamespace, *podName, *metricsAddress); err != nil {
+		logging.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, configFile, ifName, clusterIfName, podNamespace, podName, metricsAddress string) error {
+	conf, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, 1)
+	if metricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", macvlan.MetricsHandler())
+		server := &http.Server{Addr: metricsAddress, Handler: mux}
+		go func() {
+			logging.Verbosef("Serving metrics on %s", metricsAddress)
+			errs <- server.ListenAndServe()
+		}()
+		defer server.Close()
+	}
+	if conf.IPConfig == nil || conf.IPConfig.Name == "" {
+		if metricsAddress == "" {
+			return fmt.Errorf("the configuration does not reference an ipConfig ConfigMap and metrics are disabled, nothing to do")
+		}
+		logging.Verbosef("The configuration does not reference an ipConfig ConfigMap, not reconciling")
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return err
+		}
+	}
+
+	if podNamespace == "" && conf.IPConfig.Namespace == "" {
+		return fmt.Errorf("the pod namespace is unknown, set -pod-namespace or POD_NAMESPACE")
+	}
+	reconciler, err := macvlan.NewReconciler(conf, podNamespace, podName, ifName, clusterIfName)
+	if err != nil {
+		return err
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf("failed to get in-cluster config: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to get Kubernetes clientset: %v", err)
+	}
+
+	for {
+		if err := watchConfigMap(ctx, clientset, reconciler); err != nil {
+			logging.Errorf("%v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return err
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// watchConfigMap applies the current content of the ipConfig ConfigMap and then
+// every change to it, until the watch ends or ctx is cancelled.
+func watchConfigMap(ctx context.Context, clientset kubernetes.Interface, reconciler *macvlan.Reconciler) error {
+	namespace, name := reconciler.ConfigMap()
+	configMaps := clientset.CoreV1().ConfigMaps(namespace)
+
+	cm, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get ConfigMap %s/%s: %v", namespace, name, err)
+	}
+	apply(ctx, reconciler, cm)
+
+	w, err := configMaps.Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+		ResourceVersion: cm.ResourceVersion,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch ConfigMap %s/%s: %v", namespace, name, err)
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				logging.Debugf("Watch of ConfigMap %s/%s closed", namespace, name)
+				return nil
+			}
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				if cm, ok := event.Object.(*corev1.ConfigMap); ok {
+					apply(ctx, reconciler, cm)
+				}
+			case watch.Deleted:
+				logging.Errorf("ConfigMap %s/%s was deleted, keeping the current rules", namespace, name)
+			case watch.Error:
+				return fmt.Errorf("watch of ConfigMap %s/%s failed: %v", namespace, name, event.Object)
+			}
+		}
+	}
+}
+
+// apply applies cm and logs the outcome. An invalid ConfigMap leaves the current
+// rules in place.
+func apply(ctx context.Context, reconciler *macvlan.Reconciler, cm *corev1.ConfigMap) {
+	logging.Debugf("Applying ConfigMap %s/%s version %s", cm.Namespace, cm.Name, cm.ResourceVersion)
+	if err := reconciler.Apply(ctx, cm.Data); err != nil {
+		logging.Errorf("failed to apply ConfigMap %s/%s version %s: %v", cm.Namespace, cm.Name, cm.ResourceVersion, err)
+	}
+}
+
+// loadConfig reads the network configuration.
+func loadConfig(configFile string) (*types.NetConf, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration: %v", err)
+	}
+	conf := &types.NetConf{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration %s: %v", configFile, err)
+	}
+	return conf, nil
+}
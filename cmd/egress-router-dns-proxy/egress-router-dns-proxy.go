@@ -0,0 +1,106 @@
+// egress-router-dns-proxy is the TCP proxy of the "dns-proxy" egress mode. It
+// runs in the egress router pod, reads the same network configuration as the CNI
+// plugin and forwards the local port of every destination to the current
+// addresses of its host, from the egress addresses of the egress interface.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/openshift/egress-router-cni/pkg/dnsproxy"
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/macvlan"
+	"github.com/openshift/egress-router-cni/pkg/types"
+	"github.com/openshift/egress-router-cni/pkg/util"
+)
+
+func main() {
+	configFile := flag.String("config", "/etc/egress-router/config.json", "path to the egress router network configuration")
+	ifName := flag.String("interface", "net1", "egress interface whose addresses outgoing connections are bound to")
+	clusterIfName := flag.String("cluster-interface", "eth0", "cluster interface whose addresses the proxy listens on, unless the configuration sets clusterInterface")
+	listenAddress := flag.String("listen-address", "", "address to listen on, instead of the addresses of the cluster interface")
+	podNamespace := flag.String("pod-namespace", os.Getenv("POD_NAMESPACE"), "namespace of the egress router pod, where the ipConfig ConfigMap is looked up")
+	podName := flag.String("pod-name", os.Getenv("POD_NAME"), "name of the egress router pod, used to select its 'podIP' entry")
+	interval := flag.Duration("resolve-interval", dnsproxy.DefaultResolveInterval, "how often destination hosts are resolved again")
+	logLevel := flag.String("log-level", "verbose", "log level: error, verbose or debug")
+	flag.Parse()
+
+	logging.SetLogStderr(true)
+	logging.SetLogLevel(*logLevel)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if err := run(ctx, *configFile, *ifName, *clusterIfName, *listenAddress, *podNamespace, *podName, *interval); err != nil {
+		logging.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, configFile, ifName, clusterIfName, listenAddress, podNamespace, podName string, interval time.Duration) error {
+	conf, err := loadConfig(configFile, podNamespace, podName)
+	if err != nil {
+		return err
+	}
+	destinations, err := dnsproxy.ParseDestinations(conf.IP.Destinations)
+	if err != nil {
+		return err
+	}
+	sources, err := util.EgressAddresses(ifName)
+	if err != nil {
+		return err
+	}
+	if conf.ClusterInterface != "" {
+		clusterIfName = conf.ClusterInterface
+	}
+	listenIPs, err := util.ListenAddresses(listenAddress, clusterIfName)
+	if err != nil {
+		return err
+	}
+	return dnsproxy.New(destinations, listenIPs, sources, interval).Run(ctx)
+}
+
+// readIPConfigMap reads the data of the ipConfig ConfigMap, and is replaced in
+// tests.
+var readIPConfigMap = macvlan.IPConfigMapData
+
+// loadConfig reads the network configuration, checks that it is in dns-proxy
+// mode and resolves its effective "ip" section for the pod podName as ADD does,
+// from the ipConfig ConfigMap if the configuration references one. The resolved
+// section must have at least one destination.
+func loadConfig(configFile, podNamespace, podName string) (*types.NetConf, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration: %v", err)
+	}
+	conf := &types.NetConf{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration %s: %v", configFile, err)
+	}
+	if conf.Mode != types.ModeDNSProxy {
+		return nil, fmt.Errorf("configuration %s is not in %s mode", configFile, types.ModeDNSProxy)
+	}
+
+	var ipConfigData map[string]string
+	if conf.IPConfig != nil && conf.IPConfig.Name != "" {
+		if podNamespace == "" && conf.IPConfig.Namespace == "" {
+			return nil, fmt.Errorf("the pod namespace is unknown, set -pod-namespace or POD_NAMESPACE")
+		}
+		if ipConfigData, err = readIPConfigMap(conf.IPConfig, podNamespace); err != nil {
+			return nil, err
+		}
+	}
+	if conf.IP, err = macvlan.EffectiveIP(conf, podName, ipConfigData); err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %v", configFile, err)
+	}
+	if conf.IP == nil || len(conf.IP.Destinations) == 0 {
+		return nil, fmt.Errorf("configuration %s has no destinations", configFile)
+	}
+	return conf, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+func TestLoadConfig(t *testing.T) {
+	defer func(f func(*types.IPConfig, string) (map[string]string, error)) { readIPConfigMap = f }(readIPConfigMap)
+	readIPConfigMap = func(ipc *types.IPConfig, podNamespace string) (map[string]string, error) {
+		if ipc.Namespace == "" {
+			ipc.Namespace = podNamespace
+		}
+		switch ipc.Namespace + "/" + ipc.Name {
+		case "egress/egress-ip":
+			return map[string]string{"ip": `{"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1", "destinations": ["443 partner.example.com"]}`}, nil
+		case "egress/egress-pod-ip":
+			return map[string]string{"podIP": `{"egress-router-0": {"addresses": ["192.168.3.11/24"], "gateway": "192.168.3.1", "destinations": ["8443 api.example.com 443"]}}`}, nil
+		}
+		return nil, fmt.Errorf("failed to get ConfigMap on namespace %s with name %s: not found", ipc.Namespace, ipc.Name)
+	}
+
+	tests := []struct {
+		desc         string
+		conf         string
+		destinations []string
+		errMatch     string
+	}{
+		{
+			desc:         "inline destinations",
+			conf:         `{"mode": "dns-proxy", "ip": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1", "destinations": ["443 partner.example.com"]}}`,
+			destinations: []string{"443 partner.example.com"},
+		},
+		{
+			desc:         "podIP entry of the pod",
+			conf:         `{"mode": "dns-proxy", "podIP": {"egress-router-0": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1", "destinations": ["443 partner.example.com"]}}}`,
+			destinations: []string{"443 partner.example.com"},
+		},
+		{
+			desc:         "ConfigMap ip",
+			conf:         `{"mode": "dns-proxy", "ipConfig": {"name": "egress-ip"}}`,
+			destinations: []string{"443 partner.example.com"},
+		},
+		{
+			desc:         "ConfigMap ip with overrides",
+			conf:         `{"mode": "dns-proxy", "ip": {"destinations": ["443 inline.example.com"]}, "ipConfig": {"name": "egress-ip", "overrides": {"destinations": ["443 override.example.com"]}}}`,
+			destinations: []string{"443 override.example.com"},
+		},
+		{
+			desc:         "ConfigMap podIP entry of the pod",
+			conf:         `{"mode": "dns-proxy", "ipConfig": {"name": "egress-pod-ip"}}`,
+			destinations: []string{"8443 api.example.com 443"},
+		},
+		{
+			desc:     "ConfigMap missing",
+			conf:     `{"mode": "dns-proxy", "ipConfig": {"name": "missing"}}`,
+			errMatch: "failed to get ConfigMap on namespace egress with name missing",
+		},
+		{
+			desc:     "no destinations",
+			conf:     `{"mode": "dns-proxy", "ip": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1"}}`,
+			errMatch: "has no destinations",
+		},
+		{
+			desc:     "redirect mode",
+			conf:     `{"ip": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1", "destinations": ["10.100.3.1"]}}`,
+			errMatch: "is not in dns-proxy mode",
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(configFile, []byte(tc.conf), 0o600); err != nil {
+				t.Fatalf("failed to write configuration: %v", err)
+			}
+			conf, err := loadConfig(configFile, "egress", "egress-router-0")
+			if tc.errMatch != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tc.errMatch)
+				}
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			var destinations []string
+			for _, d := range conf.IP.Destinations {
+				destinations = append(destinations, d.String())
+			}
+			assert.Equal(t, tc.destinations, destinations)
+		})
+	}
+}
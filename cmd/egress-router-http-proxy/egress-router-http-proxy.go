@@ -0,0 +1,91 @@
+// egress-router-http-proxy is the HTTP proxy of the "http-proxy" egress mode. It
+// runs in the egress router pod, reads the same network configuration as the CNI
+// plugin and connects to the allowlisted destinations from the egress addresses
+// of the egress interface.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/openshift/egress-router-cni/pkg/httpproxy"
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+	"github.com/openshift/egress-router-cni/pkg/util"
+)
+
+func main() {
+	configFile := flag.String("config", "/etc/egress-router/config.json", "path to the egress router network configuration")
+	ifName := flag.String("interface", "net1", "egress interface whose addresses outgoing connections are bound to")
+	clusterIfName := flag.String("cluster-interface", "eth0", "cluster interface whose addresses the proxy listens on, unless the configuration sets clusterInterface")
+	listenAddress := flag.String("listen-address", "", "address to listen on, instead of the addresses of the cluster interface")
+	logLevel := flag.String("log-level", "verbose", "log level: error, verbose or debug")
+	flag.Parse()
+
+	logging.SetLogStderr(true)
+	logging.SetLogLevel(*logLevel)
+
+	if err := run(*configFile, *ifName, *clusterIfName, *listenAddress); err != nil {
+		logging.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
+
+func run(configFile, ifName, clusterIfName, listenAddress string) error {
+	conf, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	allowlist, err := httpproxy.ParseAllowlist(conf.HTTPProxy.Allowlist)
+	if err != nil {
+		return fmt.Errorf("invalid allowlist: %v", err)
+	}
+	sources, err := util.EgressAddresses(ifName)
+	if err != nil {
+		return err
+	}
+
+	if conf.ClusterInterface != "" {
+		clusterIfName = conf.ClusterInterface
+	}
+	listenIPs, err := util.ListenAddresses(listenAddress, clusterIfName)
+	if err != nil {
+		return err
+	}
+
+	port := conf.HTTPProxy.Port
+	if port == 0 {
+		port = httpproxy.DefaultPort
+	}
+	proxy := httpproxy.New(allowlist, sources)
+	errs := make(chan error, len(listenIPs))
+	for _, ip := range listenIPs {
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		logging.Verbosef("Listening on %s, connecting from %v", addr, sources)
+		go func() {
+			errs <- http.ListenAndServe(addr, proxy)
+		}()
+	}
+	return <-errs
+}
+
+// loadConfig reads the network configuration and checks that it is in http-proxy mode.
+func loadConfig(configFile string) (*types.NetConf, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration: %v", err)
+	}
+	conf := &types.NetConf{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration %s: %v", configFile, err)
+	}
+	if conf.Mode != types.ModeHTTPProxy || conf.HTTPProxy == nil {
+		return nil, fmt.Errorf("configuration %s is not in %s mode", configFile, types.ModeHTTPProxy)
+	}
+	return conf, nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/version"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
@@ -9,19 +11,27 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validate(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "render", "--dry-run":
+			os.Exit(render(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "inspect":
+			os.Exit(inspect(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		}
+	}
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("egress-router"))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
-	return nil
+	return macvlan.CmdCheck(args)
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
-	macvlan.CmdAdd(args)
-	return nil
+	return macvlan.CmdAdd(args)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	macvlan.CmdDel(args)
-	return nil
+	return macvlan.CmdDel(args)
 }
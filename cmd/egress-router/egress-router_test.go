@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// pluginEnv makes the test binary run the plugin's main instead of the tests,
+// so that every test case sees the exit code and stdout the runtime would see.
+const pluginEnv = "EGRESS_ROUTER_TEST_RUN_PLUGIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(pluginEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func runPlugin(t *testing.T, command, netns, conf string) (int, []byte) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(),
+		pluginEnv+"=1",
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID=egress-router-test",
+		"CNI_NETNS="+netns,
+		"CNI_IFNAME=net1",
+		"CNI_PATH=/opt/cni/bin",
+	)
+	cmd.Stdin = strings.NewReader(conf)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), stdout.Bytes()
+	} else if err != nil {
+		t.Fatalf("failed to run plugin: %v", err)
+	}
+	return 0, stdout.Bytes()
+}
+
+func TestPluginErrors(t *testing.T) {
+	const interfaceArgs = `"interfaceArgs": {"master": "eth0", "mode": "bridge", "mtu": "1500"}`
+
+	tests := []struct {
+		desc     string
+		command  string
+		netns    string
+		conf     string
+		exitCode int
+		errCode  uint
+		errMatch string
+	}{
+		{
+			desc:     "ADD with undecodable config",
+			command:  "ADD",
+			netns:    "/var/run/netns/egress-router-test",
+			conf:     `{"cniVersion": "0.4.0", "name": "egress", "type": "egress-router", "ip": "192.168.3.10/24"}`,
+			exitCode: 1,
+			errCode:  cnitypes.ErrDecodingFailure,
+			errMatch: "failed to load netconf",
+		},
+		{
+			desc:     "ADD without IP configuration",
+			command:  "ADD",
+			netns:    "/var/run/netns/egress-router-test",
+			conf:     `{"cniVersion": "0.4.0", "name": "egress", "type": "egress-router", ` + interfaceArgs + `}`,
+			exitCode: 1,
+			errCode:  cnitypes.ErrInvalidNetworkConfig,
+			errMatch: "no IP addresses configured",
+		},
+		{
+			desc:     "ADD with invalid address",
+			command:  "ADD",
+			netns:    "/var/run/netns/egress-router-test",
+			conf:     `{"cniVersion": "0.4.0", "name": "egress", "type": "egress-router", ` + interfaceArgs + `, "ip": {"addresses": ["192.168.3.300/24"], "gateway": "192.168.3.1"}}`,
+			exitCode: 1,
+			errCode:  cnitypes.ErrInvalidNetworkConfig,
+			errMatch: "unable to parse IP address",
+		},
+		{
+			desc:     "ADD with invalid destination",
+			command:  "ADD",
+			netns:    "/var/run/netns/egress-router-test",
+			conf:     `{"cniVersion": "0.4.0", "name": "egress", "type": "egress-router", ` + interfaceArgs + `, "ip": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1", "destinations": ["80 icmp 10.0.0.1"]}}`,
+			exitCode: 1,
+			errCode:  cnitypes.ErrInvalidNetworkConfig,
+			errMatch: "invalid destination 0",
+		},
+		{
+			desc:     "ADD with missing netns",
+			command:  "ADD",
+			netns:    "/var/run/netns/egress-router-test-missing",
+			conf:     `{"cniVersion": "0.4.0", "name": "egress", "type": "egress-router", ` + interfaceArgs + `, "ip": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1"}}`,
+			exitCode: 1,
+			errCode:  cnitypes.ErrUnknownContainer,
+			errMatch: "failed to open netns",
+		},
+		{
+			desc:     "DEL with missing netns succeeds",
+			command:  "DEL",
+			netns:    "/var/run/netns/egress-router-test-missing",
+			conf:     `{"cniVersion": "0.4.0", "name": "egress", "type": "egress-router", ` + interfaceArgs + `}`,
+			exitCode: 0,
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			exitCode, stdout := runPlugin(t, tc.command, tc.netns, tc.conf)
+
+			assert.Equal(t, tc.exitCode, exitCode)
+			if tc.exitCode == 0 {
+				assert.Empty(t, stdout)
+				return
+			}
+
+			cniErr := &cnitypes.Error{}
+			if err := json.Unmarshal(stdout, cniErr); err != nil {
+				t.Fatalf("failed to decode error payload %q: %v", stdout, err)
+			}
+			assert.Equal(t, tc.errCode, cniErr.Code)
+			assert.Contains(t, cniErr.Msg, tc.errMatch)
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/macvlan"
+	"github.com/openshift/egress-router-cni/pkg/util"
+)
+
+// inspect implements "egress-router inspect -netns <path> [flags]": it prints
+// the egress state of a pod network namespace and, if a network configuration
+// is given, how it deviates from what ADD would configure. It returns the exit
+// code, 1 if the state deviates or cannot be read and 2 on usage errors.
+func inspect(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	netns := flags.String("netns", "", "path of the pod network namespace, e.g. /var/run/netns/<name> or /proc/<pid>/ns/net")
+	ifName := flags.String("interface", "net1", "name of the egress interface, as CNI_IFNAME")
+	confFile := flags.String("config", "", "network configuration to compare the state against, \"-\" for stdin")
+	clusterIfName := flags.String("cluster-interface", "eth0", "cluster interface of the pod, unless the configuration sets clusterInterface")
+	podName := flags.String("pod-name", "", "name of the pod, selecting its 'podIP' entry")
+	ipConfigFile := flags.String("ip-config", "", "file holding the ipConfig ConfigMap, as JSON, if the configuration references one")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: egress-router inspect -netns <path> [flags]\n\n"+
+			"Prints the egress interface, its master, addresses, routes, egress_cni\n"+
+			"nftables table and counters, sysctls and gateway neighbor entries of a pod\n"+
+			"network namespace. With -config, the state is compared against what ADD\n"+
+			"would configure and every deviation is reported.\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *netns == "" || flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	var conf []byte
+	opts := macvlan.RenderOptions{ClusterInterface: *clusterIfName, PodName: *podName}
+	if *confFile != "" {
+		var err error
+		if conf, err = readConfig(*confFile, stdin); err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return 2
+		}
+		if *ipConfigFile != "" {
+			if opts.IPConfigData, err = readConfigMapData(*ipConfigFile); err != nil {
+				fmt.Fprintf(stderr, "%v\n", err)
+				return 2
+			}
+		}
+	}
+
+	// The report is the output; the debug log of the rule comparison is noise
+	logging.SetLogLevel("error")
+	report, err := macvlan.Inspect(*netns, *ifName, conf, opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(stderr, "failed to print report: %v\n", err)
+			return 1
+		}
+	} else {
+		printReport(stdout, *ifName, report)
+	}
+	if len(report.Deviations) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// printReport prints report in a human readable form.
+func printReport(w io.Writer, ifName string, report *macvlan.Report) {
+	if l := report.Link; l != nil {
+		kind := l.Type
+		if l.Mode != "" {
+			kind += " " + l.Mode
+		}
+		fmt.Fprintf(w, "interface: %s (%s) mtu %d mac %s master %s state %s\n", l.Name, kind, l.MTU, l.MAC, l.Master, l.State)
+	} else {
+		fmt.Fprintf(w, "interface: %s not found\n", ifName)
+	}
+	fmt.Fprintf(w, "addresses: %s\n", strings.Join(report.Addresses, " "))
+
+	fmt.Fprintln(w, "routes:")
+	for _, r := range report.Routes {
+		fmt.Fprintf(w, "  %s\n", r)
+	}
+	if len(report.Rules) > 0 {
+		fmt.Fprintln(w, "rules:")
+		for _, rule := range report.Rules {
+			fmt.Fprintf(w, "  %s\n", rule)
+		}
+	}
+
+	fmt.Fprintln(w, "sysctls:")
+	for _, name := range util.SortedKeys(report.Sysctls) {
+		fmt.Fprintf(w, "  %s = %s\n", name, report.Sysctls[name])
+	}
+	fmt.Fprintln(w, "gateways:")
+	for _, n := range report.Neighbors {
+		mac := n.MAC
+		if mac == "" {
+			mac = "<none>"
+		}
+		fmt.Fprintf(w, "  %s lladdr %s %s\n", n.IP, mac, n.State)
+	}
+
+	if report.Ruleset == "" {
+		fmt.Fprintln(w, "nftables: table egress_cni not found")
+	} else {
+		fmt.Fprintln(w, "nftables:")
+		for _, line := range strings.Split(strings.TrimRight(report.Ruleset, "\n"), "\n") {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+		fmt.Fprintln(w, "counters:")
+		for _, c := range report.Counters {
+			fmt.Fprintf(w, "  %s %q: %d packets, %d bytes\n", c.Chain, c.Comment, c.Packets, c.Bytes)
+		}
+	}
+
+	if len(report.Deviations) > 0 {
+		fmt.Fprintln(w, "deviations:")
+		for _, d := range report.Deviations {
+			fmt.Fprintf(w, "  %s\n", d)
+		}
+	}
+}
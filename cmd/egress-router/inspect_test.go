@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openshift/egress-router-cni/pkg/macvlan"
+)
+
+func TestInspectUsage(t *testing.T) {
+	tests := []struct {
+		desc string
+		args []string
+	}{
+		{
+			desc: "missing netns",
+			args: []string{"-interface", "net1"},
+		},
+		{
+			desc: "extra argument",
+			args: []string{"-netns", "/var/run/netns/router", "net1"},
+		},
+		{
+			desc: "unreadable configuration",
+			args: []string{"-netns", "/var/run/netns/router", "-config", "/nonexistent/egress.json"},
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			assert.Equal(t, 2, inspect(tc.args, strings.NewReader(""), &stdout, &stderr))
+			assert.Empty(t, stdout.String())
+		})
+	}
+}
+
+func TestPrintReport(t *testing.T) {
+	var out bytes.Buffer
+	printReport(&out, "net1", &macvlan.Report{
+		Link:      &macvlan.ReportLink{Name: "net1", Type: "macvlan", Mode: "bridge", MTU: 1500, MAC: "0a:58:c0:a8:03:0a", Master: "eth1", State: "up"},
+		Addresses: []string{"192.168.3.10/24"},
+		Routes: []macvlan.PlanRoute{
+			{Destination: "192.168.3.1/32", Device: "net1", Scope: "link"},
+			{Destination: "0.0.0.0/0", Gateway: "192.168.3.1", Device: "net1"},
+		},
+		Sysctls:    map[string]string{"net.ipv4.ip_forward": "1", "net.ipv4.conf.net1.proxy_arp": "1"},
+		Neighbors:  []macvlan.ReportNeighbor{{IP: "192.168.3.1", State: "FAILED"}},
+		Deviations: []string{"gateway 192.168.3.1 is not reachable: neighbor state FAILED"},
+	})
+	assert.Equal(t, `interface: net1 (macvlan bridge) mtu 1500 mac 0a:58:c0:a8:03:0a master eth1 state up
+addresses: 192.168.3.10/24
+routes:
+  192.168.3.1/32 dev net1 scope link
+  0.0.0.0/0 via 192.168.3.1 dev net1
+sysctls:
+  net.ipv4.conf.net1.proxy_arp = 1
+  net.ipv4.ip_forward = 1
+gateways:
+  192.168.3.1 lladdr <none> FAILED
+nftables: table egress_cni not found
+deviations:
+  gateway 192.168.3.1 is not reachable: neighbor state FAILED
+`, out.String())
+
+	out.Reset()
+	printReport(&out, "net1", &macvlan.Report{
+		Ruleset:  "table inet egress_cni {\n\tchain prerouting {\n\t\ttype nat hook prerouting priority dstnat; policy accept;\n\t}\n}\n",
+		Counters: []macvlan.ReportCounter{{Chain: "prerouting", Comment: "80/tcp -> 10.100.3.1", Packets: 3, Bytes: 180}},
+	})
+	assert.Equal(t, `interface: net1 not found
+addresses: 
+routes:
+sysctls:
+gateways:
+nftables:
+  table inet egress_cni {
+  	chain prerouting {
+  		type nat hook prerouting priority dstnat; policy accept;
+  	}
+  }
+counters:
+  prerouting "80/tcp -> 10.100.3.1": 3 packets, 180 bytes
+`, out.String())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/macvlan"
+)
+
+// render implements "egress-router render [flags] [file|-]": it prints the
+// egress_cni ruleset in nft syntax followed by the JSON plan of the changes ADD
+// would make for a network configuration, without touching the network. It
+// returns the exit code, 1 if the plan cannot be computed and 2 on usage errors.
+func render(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	ifName := flags.String("interface", "net1", "name of the egress interface, as CNI_IFNAME")
+	clusterIfName := flags.String("cluster-interface", "eth0", "cluster interface of the pod, unless the configuration sets clusterInterface")
+	podName := flags.String("pod-name", "", "name of the pod, selecting its 'podIP' entry")
+	ipConfigFile := flags.String("ip-config", "", "file holding the ipConfig ConfigMap, as JSON, if the configuration references one")
+	asJSON := flags.Bool("json", false, "only print the JSON plan, with the ruleset in its \"ruleset\" field")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: egress-router render [flags] [file|-]\n\n"+
+			"Prints what ADD would do for the network configuration in file, or on stdin\n"+
+			"if file is \"-\" or omitted: the egress_cni nftables ruleset, then the\n"+
+			"interface, addresses, routes and sysctls as a JSON plan.\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	data, err := readConfig(flags.Arg(0), stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 2
+	}
+	opts := macvlan.RenderOptions{IfName: *ifName, ClusterInterface: *clusterIfName, PodName: *podName}
+	if *ipConfigFile != "" {
+		if opts.IPConfigData, err = readConfigMapData(*ipConfigFile); err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return 2
+		}
+	}
+
+	// The plan is the output; the debug log of the rule generation is noise
+	logging.SetLogLevel("error")
+	plan, err := macvlan.Render(data, opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	if !*asJSON {
+		fmt.Fprintln(stdout, plan.Ruleset)
+		plan.Ruleset = ""
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(plan); err != nil {
+		fmt.Fprintf(stderr, "failed to print plan: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// readConfigMapData returns the data of the ConfigMap in file, as printed by
+// "kubectl get configmap -o json".
+func readConfigMapData(file string) (map[string]string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ConfigMap: %v", err)
+	}
+	var cm struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(content, &cm); err != nil {
+		return nil, fmt.Errorf("failed to parse ConfigMap %s: %v", file, err)
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	return cm.Data, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openshift/egress-router-cni/pkg/macvlan"
+)
+
+func TestRender(t *testing.T) {
+	const conf = `{"cniVersion": "0.4.0", "name": "egress", "type": "egress-router", "ipConfig": {"name": "egress"}}`
+	cm := filepath.Join(t.TempDir(), "configmap.json")
+	assert.NoError(t, os.WriteFile(cm, []byte(`{"kind": "ConfigMap", "data": {"ip": "{\"addresses\": [\"192.168.3.10/24\"], \"gateway\": \"192.168.3.1\", \"destinations\": [\"80 tcp 10.100.3.1\"]}"}}`), 0600))
+
+	tests := []struct {
+		desc     string
+		args     []string
+		exitCode int
+		check    func(t *testing.T, stdout string)
+	}{
+		{
+			desc: "ruleset and plan",
+			args: []string{"-ip-config", cm},
+			check: func(t *testing.T, stdout string) {
+				ruleset, plan, found := strings.Cut(stdout, "\n\n{")
+				if !assert.True(t, found, "ruleset and plan must be separated by a blank line") {
+					return
+				}
+				assert.Contains(t, ruleset, "add element inet egress_cni dnat-ipv4 { tcp . 80 comment \"80 tcp 10.100.3.1\" : 10.100.3.1 . 80 }")
+				p := &macvlan.Plan{}
+				if assert.NoError(t, json.Unmarshal([]byte("{"+plan), p)) {
+					assert.Equal(t, []string{"192.168.3.10/24"}, p.Addresses)
+					assert.Empty(t, p.Ruleset)
+				}
+			},
+		},
+		{
+			desc: "JSON plan only",
+			args: []string{"-json", "-interface", "net2", "-ip-config", cm, "-"},
+			check: func(t *testing.T, stdout string) {
+				p := &macvlan.Plan{}
+				if assert.NoError(t, json.Unmarshal([]byte(stdout), p)) {
+					assert.Equal(t, "net2", p.Interface.Name)
+					assert.Contains(t, p.Ruleset, "oif net2 snat ip to 192.168.3.10")
+				}
+			},
+		},
+		{
+			desc:     "missing ConfigMap",
+			exitCode: 1,
+		},
+		{
+			desc:     "unreadable ConfigMap",
+			args:     []string{"-ip-config", cm + ".missing"},
+			exitCode: 2,
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			exitCode := render(tc.args, strings.NewReader(conf), &stdout, &stderr)
+			assert.Equal(t, tc.exitCode, exitCode, stderr.String())
+			if tc.check != nil {
+				tc.check(t, stdout.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/openshift/egress-router-cni/pkg/macvlan"
+)
+
+// validate implements "egress-router validate [-json] [file|-]": it checks a
+// network configuration without touching the network, prints every problem
+// found and returns the exit code, 1 if the configuration has problems and 2 if
+// it cannot be read.
+func validate(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	asJSON := flags.Bool("json", false, "print the problems as a JSON array of {\"pointer\", \"message\"} objects")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: egress-router validate [-json] [file|-]\n\n"+
+			"Validates the network configuration in file, or on stdin if file is \"-\" or\n"+
+			"omitted. The configuration may also be a NetworkAttachmentDefinition in JSON,\n"+
+			"in which case its spec.config is validated. Problems are located by JSON\n"+
+			"pointers into the configuration.\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	data, err := readConfig(flags.Arg(0), stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 2
+	}
+
+	problems := macvlan.Validate(data)
+	if *asJSON {
+		if problems == nil {
+			problems = []macvlan.Problem{}
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(problems); err != nil {
+			fmt.Fprintf(stderr, "failed to print problems: %v\n", err)
+			return 2
+		}
+	} else {
+		for _, p := range problems {
+			fmt.Fprintln(stdout, p)
+		}
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readConfig reads the network configuration from file, or from stdin if file is
+// "-" or empty. The spec.config of a NetworkAttachmentDefinition is unwrapped.
+func readConfig(file string, stdin io.Reader) ([]byte, error) {
+	var data []byte
+	var err error
+	if file == "" || file == "-" {
+		data, err = io.ReadAll(stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration: %v", err)
+	}
+
+	var nad struct {
+		Kind string `json:"kind"`
+		Spec struct {
+			Config string `json:"config"`
+		} `json:"spec"`
+	}
+	if json.Unmarshal(data, &nad) == nil && nad.Kind == "NetworkAttachmentDefinition" {
+		if nad.Spec.Config == "" {
+			return nil, fmt.Errorf("the NetworkAttachmentDefinition has no spec.config")
+		}
+		return []byte(nad.Spec.Config), nil
+	}
+	return data, nil
+}
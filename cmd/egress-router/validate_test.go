@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	const valid = `{"cniVersion": "0.4.0", "name": "egress", "type": "egress-router", "ip": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1"}}`
+	file := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(file, []byte(valid), 0600))
+
+	tests := []struct {
+		desc     string
+		args     []string
+		stdin    string
+		exitCode int
+		stdout   string
+	}{
+		{
+			desc: "valid file",
+			args: []string{file},
+		},
+		{
+			desc:  "valid stdin",
+			args:  []string{"-"},
+			stdin: valid,
+		},
+		{
+			desc:     "NetworkAttachmentDefinition",
+			stdin:    `{"apiVersion": "k8s.cni.cncf.io/v1", "kind": "NetworkAttachmentDefinition", "spec": {"config": "{\"ip\": {\"addresses\": [\"192.168.3.10/24\"], \"gateway\": \"192.168.4.1\"}}"}}`,
+			exitCode: 1,
+			stdout:   "/ip/gateway: gateway 192.168.4.1 is not in the subnet of any IPv4 address\n",
+		},
+		{
+			desc:     "problems as JSON",
+			args:     []string{"-json"},
+			stdin:    `{"mode": "socks", "ip": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1"}}`,
+			exitCode: 1,
+			stdout:   "[\n  {\n    \"pointer\": \"/mode\",\n    \"message\": \"unsupported mode \\\"socks\\\"\"\n  }\n]\n",
+		},
+		{
+			desc:   "no problems as JSON",
+			args:   []string{"-json", file},
+			stdout: "[]\n",
+		},
+		{
+			desc:     "missing file",
+			args:     []string{file + ".missing"},
+			exitCode: 2,
+		},
+		{
+			desc:     "too many arguments",
+			args:     []string{file, file},
+			exitCode: 2,
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			exitCode := validate(tc.args, strings.NewReader(tc.stdin), &stdout, &stderr)
+			assert.Equal(t, tc.exitCode, exitCode, stderr.String())
+			assert.Equal(t, tc.stdout, stdout.String())
+		})
+	}
+}
@@ -1,9 +1,10 @@
 #!/usr/bin/env bash
 set -eu
-cmd=egress-router
 eval $(go env | grep -e "GOHOSTOS" -e "GOHOSTARCH")
 GOOS=${GOOS:-${GOHOSTOS}}
 GOARCH=${GOACH:-${GOHOSTARCH}}
 GOFLAGS=${GOFLAGS:-}
 GLDFLAGS=${GLDFLAGS:-}
-CGO_ENABLED=0 GOOS=${GOOS} GOARCH=${GOARCH} go build ${GOFLAGS} -ldflags "${GLDFLAGS}" -o bin/${cmd} cmd/${cmd}/${cmd}.go
+for cmd in egress-router egress-router-http-proxy egress-router-dns-proxy egress-router-agent; do
+	CGO_ENABLED=0 GOOS=${GOOS} GOARCH=${GOARCH} go build ${GOFLAGS} -ldflags "${GLDFLAGS}" -o bin/${cmd} cmd/${cmd}/${cmd}.go
+done
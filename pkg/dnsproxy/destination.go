@@ -0,0 +1,106 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/openshift/egress-router-cni/pkg/types"
+	"github.com/openshift/egress-router-cni/pkg/util"
+)
+
+// Destination is a validated destination of the dns-proxy mode.
+type Destination struct {
+	// LocalPort is the port the proxy listens on
+	LocalPort int
+	// Host is the host name or IP address connections are forwarded to
+	Host string
+	// TargetPort is the port connections are forwarded to
+	TargetPort int
+}
+
+// String returns the destination in the "<localPort> <host> <targetPort>" format.
+func (d Destination) String() string {
+	return fmt.Sprintf("%d %s %d", d.LocalPort, d.Host, d.TargetPort)
+}
+
+// ParseDestinations parses and validates the destinations of the dns-proxy mode,
+// given either as objects or in the "<localPort> <host> [<targetPort>]" format.
+// Every local port may only be used once.
+func ParseDestinations(dests []types.Destination) ([]Destination, error) {
+	parsed := make([]Destination, 0, len(dests))
+	parser := NewParser()
+	for i, d := range dests {
+		dest, err := parser.Parse(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination %d (%q): %v", i, d.String(), err)
+		}
+		parsed = append(parsed, dest)
+	}
+	return parsed, nil
+}
+
+// Parser parses the destinations of the dns-proxy mode one at a time, rejecting
+// a local port used by a previous destination.
+type Parser struct {
+	ports map[int]bool
+}
+
+// NewParser returns a Parser that has not seen any destination.
+func NewParser() *Parser {
+	return &Parser{ports: map[int]bool{}}
+}
+
+// Parse parses and validates d, the next destination.
+func (p *Parser) Parse(d types.Destination) (Destination, error) {
+	dest, err := ParseDestination(d)
+	if err != nil {
+		return Destination{}, err
+	}
+	if p.ports[dest.LocalPort] {
+		return Destination{}, fmt.Errorf("local port %d is used more than once", dest.LocalPort)
+	}
+	p.ports[dest.LocalPort] = true
+	return dest, nil
+}
+
+// ParseDestination parses and validates a single destination of the dns-proxy mode.
+func ParseDestination(d types.Destination) (Destination, error) {
+	if d.Legacy != "" {
+		fields := strings.Fields(d.Legacy)
+		if len(fields) != 2 && len(fields) != 3 {
+			return Destination{}, fmt.Errorf("expected \"<localPort> <host> [<targetPort>]\"")
+		}
+		d = types.Destination{Target: fields[1]}
+		var err error
+		if d.LocalPort, err = strconv.Atoi(fields[0]); err != nil {
+			return Destination{}, fmt.Errorf("local port %q is not a number", fields[0])
+		}
+		if len(fields) == 3 {
+			if d.TargetPort, err = strconv.Atoi(fields[2]); err != nil {
+				return Destination{}, fmt.Errorf("target port %q is not a number", fields[2])
+			}
+		}
+	}
+
+	if p := strings.ToLower(d.Protocol); p != "" && p != "tcp" {
+		return Destination{}, fmt.Errorf("unsupported protocol %q, only tcp is proxied", d.Protocol)
+	}
+	if d.LocalPort < 1 || d.LocalPort > 65535 {
+		return Destination{}, fmt.Errorf("local port %d out of range 1-65535", d.LocalPort)
+	}
+	if d.TargetPort == 0 {
+		d.TargetPort = d.LocalPort
+	}
+	if d.TargetPort < 1 || d.TargetPort > 65535 {
+		return Destination{}, fmt.Errorf("target port %d out of range 1-65535", d.TargetPort)
+	}
+	if d.Target == "" {
+		return Destination{}, fmt.Errorf("missing target")
+	}
+	if net.ParseIP(d.Target) == nil && !util.ValidHostName(d.Target) {
+		return Destination{}, fmt.Errorf("target %q is neither a host name nor an IP address", d.Target)
+	}
+	return Destination{LocalPort: d.LocalPort, Host: strings.TrimSuffix(d.Target, "."), TargetPort: d.TargetPort}, nil
+}
@@ -0,0 +1,77 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+func TestParseDestinations(t *testing.T) {
+	tests := []struct {
+		desc     string
+		dests    []types.Destination
+		expected []Destination
+		errMatch error
+	}{
+		{
+			desc: "legacy and object destinations",
+			dests: []types.Destination{
+				{Legacy: "443 partner.example.com"},
+				{Legacy: "8080 api.example.com 80"},
+				{LocalPort: 5432, Target: "db.example.com.", TargetPort: 15432},
+				{LocalPort: 22, Protocol: "TCP", Target: "203.0.113.10"},
+			},
+			expected: []Destination{
+				{LocalPort: 443, Host: "partner.example.com", TargetPort: 443},
+				{LocalPort: 8080, Host: "api.example.com", TargetPort: 80},
+				{LocalPort: 5432, Host: "db.example.com", TargetPort: 15432},
+				{LocalPort: 22, Host: "203.0.113.10", TargetPort: 22},
+			},
+		},
+		{
+			desc:     "redirect mode format",
+			dests:    []types.Destination{{Legacy: "80 tcp 10.0.0.1"}},
+			errMatch: fmt.Errorf("invalid destination 0 (\"80 tcp 10.0.0.1\"): target port \"10.0.0.1\" is not a number"),
+		},
+		{
+			desc:     "target only",
+			dests:    []types.Destination{{Legacy: "partner.example.com"}},
+			errMatch: fmt.Errorf("expected \"<localPort> <host> [<targetPort>]\""),
+		},
+		{
+			desc:     "invalid host",
+			dests:    []types.Destination{{Legacy: "443 partner_example!com"}},
+			errMatch: fmt.Errorf("target \"partner_example!com\" is neither a host name nor an IP address"),
+		},
+		{
+			desc:     "udp",
+			dests:    []types.Destination{{LocalPort: 53, Protocol: "udp", Target: "dns.example.com"}},
+			errMatch: fmt.Errorf("unsupported protocol \"udp\", only tcp is proxied"),
+		},
+		{
+			desc:     "local port out of range",
+			dests:    []types.Destination{{Legacy: "0 partner.example.com"}},
+			errMatch: fmt.Errorf("local port 0 out of range 1-65535"),
+		},
+		{
+			desc:     "duplicate local port",
+			dests:    []types.Destination{{Legacy: "443 a.example.com"}, {Legacy: "443 b.example.com"}},
+			errMatch: fmt.Errorf("invalid destination 1 (\"443 b.example.com\"): local port 443 is used more than once"),
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			dests, err := ParseDestinations(tc.dests)
+			if tc.errMatch != nil {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errMatch.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, dests)
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// Package dnsproxy implements the TCP proxy of the "dns-proxy" egress mode. It
+// runs in the egress router pod, listens on the local port of every destination
+// and forwards connections, TLS included, to the current addresses of the
+// destination host, which are resolved periodically.
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+)
+
+// DefaultResolveInterval is how often destination hosts are resolved again when
+// the configuration does not say otherwise.
+const DefaultResolveInterval = 30 * time.Second
+
+// Proxy forwards connections to the destinations of the dns-proxy mode.
+type Proxy struct {
+	destinations []Destination
+	// listenAddresses are the addresses the local ports are listened on
+	listenAddresses []net.IP
+	// sources maps whether an address is IPv6 to the local address that
+	// outgoing connections of that family are bound to
+	sources  map[bool]net.IP
+	interval time.Duration
+
+	mu sync.Mutex
+	// addresses maps every host to its last resolved addresses
+	addresses map[string][]net.IP
+	// next is the index of the address of each host used by the next connection
+	next map[string]int
+
+	// lookupIP resolves host names, and is replaced in tests
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// New returns a Proxy for destinations, listening on listenAddresses, which are
+// the addresses of the cluster interface. Outgoing connections are bound to the
+// address of their family in sources, which are the egress addresses, and hosts
+// are resolved again every interval.
+func New(destinations []Destination, listenAddresses, sources []net.IP, interval time.Duration) *Proxy {
+	p := &Proxy{
+		destinations:    destinations,
+		listenAddresses: listenAddresses,
+		sources:         map[bool]net.IP{},
+		interval:        interval,
+		addresses:       map[string][]net.IP{},
+		next:            map[string]int{},
+		lookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+	}
+	for _, ip := range sources {
+		isIPv6 := ip.To4() == nil
+		if _, ok := p.sources[isIPv6]; !ok {
+			p.sources[isIPv6] = ip
+		}
+	}
+	return p
+}
+
+// Run listens on the local port of every destination, on every listen address,
+// and forwards connections until ctx is cancelled.
+func (p *Proxy) Run(ctx context.Context) error {
+	p.resolveAll(ctx)
+
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	var served []Destination
+	for _, d := range p.destinations {
+		for _, ip := range p.listenAddresses {
+			l, err := net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(d.LocalPort)))
+			if err != nil {
+				return fmt.Errorf("failed to listen for destination %q: %v", d, err)
+			}
+			listeners = append(listeners, l)
+			served = append(served, d)
+		}
+	}
+
+	for i, l := range listeners {
+		go p.serve(l, served[i])
+	}
+	logging.Verbosef("Forwarding %d destinations from %v, connecting from %v", len(p.destinations), p.listenAddresses, p.sources)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// Closing the listeners stops serve
+			return nil
+		case <-ticker.C:
+			p.resolveAll(ctx)
+		}
+	}
+}
+
+// resolveAll resolves every destination host. A host that fails to resolve keeps
+// its previous addresses.
+func (p *Proxy) resolveAll(ctx context.Context) {
+	for _, d := range p.destinations {
+		if ip := net.ParseIP(d.Host); ip != nil {
+			p.setAddresses(d.Host, []net.IP{ip})
+			continue
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		ips, err := p.lookupIP(lookupCtx, d.Host)
+		cancel()
+		if err != nil {
+			logging.Errorf("Failed to resolve %s, keeping previous addresses: %v", d.Host, err)
+			continue
+		}
+		p.setAddresses(d.Host, ips)
+	}
+}
+
+func (p *Proxy) setAddresses(host string, ips []net.IP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if fmt.Sprint(p.addresses[host]) != fmt.Sprint(ips) {
+		logging.Verbosef("%s resolves to %v", host, ips)
+	}
+	p.addresses[host] = ips
+}
+
+// targets returns the addresses of host in the order they should be tried,
+// rotating the first one between calls.
+func (p *Proxy) targets(host string) []net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ips := p.addresses[host]
+	if len(ips) == 0 {
+		return nil
+	}
+	start := p.next[host] % len(ips)
+	p.next[host] = start + 1
+	return append(append([]net.IP{}, ips[start:]...), ips[:start]...)
+}
+
+// serve accepts connections on l and forwards them to d until l is closed.
+func (p *Proxy) serve(l net.Listener, d Destination) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		go p.forward(conn, d)
+	}
+}
+
+// forward connects to d from the egress address and copies data in both
+// directions until both sides are done.
+func (p *Proxy) forward(client net.Conn, d Destination) {
+	defer client.Close()
+
+	upstream, err := p.dial(d)
+	if err != nil {
+		logging.Errorf("Failed to connect to %s for %s: %v", d.Host, client.RemoteAddr(), err)
+		return
+	}
+	defer upstream.Close()
+	logging.Debugf("Forwarding %s to %s (%s)", client.RemoteAddr(), d.Host, upstream.RemoteAddr())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, client)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+	wg.Wait()
+}
+
+// dial connects to the first reachable address of d.
+func (p *Proxy) dial(d Destination) (net.Conn, error) {
+	ips := p.targets(d.Host)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s has not been resolved", d.Host)
+	}
+	var lastErr error
+	for _, ip := range ips {
+		source, ok := p.sources[ip.To4() == nil]
+		if !ok {
+			lastErr = fmt.Errorf("no egress address for %s", ip)
+			continue
+		}
+		dialer := &net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: source},
+			Timeout:   30 * time.Second,
+		}
+		conn, err := dialer.Dial("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(d.TargetPort)))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// closeWrite half-closes conn so that the peer sees the end of the stream.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
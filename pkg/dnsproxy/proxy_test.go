@@ -0,0 +1,121 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startBackend starts a TCP server on the loopback address that greets every
+// connection with name.
+func startBackend(t *testing.T, name string) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "%s\n", name)
+			conn.Close()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestProxyFollowsResolution(t *testing.T) {
+	port := startBackend(t, "backend")
+	dest := Destination{LocalPort: 443, Host: "partner.example.com", TargetPort: port}
+
+	resolved := []net.IP{net.ParseIP("127.0.0.1")}
+	p := New([]Destination{dest}, []net.IP{net.ParseIP("127.0.0.1")}, []net.IP{net.ParseIP("127.0.0.1")}, DefaultResolveInterval)
+	p.lookupIP = func(_ context.Context, host string) ([]net.IP, error) {
+		if resolved == nil {
+			return nil, fmt.Errorf("lookup %s: no such host", host)
+		}
+		return resolved, nil
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	go p.serve(l, dest)
+
+	greeting := func() (string, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return bufio.NewReader(conn).ReadString('\n')
+	}
+
+	// Nothing is forwarded before the host has been resolved
+	_, err = greeting()
+	assert.Error(t, err)
+
+	p.resolveAll(context.Background())
+	line, err := greeting()
+	assert.NoError(t, err)
+	assert.Equal(t, "backend\n", line)
+
+	// A failed resolution keeps the previous addresses
+	resolved = nil
+	p.resolveAll(context.Background())
+	line, err = greeting()
+	assert.NoError(t, err)
+	assert.Equal(t, "backend\n", line)
+
+	// Unreachable addresses are skipped
+	resolved = []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")}
+	p.resolveAll(context.Background())
+	for i := 0; i < 2; i++ {
+		line, err = greeting()
+		assert.NoError(t, err, "attempt %d", i)
+		assert.Equal(t, "backend\n", line)
+	}
+}
+
+func TestProxyListensOnListenAddresses(t *testing.T) {
+	backend := startBackend(t, "backend")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	dest := Destination{LocalPort: port, Host: "127.0.0.1", TargetPort: backend}
+	p := New([]Destination{dest}, []net.IP{net.ParseIP("127.0.0.1")}, []net.IP{net.ParseIP("127.0.0.1")}, DefaultResolveInterval)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = p.Run(ctx) }()
+
+	var conn net.Conn
+	assert.Eventually(t, func() bool {
+		conn, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	if conn != nil {
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, "backend\n", line)
+	}
+
+	// Other local addresses are not listened on
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.2", strconv.Itoa(port)))
+	assert.Error(t, err)
+}
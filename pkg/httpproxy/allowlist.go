@@ -0,0 +1,89 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/openshift/egress-router-cni/pkg/util"
+)
+
+// Allowlist is the set of destinations the HTTP proxy may connect to.
+type Allowlist struct {
+	all     bool
+	hosts   map[string]bool
+	domains []string
+	nets    []*net.IPNet
+}
+
+// ParseAllowlist parses allowlist entries. An entry is either "*", which allows
+// every destination, a host name ("www.example.com"), a domain and all of its
+// subdomains ("*.example.com"), an IP address or a CIDR.
+func ParseAllowlist(entries []string) (*Allowlist, error) {
+	a := &Allowlist{hosts: map[string]bool{}}
+	for _, entry := range entries {
+		e := strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case e == "":
+			return nil, fmt.Errorf("empty allowlist entry")
+		case e == "*":
+			a.all = true
+		case strings.HasPrefix(e, "*."):
+			domain := strings.TrimPrefix(e, "*.")
+			if !util.ValidHostName(domain) {
+				return nil, fmt.Errorf("invalid domain in allowlist entry %q", entry)
+			}
+			a.domains = append(a.domains, domain)
+		case net.ParseIP(e) != nil:
+			ip := net.ParseIP(e)
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			a.nets = append(a.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		case strings.Contains(e, "/"):
+			_, ipnet, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR in allowlist entry %q: %v", entry, err)
+			}
+			a.nets = append(a.nets, ipnet)
+		default:
+			if !util.ValidHostName(e) {
+				return nil, fmt.Errorf("invalid host name in allowlist entry %q", entry)
+			}
+			a.hosts[strings.TrimSuffix(e, ".")] = true
+		}
+	}
+	return a, nil
+}
+
+// AllowsHost reports whether the host name is allowed by a host or domain entry.
+func (a *Allowlist) AllowsHost(host string) bool {
+	if a.all {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if a.hosts[host] {
+		return true
+	}
+	for _, domain := range a.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP reports whether ip is allowed by an IP address or CIDR entry.
+func (a *Allowlist) AllowsIP(ip net.IP) bool {
+	if a.all {
+		return true
+	}
+	for _, ipnet := range a.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAllowlist(t *testing.T) {
+	tests := []struct {
+		desc     string
+		entries  []string
+		hosts    map[string]bool
+		ips      map[string]bool
+		errMatch error
+	}{
+		{
+			desc:    "hosts, domains, IPs and CIDRs",
+			entries: []string{"www.example.com", "*.example.org", "203.0.113.10", "10.0.0.0/8", "2001:db8::/32"},
+			hosts: map[string]bool{
+				"www.example.com":    true,
+				"WWW.Example.com.":   true,
+				"api.example.com":    false,
+				"example.org":        true,
+				"a.b.example.org":    true,
+				"badexample.org":     false,
+				"www.example.com.ru": false,
+			},
+			ips: map[string]bool{
+				"203.0.113.10": true,
+				"203.0.113.11": false,
+				"10.1.2.3":     true,
+				"2001:db8::1":  true,
+				"2001:db9::1":  false,
+			},
+		},
+		{
+			desc:    "everything",
+			entries: []string{"*"},
+			hosts:   map[string]bool{"www.example.com": true},
+			ips:     map[string]bool{"192.0.2.1": true},
+		},
+		{
+			desc:     "invalid CIDR",
+			entries:  []string{"10.0.0.0/33"},
+			errMatch: fmt.Errorf("invalid CIDR in allowlist entry \"10.0.0.0/33\""),
+		},
+		{
+			desc:     "invalid host name",
+			entries:  []string{"www.example.com:443"},
+			errMatch: fmt.Errorf("invalid host name in allowlist entry \"www.example.com:443\""),
+		},
+		{
+			desc:     "invalid domain",
+			entries:  []string{"*."},
+			errMatch: fmt.Errorf("invalid domain in allowlist entry \"*.\""),
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			a, err := ParseAllowlist(tc.entries)
+			if tc.errMatch != nil {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errMatch.Error())
+				return
+			}
+			assert.NoError(t, err)
+			for host, allowed := range tc.hosts {
+				assert.Equal(t, allowed, a.AllowsHost(host), host)
+			}
+			for ip, allowed := range tc.ips {
+				assert.Equal(t, allowed, a.AllowsIP(net.ParseIP(ip)), ip)
+			}
+		})
+	}
+}
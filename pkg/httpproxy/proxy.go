@@ -0,0 +1,257 @@
+// Package httpproxy implements the HTTP proxy of the "http-proxy" egress mode. It
+// runs in the egress router pod, accepts CONNECT and plain HTTP forward proxy
+// requests from the cluster, and connects to allowlisted destinations from the
+// egress address.
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+)
+
+// DefaultPort is the port the proxy listens on when the configuration does not set one.
+const DefaultPort = 8080
+
+// hopByHopHeaders are not forwarded by proxies, see RFC 7230 section 6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Proxy is an http.Handler serving CONNECT and forward proxy requests.
+type Proxy struct {
+	allowlist *Allowlist
+	// sources maps whether an address is IPv6 to the local address that
+	// outgoing connections of that family are bound to
+	sources   map[bool]net.IP
+	transport *http.Transport
+
+	// lookupIP resolves host names, and is replaced in tests
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// New returns a Proxy enforcing allowlist. Outgoing connections are bound to
+// the address of their family in sources, which are the egress addresses.
+func New(allowlist *Allowlist, sources []net.IP) *Proxy {
+	p := &Proxy{
+		allowlist: allowlist,
+		sources:   map[bool]net.IP{},
+		lookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+	}
+	for _, ip := range sources {
+		isIPv6 := ip.To4() == nil
+		if _, ok := p.sources[isIPv6]; !ok {
+			p.sources[isIPv6] = ip
+		}
+	}
+	p.transport = &http.Transport{
+		DialContext:           p.dialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+	return p
+}
+
+// deniedError is returned when a destination is not allowlisted.
+type deniedError struct {
+	host string
+}
+
+func (e *deniedError) Error() string {
+	return fmt.Sprintf("destination %q is not allowed", e.host)
+}
+
+// resolve returns the addresses of host that the allowlist permits connecting to.
+func (p *Proxy) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if !p.allowlist.AllowsIP(ip) {
+			return nil, &deniedError{host: host}
+		}
+		return []net.IP{ip}, nil
+	}
+
+	ips, err := p.lookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if p.allowlist.AllowsHost(host) {
+		return ips, nil
+	}
+	var allowed []net.IP
+	for _, ip := range ips {
+		if p.allowlist.AllowsIP(ip) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, &deniedError{host: host}
+	}
+	return allowed, nil
+}
+
+// dialContext connects to an allowlisted address of addr from the egress address
+// of its family.
+func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := p.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		source, ok := p.sources[ip.To4() == nil]
+		if !ok {
+			lastErr = fmt.Errorf("no egress address for %s", ip)
+			continue
+		}
+		dialer := &net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: source},
+			Timeout:   30 * time.Second,
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// ServeHTTP implements http.Handler.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.serveConnect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "this is a proxy, requests must use an absolute URI", http.StatusBadRequest)
+		return
+	}
+	p.serveForward(w, r)
+}
+
+// writeDialError reports a failure to reach a destination to the client.
+func writeDialError(w http.ResponseWriter, r *http.Request, err error) {
+	var denied *deniedError
+	if errors.As(err, &denied) {
+		logging.Verbosef("Denied %s %s from %s", r.Method, r.Host, r.RemoteAddr)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	logging.Errorf("Failed to connect to %s for %s: %v", r.Host, r.RemoteAddr, err)
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// serveConnect tunnels a CONNECT request to the destination.
+func (p *Proxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	if _, port, err := net.SplitHostPort(r.Host); err != nil || port == "" {
+		http.Error(w, fmt.Sprintf("invalid CONNECT target %q", r.Host), http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	upstream, err := p.dialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		writeDialError(w, r, err)
+		return
+	}
+	defer upstream.Close()
+
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		logging.Errorf("Failed to hijack connection from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	logging.Debugf("Tunneling %s to %s", r.RemoteAddr, r.Host)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// Forward whatever the client sent after the CONNECT request
+		io.Copy(upstream, buf)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+	wg.Wait()
+}
+
+// closeWrite half-closes conn so that the peer sees the end of the stream.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
+
+// serveForward forwards a plain HTTP request to the destination.
+func (p *Proxy) serveForward(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Scheme != "http" {
+		http.Error(w, fmt.Sprintf("unsupported scheme %q, use CONNECT for https", r.URL.Scheme), http.StatusBadRequest)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	removeHopByHopHeaders(out.Header)
+
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		writeDialError(w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopByHopHeaders(resp.Header)
+	for name, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	logging.Debugf("Forwarded %s %s for %s: %d", r.Method, r.URL, r.RemoteAddr, resp.StatusCode)
+}
+
+func removeHopByHopHeaders(h http.Header) {
+	for _, name := range h.Values("Connection") {
+		h.Del(name)
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,110 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestProxy starts a proxy that connects from the loopback address and
+// resolves every host name to it.
+func newTestProxy(t *testing.T, allowlist ...string) *url.URL {
+	a, err := ParseAllowlist(allowlist)
+	if err != nil {
+		t.Fatalf("unexpected error parsing allowlist: %v", err)
+	}
+	p := New(a, []net.IP{net.ParseIP("127.0.0.1")})
+	p.lookupIP = func(_ context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("127.0.0.1")}, nil
+	}
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+	proxyURL, _ := url.Parse(server.URL)
+	return proxyURL
+}
+
+func TestProxy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	backend := httptest.NewServer(handler)
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(handler)
+	defer tlsBackend.Close()
+
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	_, tlsPort, _ := net.SplitHostPort(tlsBackend.Listener.Addr().String())
+
+	tests := []struct {
+		desc      string
+		allowlist []string
+		url       string
+		status    int
+	}{
+		{
+			desc:      "forward to allowed IP",
+			allowlist: []string{"127.0.0.0/8"},
+			url:       "http://127.0.0.1:" + port + "/",
+			status:    http.StatusOK,
+		},
+		{
+			desc:      "forward to allowed domain",
+			allowlist: []string{"*.example.com"},
+			url:       "http://backend.example.com:" + port + "/",
+			status:    http.StatusOK,
+		},
+		{
+			desc:      "forward to host resolving to an allowed CIDR",
+			allowlist: []string{"127.0.0.1"},
+			url:       "http://backend.example.net:" + port + "/",
+			status:    http.StatusOK,
+		},
+		{
+			desc:      "forward to denied host",
+			allowlist: []string{"www.example.com", "10.0.0.0/8"},
+			url:       "http://backend.example.com:" + port + "/",
+			status:    http.StatusForbidden,
+		},
+		{
+			desc:      "CONNECT to allowed host",
+			allowlist: []string{"backend.example.com"},
+			url:       "https://backend.example.com:" + tlsPort + "/",
+			status:    http.StatusOK,
+		},
+		{
+			desc:      "CONNECT to denied IP",
+			allowlist: []string{"10.0.0.0/8"},
+			url:       "https://127.0.0.1:" + tlsPort + "/",
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			transport := tlsBackend.Client().Transport.(*http.Transport).Clone()
+			transport.Proxy = http.ProxyURL(newTestProxy(t, tc.allowlist...))
+			transport.TLSClientConfig.InsecureSkipVerify = true
+			client := &http.Client{Transport: transport}
+
+			resp, err := client.Get(tc.url)
+			if tc.status == 0 {
+				// A refused CONNECT is reported as an error by the client
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), "Forbidden")
+				return
+			}
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.status, resp.StatusCode)
+			if tc.status == http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				assert.Equal(t, "hello", string(body))
+			}
+		})
+	}
+}
@@ -15,6 +15,8 @@
 package logging
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -36,9 +38,27 @@ const (
 	UnknownLevel
 )
 
+// Format is the output format of log lines.
+type Format string
+
+// TextFormat and JSONFormat are the supported log formats.
+const (
+	TextFormat Format = "text"
+	JSONFormat Format = "json"
+)
+
+// Field is a key and value carried by every log line, such as the identity of
+// the CNI invocation the line belongs to.
+type Field struct {
+	Key   string
+	Value string
+}
+
 var loggingStderr bool
 var loggingFp *os.File
 var loggingLevel Level
+var loggingFormat Format
+var loggingContext []Field
 
 const defaultTimestampFormat = time.RFC3339
 
@@ -58,25 +78,51 @@ func (l Level) String() string {
 
 // Printf provides basic Printf functionality for logs
 func Printf(level Level, format string, a ...interface{}) {
-	header := "%s [%s] "
 	t := time.Now()
 	if level > loggingLevel {
 		return
 	}
 
+	line := formatLine(t, level, fmt.Sprintf(format, a...))
 	if loggingStderr {
-		fmt.Fprintf(os.Stderr, header, t.Format(defaultTimestampFormat), level)
-		fmt.Fprintf(os.Stderr, format, a...)
-		fmt.Fprintf(os.Stderr, "\n")
+		os.Stderr.Write(line)
 	}
 
 	if loggingFp != nil {
-		fmt.Fprintf(loggingFp, header, t.Format(defaultTimestampFormat), level)
-		fmt.Fprintf(loggingFp, format, a...)
-		fmt.Fprintf(loggingFp, "\n")
+		writeFile(line)
 	}
 }
 
+// formatLine renders a log line in the current format, context fields included.
+func formatLine(t time.Time, level Level, msg string) []byte {
+	var b bytes.Buffer
+	if loggingFormat == JSONFormat {
+		fmt.Fprintf(&b, `{"time":%s,"level":%s,"msg":%s`, jsonString(t.Format(defaultTimestampFormat)), jsonString(level.String()), jsonString(msg))
+		for _, f := range loggingContext {
+			if f.Value != "" {
+				fmt.Fprintf(&b, ",%s:%s", jsonString(f.Key), jsonString(f.Value))
+			}
+		}
+		b.WriteString("}\n")
+		return b.Bytes()
+	}
+
+	fmt.Fprintf(&b, "%s [%s] ", t.Format(defaultTimestampFormat), level)
+	for _, f := range loggingContext {
+		if f.Value != "" {
+			fmt.Fprintf(&b, "%s=%s ", f.Key, f.Value)
+		}
+	}
+	b.WriteString(msg)
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+func jsonString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
 // Debugf defines our printf for debug level.
 func Debugf(format string, a ...interface{}) {
 	Printf(DebugLevel, format, a...)
@@ -129,27 +175,54 @@ func SetLogLevel(levelStr string) {
 	}
 }
 
+// SetLogFormat sets loggingFormat
+func SetLogFormat(formatStr string) {
+	switch format := Format(strings.ToLower(formatStr)); format {
+	case TextFormat, JSONFormat:
+		loggingFormat = format
+	default:
+		fmt.Fprintf(os.Stderr, "Egress Router CNI logging: cannot set logging format to %s\n", formatStr)
+	}
+}
+
+// SetLogContext sets the fields carried by every subsequent log line, replacing
+// the previous ones.
+func SetLogContext(fields ...Field) {
+	loggingContext = fields
+}
+
 // SetLogStderr enables logging to stderr
 func SetLogStderr(enable bool) {
 	loggingStderr = enable
 }
 
-// SetLogFile defines which log file we'll log to
+// SetLogFile defines which log file we'll log to. The previous log file, if any,
+// is closed. If the file cannot be opened, logs go to stderr instead.
 func SetLogFile(filename string) {
 	if filename == "" {
 		return
 	}
+	if loggingFp != nil && filename == loggingFile {
+		return
+	}
 
-	fp, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-	if err != nil {
+	fp, err := openLogFile(filename)
+	if loggingFp != nil {
+		loggingFp.Close()
 		loggingFp = nil
-		fmt.Fprintf(os.Stderr, "Egress Router CNI logging: cannot open %s", filename)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Egress Router CNI logging: cannot open %s, logging to stderr: %v\n", filename, err)
+		loggingStderr = true
+		return
 	}
 	loggingFp = fp
+	loggingFile = filename
 }
 
 func init() {
 	loggingStderr = true
 	loggingFp = nil
 	loggingLevel = DebugLevel
+	loggingFormat = TextFormat
 }
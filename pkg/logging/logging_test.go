@@ -15,10 +15,14 @@
 package logging
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
 )
 
 func TestLogging(t *testing.T) {
@@ -27,11 +31,24 @@ func TestLogging(t *testing.T) {
 }
 
 var _ = Describe("logging operations", func() {
+	var dir string
 
 	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "logging")
+		Expect(err).NotTo(HaveOccurred())
+
 		loggingStderr = false
 		loggingFp = nil
 		loggingLevel = PanicLevel
+		loggingFormat = TextFormat
+		loggingContext = nil
+		loggingFile = ""
+		loggingRotation = rotation{}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
 	})
 
 	It("Check file setter with empty", func() {
@@ -44,6 +61,126 @@ var _ = Describe("logging operations", func() {
 		Expect(loggingFp).NotTo(Equal(nil))
 	})
 
+	It("Check file setter falls back to stderr", func() {
+		SetLogFile("/nonexistent/foobar.logging")
+		Expect(loggingFp).To(BeNil())
+		Expect(loggingStderr).To(BeTrue())
+	})
+
+	It("Check file setter closes the previous file", func() {
+		SetLogFile(filepath.Join(dir, "first.log"))
+		first := loggingFp
+		SetLogFile(filepath.Join(dir, "second.log"))
+		Expect(loggingFp).NotTo(Equal(first))
+		_, err := first.Write([]byte("x"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Check the log file is rotated by size", func() {
+		filename := filepath.Join(dir, "egress.log")
+		SetLogFile(filename)
+		loggingLevel = DebugLevel
+		loggingRotation = rotation{maxSize: 100, maxBackups: 2}
+
+		for i := 0; i < 10; i++ {
+			Debugf("line %d of the log file", i)
+		}
+		backups, err := rotatedFiles(filename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backups).To(HaveLen(2))
+		data, err := os.ReadFile(filename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring("line 9 of the log file"))
+		Expect(len(data)).To(BeNumerically("<=", 100))
+	})
+
+	It("Check old rotated files are deleted", func() {
+		filename := filepath.Join(dir, "egress.log")
+		now := time.Now()
+		for _, age := range []time.Duration{49 * time.Hour, 25 * time.Hour, time.Hour} {
+			Expect(os.WriteFile(filename+"."+now.Add(-age).Format(rotatedTimeFormat), nil, 0644)).To(Succeed())
+		}
+		Expect(os.WriteFile(filename, []byte("current\n"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filename+".unrelated", nil, 0644)).To(Succeed())
+
+		loggingRotation = rotation{maxAge: 48 * time.Hour}
+		Expect(rotateFile(filename, now)).To(Succeed())
+		backups, err := rotatedFiles(filename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backups).To(HaveLen(3))
+		Expect(backups[0].path).To(Equal(filename + "." + now.Format(rotatedTimeFormat)))
+		Expect(filename + ".unrelated").To(BeAnExistingFile())
+	})
+
+	It("Check files rotated at the same time are all kept", func() {
+		filename := filepath.Join(dir, "egress.log")
+		now := time.Now()
+		for _, content := range []string{"first\n", "second\n"} {
+			Expect(os.WriteFile(filename, []byte(content), 0644)).To(Succeed())
+			Expect(rotateFile(filename, now)).To(Succeed())
+		}
+		backups, err := rotatedFiles(filename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backups).To(HaveLen(2))
+		Expect(backups[0].path).To(Equal(filename + "." + now.Format(rotatedTimeFormat) + "-1"))
+		data, err := os.ReadFile(backups[1].path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal("first\n"))
+	})
+
+	It("Check the log file is rotated by age", func() {
+		defer func(f func(*os.File) (time.Time, bool)) { fileCreated = f }(fileCreated)
+		created := time.Now()
+		fileCreated = func(*os.File) (time.Time, bool) { return created, true }
+
+		filename := filepath.Join(dir, "egress.log")
+		SetLogFile(filename)
+		loggingLevel = DebugLevel
+		loggingRotation = rotation{maxAge: 48 * time.Hour}
+		Debugf("recent")
+		created = created.Add(-49 * time.Hour)
+		Debugf("old")
+
+		backups, err := rotatedFiles(filename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backups).To(HaveLen(1))
+		data, err := os.ReadFile(filename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(HaveSuffix("[debug] old\n"))
+		Expect(string(data)).NotTo(ContainSubstring("recent"))
+	})
+
+	It("Check the locks are released after a rotation", func() {
+		filename := filepath.Join(dir, "egress.log")
+		SetLogFile(filename)
+		loggingLevel = DebugLevel
+		loggingRotation = rotation{maxSize: 10}
+		Debugf("before the rotation")
+		Debugf("after the rotation")
+
+		backups, err := rotatedFiles(filename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backups).To(HaveLen(1))
+		for _, path := range []string{filename, backups[0].path} {
+			fp, err := os.Open(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(unix.Flock(int(fp.Fd()), unix.LOCK_EX|unix.LOCK_NB)).To(Succeed())
+			fp.Close()
+		}
+	})
+
+	It("Check a file rotated by another process is reopened", func() {
+		filename := filepath.Join(dir, "egress.log")
+		SetLogFile(filename)
+		loggingLevel = DebugLevel
+		Debugf("before")
+		Expect(os.Rename(filename, filename+".other")).To(Succeed())
+		Debugf("after")
+		data, err := os.ReadFile(filename)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(HaveSuffix("[debug] after\n"))
+	})
+
 	It("Check loglevel setter", func() {
 		SetLogLevel("debug")
 		Expect(loggingLevel).To(Equal(DebugLevel))
@@ -61,6 +198,29 @@ var _ = Describe("logging operations", func() {
 		Expect(loggingLevel).To(Equal(currentLevel))
 	})
 
+	It("Check log format setter", func() {
+		SetLogFormat("JSON")
+		Expect(loggingFormat).To(Equal(JSONFormat))
+		SetLogFormat("xml")
+		Expect(loggingFormat).To(Equal(JSONFormat))
+		SetLogFormat("text")
+		Expect(loggingFormat).To(Equal(TextFormat))
+	})
+
+	It("Check text lines carry the context fields", func() {
+		SetLogContext(Field{Key: "command", Value: "ADD"}, Field{Key: "podName", Value: ""}, Field{Key: "ifName", Value: "net1"})
+		t := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+		Expect(string(formatLine(t, ErrorLevel, "failed"))).To(Equal("2021-03-04T05:06:07Z [error] command=ADD ifName=net1 failed\n"))
+	})
+
+	It("Check JSON lines carry the context fields", func() {
+		SetLogFormat("json")
+		SetLogContext(Field{Key: "command", Value: "DEL"}, Field{Key: "containerID", Value: "abc"})
+		t := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+		Expect(string(formatLine(t, DebugLevel, `quoted "value"`))).To(Equal(
+			`{"time":"2021-03-04T05:06:07Z","level":"debug","msg":"quoted \"value\"","command":"DEL","containerID":"abc"}` + "\n"))
+	})
+
 	It("Check log to stderr setter with invalid level", func() {
 		currentVal := loggingStderr
 		SetLogStderr(!currentVal)
@@ -0,0 +1,213 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// rotatedTimeFormat is the suffix format of rotated log files. Files rotated
+// within the same millisecond get a further "-<n>" suffix.
+const rotatedTimeFormat = "20060102T150405.000"
+
+// rotation is the rotation policy of the log file. Zero values disable the
+// corresponding limit.
+type rotation struct {
+	// maxSize is the size in bytes beyond which the log file is rotated
+	maxSize int64
+	// maxAge is the age beyond which the log file is rotated and rotated files
+	// are deleted
+	maxAge time.Duration
+	// maxBackups is the number of rotated files kept
+	maxBackups int
+}
+
+var loggingFile string
+var loggingRotation rotation
+
+// SetLogRotation makes the log file rotate once it would grow beyond maxSizeMB
+// megabytes or once it is older than maxAgeDays days, keeping at most maxBackups
+// rotated files, none of them older than maxAgeDays days. Zero values disable the
+// corresponding limit.
+func SetLogRotation(maxSizeMB, maxAgeDays, maxBackups int) {
+	loggingRotation = rotation{
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxAge:     time.Duration(maxAgeDays) * 24 * time.Hour,
+		maxBackups: maxBackups,
+	}
+}
+
+func openLogFile(filename string) (*os.File, error) {
+	return os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// writeFile appends line to the log file in a single write. Concurrent plugin
+// invocations share the file, so the checks and the rotation happen under an
+// exclusive lock of the file, and a file rotated by another invocation is
+// reopened first. The reopened file is locked as well until line is written.
+func writeFile(line []byte) {
+	fp := loggingFp
+	var locked []*os.File
+	var previous *os.File
+	defer func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			unix.Flock(int(locked[i].Fd()), unix.LOCK_UN)
+		}
+		if previous != nil {
+			previous.Close()
+		}
+	}()
+	lock := func(f *os.File) {
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err == nil {
+			locked = append(locked, f)
+		}
+	}
+	lock(fp)
+
+	now := time.Now()
+	reopen := false
+	info, err := fp.Stat()
+	if current, statErr := os.Stat(loggingFile); err != nil || statErr != nil || !os.SameFile(info, current) {
+		reopen = true
+	} else if info.Size() > 0 && (tooLarge(info, len(line)) || tooOld(fp, now)) {
+		if err := rotateFile(loggingFile, now); err != nil {
+			fmt.Fprintf(os.Stderr, "Egress Router CNI logging: cannot rotate %s: %v\n", loggingFile, err)
+		} else {
+			reopen = true
+		}
+	}
+
+	if reopen {
+		newFp, err := openLogFile(loggingFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Egress Router CNI logging: cannot open %s, logging to stderr: %v\n", loggingFile, err)
+			if !loggingStderr {
+				os.Stderr.Write(line)
+			}
+			loggingStderr = true
+			loggingFp = nil
+			previous = fp
+			return
+		}
+		lock(newFp)
+		loggingFp = newFp
+		previous = fp
+		fp = newFp
+	}
+	fp.Write(line)
+}
+
+// tooLarge returns whether the log file described by info would grow beyond the
+// size limit by writing n more bytes.
+func tooLarge(info os.FileInfo, n int) bool {
+	return loggingRotation.maxSize > 0 && info.Size()+int64(n) > loggingRotation.maxSize
+}
+
+// tooOld returns whether the log file fp was created longer than the age limit
+// before now. Files whose creation time is unknown are not rotated by age.
+func tooOld(fp *os.File, now time.Time) bool {
+	if loggingRotation.maxAge <= 0 {
+		return false
+	}
+	created, ok := fileCreated(fp)
+	return ok && now.Sub(created) > loggingRotation.maxAge
+}
+
+// fileCreated returns the creation time of fp, if the file system records it,
+// and is replaced in tests.
+var fileCreated = func(fp *os.File) (time.Time, bool) {
+	var stx unix.Statx_t
+	if err := unix.Statx(int(fp.Fd()), "", unix.AT_EMPTY_PATH, unix.STATX_BTIME, &stx); err != nil || stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)), true
+}
+
+// rotateFile renames filename with the time of the rotation as suffix, then
+// deletes the rotated files beyond the rotation limits.
+func rotateFile(filename string, now time.Time) error {
+	if err := renameExclusive(filename, filename+"."+now.Format(rotatedTimeFormat)); err != nil {
+		return err
+	}
+
+	backups, err := rotatedFiles(filename)
+	if err != nil {
+		return err
+	}
+	for i, backup := range backups {
+		tooMany := loggingRotation.maxBackups > 0 && i >= loggingRotation.maxBackups
+		tooOld := loggingRotation.maxAge > 0 && now.Sub(backup.rotated) > loggingRotation.maxAge
+		if tooMany || tooOld {
+			if err := os.Remove(backup.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// renameExclusive renames filename to backup without replacing an existing file:
+// if backup exists, a "-<n>" suffix is added to it. The file is linked to its
+// new name, which fails if the name is taken, then unlinked.
+func renameExclusive(filename, backup string) error {
+	for n := 0; ; n++ {
+		name := backup
+		if n > 0 {
+			name += "-" + strconv.Itoa(n)
+		}
+		err := os.Link(filename, name)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return os.Remove(filename)
+	}
+}
+
+// rotatedFile is a rotated log file, its time of rotation and its rank among the
+// files rotated at the same time.
+type rotatedFile struct {
+	path    string
+	rotated time.Time
+	n       int
+}
+
+// rotatedFiles returns the rotated files of filename, newest first.
+func rotatedFiles(filename string) ([]rotatedFile, error) {
+	matches, err := filepath.Glob(filename + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var files []rotatedFile
+	for _, path := range matches {
+		suffix := strings.TrimPrefix(path, filename+".")
+		n := 0
+		if i := strings.LastIndex(suffix, "-"); i >= 0 {
+			if n, err = strconv.Atoi(suffix[i+1:]); err != nil || n <= 0 {
+				continue
+			}
+			suffix = suffix[:i]
+		}
+		rotated, err := time.ParseInLocation(rotatedTimeFormat, suffix, time.Local)
+		if err != nil {
+			continue
+		}
+		files = append(files, rotatedFile{path: path, rotated: rotated, n: n})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].rotated.Equal(files[j].rotated) {
+			return files[i].rotated.After(files[j].rotated)
+		}
+		return files[i].n > files[j].n
+	})
+	return files, nil
+}
@@ -0,0 +1,565 @@
+package macvlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+	"sigs.k8s.io/knftables"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+	"github.com/openshift/egress-router-cni/pkg/util"
+)
+
+// checkFailed logs and returns the CNI error reported when the live state of the
+// egress pod does not match what ADD configured.
+func checkFailed(format string, a ...interface{}) error {
+	msg := fmt.Sprintf(format, a...)
+	logging.Errorf("CNI CHECK failed: %s", msg)
+	return cnitypes.NewError(cnitypes.ErrInternal, msg, "")
+}
+
+// macvlanCmdCheck verifies that the interface, addresses, routes, sysctls and
+// nftables rules installed by macvlanCmdAdd are still present in the container
+// network namespace.
+func macvlanCmdCheck(args *skel.CmdArgs) error {
+	n, err := loadNetConf(&types.ClusterConf{}, args.StdinData)
+	logging.Debugf("Called CNI CHECK")
+	if err != nil {
+		return err
+	}
+	if err := resolveIP(n, args.Args); err != nil {
+		return err
+	}
+	useIPAM := n.IPAM.Type != ""
+
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return checkFailed("failed to parse prevResult: %v", err)
+	}
+	if n.PrevResult == nil {
+		return checkFailed("required prevResult missing")
+	}
+	prevResult, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return checkFailed("failed to convert prevResult: %v", err)
+	}
+
+	var contIface *current.Interface
+	contIfaceIdx := -1
+	for i, iface := range prevResult.Interfaces {
+		if iface.Name == args.IfName {
+			contIface = iface
+			contIfaceIdx = i
+			break
+		}
+	}
+	if contIface == nil {
+		return checkFailed("interface %q not found in prevResult", args.IfName)
+	}
+
+	var expectedIPs []*current.IPConfig
+	for _, ipc := range prevResult.IPs {
+		if ipc.Interface != nil && *ipc.Interface == contIfaceIdx {
+			expectedIPs = append(expectedIPs, ipc)
+		}
+	}
+	if len(expectedIPs) == 0 {
+		return checkFailed("no IP addresses for %q in prevResult", args.IfName)
+	}
+
+	if useIPAM {
+		if err := ipam.ExecCheck(n.IPAM.Type, args.StdinData); err != nil {
+			return checkFailed("IPAM plugin %q check failed: %v", n.IPAM.Type, err)
+		}
+	}
+
+	master, err := util.GetNetLinkOps().LinkByName(n.InterfaceArgs["master"])
+	if err != nil {
+		return checkFailed("failed to lookup master %q: %v", n.InterfaceArgs["master"], err)
+	}
+
+	families, err := egressFamilies(expectedIPs, n.IP)
+	if err != nil {
+		return err
+	}
+	allowedDestinations, err := destinations(n)
+	if err != nil {
+		return cniError(cnitypes.ErrInvalidNetworkConfig, "%v", err)
+	}
+	filter, err := parseFilter(n.Filter)
+	if err != nil {
+		return cniError(cnitypes.ErrInvalidNetworkConfig, "invalid filter: %v", err)
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return checkFailed("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	state, err := loadState(args.ContainerID, args.IfName)
+	if err != nil {
+		return checkFailed("failed to read state for %s/%s: %v", args.ContainerID, args.IfName, err)
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := checkLink(n, args.IfName, contIface.Mac, master.Attrs().Index)
+		if err != nil {
+			return err
+		}
+
+		// ADD may have removed the default route of the cluster interface, so
+		// prefer the one it recorded over discovering it again
+		clusterIfName := n.ClusterInterface
+		if clusterIfName == "" && state != nil {
+			clusterIfName = state.ClusterInterface
+		}
+		if clusterIfName == "" {
+			if clusterIfName, err = clusterInterfaceName(n, prevResult, args.IfName); err != nil {
+				return err
+			}
+		}
+
+		if err := checkAddresses(link, expectedIPs); err != nil {
+			return err
+		}
+		for _, f := range families {
+			if n.PolicyRouting != nil {
+				if err := checkPolicyRules(n.PolicyRouting, clusterIfName, f); err != nil {
+					return err
+				}
+			}
+			if err := checkRoutes(link, f.gateway, f.isIPv6, policyTable(n)); err != nil {
+				return err
+			}
+			if err := checkSysctls(args.IfName, f.isIPv6); err != nil {
+				return err
+			}
+		}
+
+		expected := knftables.NewFake(egressTableFamily, egressTableName)
+		tx := expected.NewTransaction()
+		generateEgressNFTablesRules(tx, clusterIfName, args.IfName, snatAddresses(families), allowedDestinations, filter)
+		if err := expected.Run(context.Background(), tx); err != nil {
+			return checkFailed("failed to render expected nftables rules: %v", err)
+		}
+		nft, err := knftables.New(egressTableFamily, egressTableName)
+		if err != nil {
+			return checkFailed("failed to get NFTables: %v", err)
+		}
+		return checkNFTablesRules(context.Background(), nft, expected)
+	})
+}
+
+// checkLink verifies that ifName is a link of the configured interface type on the
+// expected master, with the MAC address reported by ADD and the configured MTU and mode.
+func checkLink(n *types.NetConf, ifName, mac string, masterIndex int) (netlink.Link, error) {
+	mtu, err := strconv.Atoi(n.InterfaceArgs["mtu"])
+	if err != nil {
+		return nil, checkFailed("failed to convert MTU to integer: %v", n.InterfaceArgs["mtu"])
+	}
+
+	link, err := util.GetNetLinkOps().LinkByName(ifName)
+	if err != nil {
+		return nil, checkFailed("failed to lookup %q: %v", ifName, err)
+	}
+	if link.Type() != n.InterfaceType {
+		return nil, checkFailed("interface %q is of type %q, expected %q", ifName, link.Type(), n.InterfaceType)
+	}
+	if link.Attrs().HardwareAddr.String() != mac {
+		return nil, checkFailed("interface %q has MAC %s, expected %s", ifName, link.Attrs().HardwareAddr, mac)
+	}
+	if link.Attrs().MTU != mtu {
+		return nil, checkFailed("interface %q has MTU %d, expected %d", ifName, link.Attrs().MTU, mtu)
+	}
+	if link.Attrs().ParentIndex != masterIndex {
+		return nil, checkFailed("interface %q has parent index %d, expected master index %d", ifName, link.Attrs().ParentIndex, masterIndex)
+	}
+
+	switch l := link.(type) {
+	case *netlink.Macvlan:
+		mode, err := modeFromString(n.InterfaceArgs["mode"])
+		if err != nil {
+			return nil, checkFailed("%v", err)
+		}
+		if l.Mode != mode {
+			return nil, checkFailed("interface %q has macvlan mode %d, expected %d", ifName, l.Mode, mode)
+		}
+	case *netlink.IPVlan:
+		mode, err := ipvlanModeFromString(n.InterfaceArgs["mode"])
+		if err != nil {
+			return nil, checkFailed("%v", err)
+		}
+		if l.Mode != mode {
+			return nil, checkFailed("interface %q has ipvlan mode %d, expected %d", ifName, l.Mode, mode)
+		}
+	}
+	return link, nil
+}
+
+// checkAddresses verifies that every address from prevResult is configured on link.
+func checkAddresses(link netlink.Link, expected []*current.IPConfig) error {
+	addrs, err := util.GetNetLinkOps().AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return checkFailed("failed to list addresses on %q: %v", link.Attrs().Name, err)
+	}
+	for _, ipc := range expected {
+		found := false
+		for _, addr := range addrs {
+			if addr.IPNet.IP.Equal(ipc.Address.IP) && addr.IPNet.Mask.String() == ipc.Address.Mask.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return checkFailed("address %s not configured on %q", ipc.Address.String(), link.Attrs().Name)
+		}
+	}
+	return nil
+}
+
+// policyTable returns the policy routing table of n, or 0 if the egress routes
+// live in the main table.
+func policyTable(n *types.NetConf) int {
+	if n.PolicyRouting == nil {
+		return 0
+	}
+	return n.PolicyRouting.Table
+}
+
+// checkRoutes verifies that the host route to the gateway and the default route
+// via the gateway are installed on link, in table or in the main table if table is 0.
+func checkRoutes(link netlink.Link, gw net.IP, isIPv6 bool, table int) error {
+	var routes []netlink.Route
+	var err error
+	if table == 0 {
+		routes, err = util.GetNetLinkOps().RouteList(link, netlinkFamily(isIPv6))
+	} else {
+		filter := &netlink.Route{LinkIndex: link.Attrs().Index, Table: table}
+		routes, err = util.GetNetLinkOps().RouteListFiltered(netlinkFamily(isIPv6), filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	}
+	if err != nil {
+		return checkFailed("failed to list routes on %q: %v", link.Attrs().Name, err)
+	}
+
+	var hasGatewayRoute, hasDefaultRoute bool
+	for _, r := range routes {
+		if r.Dst == nil && r.Gw.Equal(gw) {
+			hasDefaultRoute = true
+		} else if r.Dst != nil && r.Dst.IP.Equal(gw) {
+			if ones, bits := r.Dst.Mask.Size(); ones == bits {
+				hasGatewayRoute = true
+			}
+		}
+	}
+	if !hasGatewayRoute {
+		return checkFailed("route to gateway %s missing on %q", gw, link.Attrs().Name)
+	}
+	if !hasDefaultRoute {
+		return checkFailed("default route via %s missing on %q", gw, link.Attrs().Name)
+	}
+	return nil
+}
+
+// checkPolicyRules verifies that the ip rules selecting the policy routing table
+// for traffic from the cluster interface and from the egress address are installed.
+func checkPolicyRules(pr *types.PolicyRouting, clusterIfName string, f egressFamily) error {
+	clusterLink, err := util.GetNetLinkOps().LinkByName(clusterIfName)
+	if err != nil {
+		return checkFailed("failed to lookup cluster interface %q: %v", clusterIfName, err)
+	}
+	rules, err := netlink.RuleList(netlinkFamily(f.isIPv6))
+	if err != nil {
+		return checkFailed("failed to list ip rules: %v", err)
+	}
+	for _, expected := range policyRules(pr, clusterLink, f) {
+		found := false
+		for _, r := range rules {
+			if r.Table == expected.Table && r.Priority == expected.Priority && r.IifName == expected.IifName &&
+				(r.Src == nil) == (expected.Src == nil) && (r.Src == nil || r.Src.String() == expected.Src.String()) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return checkFailed("%s missing", describeRule(expected))
+		}
+	}
+	return nil
+}
+
+// checkSysctls verifies that forwarding for the IP family and proxy ARP are still enabled.
+func checkSysctls(ifName string, isIPv6 bool) error {
+	for _, name := range []string{ipForwardSysctl(isIPv6), fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, ifName)} {
+		value, err := sysctl.Sysctl(name)
+		if err != nil {
+			return checkFailed("failed to read sysctl %s: %v", name, err)
+		}
+		if value != "1" {
+			return checkFailed("sysctl %s is %q, expected \"1\"", name, value)
+		}
+	}
+	return nil
+}
+
+// checkNFTablesRules compares the chains, rules, sets and maps of the egress_cni
+// table in nft against the ones rendered into expected. Rules and elements are
+// matched by their comments, then compared by their bodies.
+func checkNFTablesRules(ctx context.Context, nft knftables.Interface, expected *knftables.Fake) error {
+	chains, err := nft.List(ctx, "chains")
+	if err != nil && !knftables.IsNotFound(err) {
+		return checkFailed("failed to list nftables chains: %v", err)
+	}
+	if len(chains) == 0 {
+		return checkFailed("nftables table %q not found", egressTableName)
+	}
+
+	existing := make(map[string]bool, len(chains))
+	for _, chain := range chains {
+		existing[chain] = true
+		if _, ok := expected.Table.Chains[chain]; !ok {
+			return checkFailed("unexpected nftables chain %q in table %q", chain, egressTableName)
+		}
+	}
+
+	// The count chain mirrors the destinations and egress addresses, so it is
+	// checked last, after the chains, sets and maps that implement them
+	for _, name := range util.SortedKeys(expected.Table.Chains) {
+		if name == countChainName {
+			continue
+		}
+		if err := checkNFTablesChain(ctx, nft, name, expected.Table.Chains[name], existing[name]); err != nil {
+			return err
+		}
+	}
+
+	expectedElements := map[string]map[string][]*knftables.Element{"set": {}, "map": {}}
+	for name, set := range expected.Table.Sets {
+		expectedElements["set"][name] = set.Elements
+	}
+	for name, m := range expected.Table.Maps {
+		expectedElements["map"][name] = m.Elements
+	}
+	for _, objectType := range []string{"set", "map"} {
+		if err := checkNFTablesElements(ctx, nft, objectType, expectedElements[objectType]); err != nil {
+			return err
+		}
+	}
+
+	if chain, ok := expected.Table.Chains[countChainName]; ok {
+		return checkNFTablesChain(ctx, nft, countChainName, chain, existing[countChainName])
+	}
+	return nil
+}
+
+// checkNFTablesChain compares the rules of the chain name of the egress_cni
+// table in nft against expected.
+func checkNFTablesChain(ctx context.Context, nft knftables.Interface, name string, expected *knftables.FakeChain, exists bool) error {
+	if !exists {
+		return checkFailed("nftables chain %q missing from table %q", name, egressTableName)
+	}
+	rules, err := nft.ListRules(ctx, name)
+	if err != nil {
+		return checkFailed("failed to list rules in nftables chain %q: %v", name, err)
+	}
+	if len(rules) != len(expected.Rules) {
+		return checkFailed("nftables chain %q has %d rules, expected %d", name, len(rules), len(expected.Rules))
+	}
+	for i, rule := range expected.Rules {
+		if ruleComment(rules[i]) != ruleComment(rule) {
+			return checkFailed("nftables chain %q rule %d is %q, expected %q", name, i, ruleComment(rules[i]), ruleComment(rule))
+		}
+	}
+
+	bodies := make([]string, len(rules))
+	for i, rule := range rules {
+		bodies[i] = rule.Rule
+	}
+	// knftables only reports the bodies of the rules of its fake, so the chain
+	// is listed again with nft
+	if len(rules) > 0 && rules[0].Rule == "" {
+		if bodies, err = listNFTRuleBodies(ctx, name); err != nil {
+			return checkFailed("%v", err)
+		}
+		if len(bodies) != len(expected.Rules) {
+			return checkFailed("nftables chain %q has %d rules, expected %d", name, len(bodies), len(expected.Rules))
+		}
+	}
+	for i, rule := range expected.Rules {
+		if body := normalizeRuleBody(bodies[i]); body != normalizeRuleBody(rule.Rule) {
+			return checkFailed("nftables chain %q rule %d (%q) is %q, expected %q", name, i, ruleComment(rule), body, normalizeRuleBody(rule.Rule))
+		}
+	}
+	return nil
+}
+
+// listNFTRuleBodies returns the rules of the chain name of the egress_cni table
+// as printed by nft. It must be called inside the container network namespace.
+var listNFTRuleBodies = func(ctx context.Context, name string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "nft", "list", "chain", string(egressTableFamily), egressTableName, name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nftables chain %q: %v", name, err)
+	}
+	return parseNFTRuleBodies(out), nil
+}
+
+// parseNFTRuleBodies extracts the rules from the output of "nft list chain",
+// skipping the declaration of base chains.
+func parseNFTRuleBodies(data []byte) []string {
+	var bodies []string
+	inChain := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "chain "):
+			inChain = true
+		case line == "}":
+			inChain = false
+		case !inChain || line == "" || strings.HasPrefix(line, "type "):
+		default:
+			bodies = append(bodies, line)
+		}
+	}
+	return bodies
+}
+
+var (
+	ruleCommentRegexp = regexp.MustCompile(`\s*comment "[^"]*"$`)
+	ruleCounterRegexp = regexp.MustCompile(`\bcounter packets \d+ bytes \d+`)
+)
+
+// normalizeRuleBody strips the comment, the counter values and the quotes nft
+// adds around interface names from rule, so that a rule listed by nft compares
+// equal to the rule it was added as.
+func normalizeRuleBody(rule string) string {
+	rule = ruleCommentRegexp.ReplaceAllString(rule, "")
+	rule = ruleCounterRegexp.ReplaceAllString(rule, "counter")
+	rule = strings.ReplaceAll(rule, `"`, "")
+	return strings.Join(strings.Fields(rule), " ")
+}
+
+// checkNFTablesElements compares the sets or maps (objectType) of the egress_cni
+// table in nft, and their elements, against expected. Elements are matched by
+// their comments, then compared by their keys and values.
+func checkNFTablesElements(ctx context.Context, nft knftables.Interface, objectType string, expected map[string][]*knftables.Element) error {
+	names, err := nft.List(ctx, objectType+"s")
+	if err != nil && !knftables.IsNotFound(err) {
+		return checkFailed("failed to list nftables %ss: %v", objectType, err)
+	}
+	existing := make(map[string]bool, len(names))
+	for _, name := range names {
+		existing[name] = true
+		if _, ok := expected[name]; !ok {
+			return checkFailed("unexpected nftables %s %q in table %q", objectType, name, egressTableName)
+		}
+	}
+
+	for name, elements := range expected {
+		if !existing[name] {
+			return checkFailed("nftables %s %q missing from table %q", objectType, name, egressTableName)
+		}
+		live, err := nft.ListElements(ctx, objectType, name)
+		if err != nil {
+			return checkFailed("failed to list elements of nftables %s %q: %v", objectType, name, err)
+		}
+		if diff := elementsDiff(live, elements); diff != "" {
+			return checkFailed("nftables %s %q: %s", objectType, name, diff)
+		}
+	}
+	return nil
+}
+
+// elementsDiff describes the first difference between the live and expected
+// elements, or returns "" if they match.
+func elementsDiff(live, expected []*knftables.Element) string {
+	liveBodies := elementBodies(live)
+	expectedBodies := elementBodies(expected)
+	comments := make([]string, 0, len(liveBodies)+len(expectedBodies))
+	for comment := range liveBodies {
+		comments = append(comments, comment)
+	}
+	for comment := range expectedBodies {
+		if _, ok := liveBodies[comment]; !ok {
+			comments = append(comments, comment)
+		}
+	}
+	sort.Strings(comments)
+	for _, comment := range comments {
+		l, e := liveBodies[comment], expectedBodies[comment]
+		if len(l) > len(e) {
+			return fmt.Sprintf("unexpected element %q", comment)
+		} else if len(l) < len(e) {
+			return fmt.Sprintf("element %q missing", comment)
+		}
+		for i := range l {
+			if l[i] != e[i] {
+				return fmt.Sprintf("element %q is %q, expected %q", comment, l[i], e[i])
+			}
+		}
+	}
+	return ""
+}
+
+// elementBodies returns the normalized keys and values of elements, sorted and
+// grouped by comment.
+func elementBodies(elements []*knftables.Element) map[string][]string {
+	bodies := map[string][]string{}
+	for _, e := range elements {
+		body := normalizeElementValue(e.Key)
+		if len(e.Value) > 0 {
+			body += " : " + normalizeElementValue(e.Value)
+		}
+		bodies[elementComment(e)] = append(bodies[elementComment(e)], body)
+	}
+	for _, b := range bodies {
+		sort.Strings(b)
+	}
+	return bodies
+}
+
+// normalizeElementValue joins the fields of an element key or value, writing
+// addresses the way nft prints them: host prefixes as plain addresses.
+func normalizeElementValue(fields []string) string {
+	normalized := make([]string, len(fields))
+	for i, field := range fields {
+		normalized[i] = field
+		if ip, cidr, err := net.ParseCIDR(field); err == nil {
+			if ones, bits := cidr.Mask.Size(); ones == bits {
+				normalized[i] = ip.String()
+			} else {
+				normalized[i] = cidr.String()
+			}
+		} else if ip := net.ParseIP(field); ip != nil {
+			normalized[i] = ip.String()
+		}
+	}
+	return strings.Join(normalized, " . ")
+}
+
+func elementComment(e *knftables.Element) string {
+	if e.Comment == nil {
+		return ""
+	}
+	return *e.Comment
+}
+
+func ruleComment(rule *knftables.Rule) string {
+	if rule.Comment == nil {
+		return ""
+	}
+	return *rule.Comment
+}
@@ -0,0 +1,165 @@
+package macvlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/knftables"
+)
+
+func renderEgressTable(t *testing.T, destinations []string) *knftables.Fake {
+	fake := knftables.NewFake(egressTableFamily, egressTableName)
+	tx := fake.NewTransaction()
+	generateEgressNFTablesRules(tx, "eth0", "net1", []net.IP{net.ParseIP("192.168.3.10")}, mustParseDestinations(t, destinations...), nil)
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error running transaction: %v", err)
+	}
+	return fake
+}
+
+func TestCheckNFTablesRules(t *testing.T) {
+	destinations := []string{"80 tcp 10.100.3.1", "8443 tcp 203.0.113.27 443", "10.100.3.2"}
+
+	tests := []struct {
+		desc     string
+		live     func() *knftables.Fake
+		errMatch error
+	}{
+		{
+			desc: "live table matches expected table",
+			live: func() *knftables.Fake { return renderEgressTable(t, destinations) },
+		},
+		{
+			desc:     "table missing",
+			live:     func() *knftables.Fake { return knftables.NewFake(egressTableFamily, egressTableName) },
+			errMatch: fmt.Errorf("nftables table \"egress_cni\" not found"),
+		},
+		{
+			desc:     "destination removed",
+			live:     func() *knftables.Fake { return renderEgressTable(t, destinations[:2]) },
+			errMatch: fmt.Errorf("nftables chain \"prerouting\" has 1 rules, expected 2"),
+		},
+		{
+			desc:     "port destination removed",
+			live:     func() *knftables.Fake { return renderEgressTable(t, destinations[1:]) },
+			errMatch: fmt.Errorf("nftables map \"dnat-ipv4\": element \"80 tcp 10.100.3.1\" missing"),
+		},
+		{
+			desc: "destination changed",
+			live: func() *knftables.Fake {
+				return renderEgressTable(t, []string{"80 tcp 10.100.3.1", "8443 tcp 203.0.113.28 443", "10.100.3.2"})
+			},
+			errMatch: fmt.Errorf("nftables map \"dnat-ipv4\": element \"8443 tcp 203.0.113.27 443\" missing"),
+		},
+		{
+			desc: "catch-all destination changed",
+			live: func() *knftables.Fake {
+				return renderEgressTable(t, []string{"80 tcp 10.100.3.1", "8443 tcp 203.0.113.27 443", "10.100.3.3"})
+			},
+			errMatch: fmt.Errorf("nftables chain \"prerouting\" rule 1 is \"10.100.3.3\", expected \"10.100.3.2\""),
+		},
+		{
+			desc: "port destination added",
+			live: func() *knftables.Fake {
+				return renderEgressTable(t, append([]string{"81 udp 10.100.3.1"}, destinations...))
+			},
+			errMatch: fmt.Errorf("nftables map \"dnat-ipv4\": unexpected element \"81 udp 10.100.3.1\""),
+		},
+		{
+			desc: "rule body changed",
+			live: func() *knftables.Fake {
+				fake := renderEgressTable(t, destinations)
+				fake.Table.Chains["postrouting"].Rules[0].Rule = "oif net1 snat ip to 192.168.3.11"
+				return fake
+			},
+			errMatch: fmt.Errorf("nftables chain \"postrouting\" rule 0 (\"snat 192.168.3.10\") is \"oif net1 snat ip to 192.168.3.11\", expected \"oif net1 snat ip to 192.168.3.10\""),
+		},
+		{
+			desc: "map element changed",
+			live: func() *knftables.Fake {
+				fake := renderEgressTable(t, destinations)
+				for _, e := range fake.Table.Maps["dnat-ipv4"].Elements {
+					if *e.Comment == "80 tcp 10.100.3.1" {
+						e.Value = []string{"10.100.3.9", "80"}
+					}
+				}
+				return fake
+			},
+			errMatch: fmt.Errorf("nftables map \"dnat-ipv4\": element \"80 tcp 10.100.3.1\" is \"tcp . 80 : 10.100.3.9 . 80\", expected \"tcp . 80 : 10.100.3.1 . 80\""),
+		},
+		{
+			desc: "unexpected chain",
+			live: func() *knftables.Fake {
+				fake := renderEgressTable(t, destinations)
+				tx := fake.NewTransaction()
+				tx.Add(&knftables.Chain{Name: "extra"})
+				if err := fake.Run(context.Background(), tx); err != nil {
+					t.Fatalf("unexpected error running transaction: %v", err)
+				}
+				return fake
+			},
+			errMatch: fmt.Errorf("unexpected nftables chain \"extra\""),
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			expected := renderEgressTable(t, destinations)
+			err := checkNFTablesRules(context.Background(), tc.live(), expected)
+			if tc.errMatch != nil {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errMatch.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckNFTablesRuleBodies(t *testing.T) {
+	defer func(f func(context.Context, string) ([]string, error)) { listNFTRuleBodies = f }(listNFTRuleBodies)
+
+	expected := renderEgressTable(t, []string{"80 tcp 10.100.3.1", "10.100.3.2"})
+	chain := expected.Table.Chains["prerouting"]
+	listed := `table inet egress_cni {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		iif "eth0" meta nfproto ipv4 dnat ip addr . port to meta l4proto . th dport map @dnat-ipv4 comment "dnat-ipv4"
+		iif "eth0" dnat ip to %s comment "10.100.3.2"
+	}
+}
+`
+
+	// knftables does not report the bodies of live rules
+	rules := make([]*knftables.Rule, len(chain.Rules))
+	for i, rule := range chain.Rules {
+		rules[i] = &knftables.Rule{Chain: rule.Chain, Comment: rule.Comment}
+	}
+	live := &knftables.FakeChain{Rules: rules}
+
+	listNFTRuleBodies = func(_ context.Context, name string) ([]string, error) {
+		assert.Equal(t, "prerouting", name)
+		return parseNFTRuleBodies([]byte(fmt.Sprintf(listed, "10.100.3.2"))), nil
+	}
+	nft := knftables.NewFake(egressTableFamily, egressTableName)
+	nft.Table = &knftables.FakeTable{Chains: map[string]*knftables.FakeChain{"prerouting": live}}
+	assert.NoError(t, checkNFTablesChain(context.Background(), nft, "prerouting", chain, true))
+
+	listNFTRuleBodies = func(_ context.Context, _ string) ([]string, error) {
+		return parseNFTRuleBodies([]byte(fmt.Sprintf(listed, "10.100.3.3"))), nil
+	}
+	err := checkNFTablesChain(context.Background(), nft, "prerouting", chain, true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `nftables chain "prerouting" rule 1 ("10.100.3.2") is "iif eth0 dnat ip to 10.100.3.3", expected "iif eth0 dnat ip to 10.100.3.2"`)
+	}
+}
+
+func TestNormalizeRuleBody(t *testing.T) {
+	assert.Equal(t, "meta nfproto ipv4 ct status snat ct reply ip daddr 192.168.3.10 counter",
+		normalizeRuleBody(`meta nfproto ipv4 ct status snat ct reply ip daddr 192.168.3.10 counter packets 12 bytes 3456 comment "snat 192.168.3.10"`))
+	assert.Equal(t, "oif net1 snat ip to 192.168.3.10", normalizeRuleBody(`oif "net1"  snat ip to 192.168.3.10`))
+	assert.Equal(t, "10.100.3.1 . tcp . 80", normalizeElementValue([]string{"10.100.3.1/32", "tcp", "80"}))
+	assert.Equal(t, "fd00:100::/64", normalizeElementValue([]string{"fd00:100:0::/64"}))
+}
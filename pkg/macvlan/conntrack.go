@@ -0,0 +1,135 @@
+package macvlan
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"sigs.k8s.io/knftables"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+	"github.com/openshift/egress-router-cni/pkg/util"
+)
+
+// staleDestinations returns the destinations of old that are not part of current,
+// either because they were removed or because their target changed.
+func staleDestinations(old, current []destination) []destination {
+	var stale []destination
+	for _, o := range old {
+		found := false
+		for _, c := range current {
+			if o.localPort == c.localPort && o.protocol == c.protocol && o.target.Equal(c.target) && o.targetPort == c.targetPort {
+				found = true
+				break
+			}
+		}
+		if !found {
+			stale = append(stale, o)
+		}
+	}
+	return stale
+}
+
+// installedDestinations returns the destinations redirected by the egress_cni
+// table in nft, recovered from the comments of the DNAT map elements and of the
+// catch-all prerouting rules. It returns nil if the table does not exist.
+func installedDestinations(ctx context.Context, nft knftables.Interface) ([]destination, error) {
+	rules, err := nft.ListRules(ctx, "prerouting")
+	if err != nil {
+		if knftables.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list rules in nftables chain %q: %v", "prerouting", err)
+	}
+
+	var entries []string
+	for _, rule := range rules {
+		comment := ruleComment(rule)
+		switch comment {
+		case "":
+		case dnatMapName(false), dnatMapName(true):
+			elements, err := nft.ListElements(ctx, "map", comment)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list elements of nftables map %q: %v", comment, err)
+			}
+			for _, e := range elements {
+				entries = append(entries, elementComment(e))
+			}
+		default:
+			entries = append(entries, comment)
+		}
+	}
+
+	installed := make([]destination, 0, len(entries))
+	for _, entry := range entries {
+		d, err := parseDestination(types.Destination{Legacy: entry})
+		if err != nil {
+			logging.Debugf("Ignoring installed destination %q: %v", entry, err)
+			continue
+		}
+		installed = append(installed, d)
+	}
+	return installed, nil
+}
+
+// staleConntrackFilter matches the conntrack entries of the connections DNATed by
+// one of the stale destinations: their original destination port and protocol
+// are the ones of the destination, and the replies come from its target rather
+// than from the original destination.
+type staleConntrackFilter struct {
+	stale []destination
+}
+
+func (f *staleConntrackFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	for _, d := range f.stale {
+		if !flow.Reverse.SrcIP.Equal(d.target) || flow.Forward.DstIP.Equal(d.target) {
+			continue
+		}
+		if d.localPort == 0 {
+			return true
+		}
+		if flow.Forward.Protocol == protocolNumber(d.protocol) && int(flow.Forward.DstPort) == d.localPort {
+			return true
+		}
+	}
+	return false
+}
+
+// protocolNumber returns the IP protocol number of a destination protocol.
+func protocolNumber(protocol string) uint8 {
+	switch protocol {
+	case "tcp":
+		return unix.IPPROTO_TCP
+	case "udp":
+		return unix.IPPROTO_UDP
+	case "sctp":
+		return unix.IPPROTO_SCTP
+	}
+	return 0
+}
+
+// flushConntrack deletes the conntrack entries of the connections DNATed by the
+// stale destinations, so that they do not keep going to their previous target
+// once the rules are replaced. It must be called inside the container network
+// namespace.
+func flushConntrack(stale []destination) error {
+	for _, isIPv6 := range []bool{false, true} {
+		filter := &staleConntrackFilter{}
+		for _, d := range stale {
+			if (d.target.To4() == nil) == isIPv6 {
+				filter.stale = append(filter.stale, d)
+			}
+		}
+		if len(filter.stale) == 0 {
+			continue
+		}
+		n, err := util.GetNetLinkOps().ConntrackDeleteFilter(netlink.ConntrackTable, netlink.InetFamily(netlinkFamily(isIPv6)), filter)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s conntrack entries of stale destinations: %v", ipFamilyName(isIPv6), err)
+		}
+		logging.Debugf("Deleted %d %s conntrack entries of %d stale destinations", n, ipFamilyName(isIPv6), len(filter.stale))
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package macvlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"sigs.k8s.io/knftables"
+)
+
+func TestStaleDestinations(t *testing.T) {
+	tests := []struct {
+		desc    string
+		old     []string
+		current []string
+		expt    []string
+	}{
+		{
+			desc:    "unchanged",
+			old:     []string{"80 tcp 10.100.3.1", "10.100.3.2"},
+			current: []string{"10.100.3.2", "80 tcp 10.100.3.1"},
+		},
+		{
+			desc:    "removed",
+			old:     []string{"80 tcp 10.100.3.1", "10.100.3.2"},
+			current: []string{"80 tcp 10.100.3.1"},
+			expt:    []string{"10.100.3.2"},
+		},
+		{
+			desc:    "target changed",
+			old:     []string{"80 tcp 10.100.3.1", "8443 tcp 203.0.113.27 443"},
+			current: []string{"80 tcp 10.100.3.5", "8443 tcp 203.0.113.27 8443"},
+			expt:    []string{"80 tcp 10.100.3.1", "8443 tcp 203.0.113.27 443"},
+		},
+		{
+			desc:    "added",
+			old:     []string{"80 tcp 10.100.3.1"},
+			current: []string{"80 tcp 10.100.3.1", "81 tcp 10.100.3.1"},
+		},
+	}
+
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			var entries []string
+			for _, d := range staleDestinations(mustParseDestinations(t, tc.old...), mustParseDestinations(t, tc.current...)) {
+				entries = append(entries, d.entry)
+			}
+			assert.Equal(t, tc.expt, entries)
+		})
+	}
+}
+
+func TestInstalledDestinations(t *testing.T) {
+	entries := []string{"80 tcp 10.100.3.1", "8443 tcp 203.0.113.27 443", "53 udp 2001:db8::53", "10.100.3.2"}
+	fake := renderEgressTable(t, entries)
+
+	installed, err := installedDestinations(context.Background(), fake)
+	assert.NoError(t, err)
+	assert.Empty(t, staleDestinations(installed, mustParseDestinations(t, entries...)))
+	assert.Empty(t, staleDestinations(mustParseDestinations(t, entries...), installed))
+
+	installed, err = installedDestinations(context.Background(), knftables.NewFake(egressTableFamily, egressTableName))
+	assert.NoError(t, err)
+	assert.Nil(t, installed)
+}
+
+func TestStaleConntrackFilter(t *testing.T) {
+	filter := &staleConntrackFilter{stale: mustParseDestinations(t, "8443 tcp 203.0.113.27 443", "203.0.113.30")}
+	flow := func(protocol uint8, origDst string, origPort uint16, replySrc string) *netlink.ConntrackFlow {
+		f := &netlink.ConntrackFlow{}
+		f.Forward.Protocol = protocol
+		f.Forward.SrcIP = net.ParseIP("10.128.0.5")
+		f.Forward.DstIP = net.ParseIP(origDst)
+		f.Forward.DstPort = origPort
+		f.Reverse.SrcIP = net.ParseIP(replySrc)
+		f.Reverse.DstIP = net.ParseIP("192.168.3.10")
+		return f
+	}
+
+	tests := []struct {
+		desc  string
+		flow  *netlink.ConntrackFlow
+		match bool
+	}{
+		{
+			desc:  "flow DNATed by the destination",
+			flow:  flow(unix.IPPROTO_TCP, "10.129.0.8", 8443, "203.0.113.27"),
+			match: true,
+		},
+		{
+			desc: "flow to another local port of the same target",
+			flow: flow(unix.IPPROTO_TCP, "10.129.0.8", 8080, "203.0.113.27"),
+		},
+		{
+			desc: "flow with another protocol",
+			flow: flow(unix.IPPROTO_UDP, "10.129.0.8", 8443, "203.0.113.27"),
+		},
+		{
+			desc: "flow DNATed to another target",
+			flow: flow(unix.IPPROTO_TCP, "10.129.0.8", 8443, "203.0.113.28"),
+		},
+		{
+			desc: "flow to the target without DNAT",
+			flow: flow(unix.IPPROTO_TCP, "203.0.113.27", 8443, "203.0.113.27"),
+		},
+		{
+			desc:  "flow DNATed by a catch-all destination",
+			flow:  flow(unix.IPPROTO_UDP, "10.129.0.8", 53, "203.0.113.30"),
+			match: true,
+		},
+	}
+
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			assert.Equal(t, tc.match, filter.MatchConntrackFlow(tc.flow))
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package macvlan
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+// destination is a validated egress destination.
+type destination struct {
+	// localPort is zero when all traffic is redirected to target
+	localPort int
+	// protocol is "tcp", "udp" or "sctp", and empty when localPort is zero
+	protocol string
+	target   net.IP
+	// targetPort is zero when the local port is kept
+	targetPort int
+	// entry is the destination as configured, used as the nftables rule comment
+	entry string
+}
+
+// parseDestinations parses and validates every configured destination. A local
+// port may only be redirected once per protocol and IP family.
+func parseDestinations(dests []types.Destination) ([]destination, error) {
+	parsed := make([]destination, 0, len(dests))
+	parser := newDestinationParser()
+	for i, d := range dests {
+		dest, err := parser.parse(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination %d (%q): %v", i, d.String(), err)
+		}
+		parsed = append(parsed, dest)
+	}
+	return parsed, nil
+}
+
+// destinationParser parses destinations one at a time, rejecting a local port
+// and protocol already redirected by a previous destination of the same IP
+// family.
+type destinationParser struct {
+	seen map[string]bool
+}
+
+func newDestinationParser() *destinationParser {
+	return &destinationParser{seen: map[string]bool{}}
+}
+
+// parse parses and validates d, the next destination.
+func (p *destinationParser) parse(d types.Destination) (destination, error) {
+	dest, err := parseDestination(d)
+	if err != nil {
+		return destination{}, err
+	}
+	if dest.localPort != 0 {
+		key := fmt.Sprintf("%s %d/%s", nftIPFamily(dest.target), dest.localPort, dest.protocol)
+		if p.seen[key] {
+			return destination{}, fmt.Errorf("local port %d/%s is already redirected", dest.localPort, dest.protocol)
+		}
+		p.seen[key] = true
+	}
+	return dest, nil
+}
+
+// parseDestination validates d, which is either a destination object or a string
+// in the legacy "<target>" or "<localPort> <protocol> <target> [<targetPort>]" format.
+func parseDestination(d types.Destination) (destination, error) {
+	if d.Legacy != "" {
+		var err error
+		if d, err = splitLegacyDestination(d.Legacy); err != nil {
+			return destination{}, err
+		}
+	}
+
+	dest := destination{entry: d.String()}
+
+	if d.Target == "" {
+		return destination{}, fmt.Errorf("missing target")
+	}
+	if dest.target = net.ParseIP(d.Target); dest.target == nil {
+		ip, ipNet, err := net.ParseCIDR(d.Target)
+		if err != nil {
+			return destination{}, fmt.Errorf("target %q is not an IP address", d.Target)
+		}
+		ones, bits := ipNet.Mask.Size()
+		if ones != bits {
+			// The legacy format accepted a mask, which never selected more than
+			// the address as the DNAT target
+			if d.Legacy == "" {
+				return destination{}, fmt.Errorf("target %q is not a single address, only a /%d mask is allowed", d.Target, bits)
+			}
+			logging.Errorf("Destination %q: ignoring the mask of target %q, traffic is redirected to %s only", d.Legacy, d.Target, ip)
+		}
+		dest.target = ip
+	}
+
+	if d.LocalPort == 0 {
+		if d.Protocol != "" || d.TargetPort != 0 {
+			return destination{}, fmt.Errorf("protocol and targetPort require localPort")
+		}
+		return dest, nil
+	}
+
+	if err := validatePort(d.LocalPort); err != nil {
+		return destination{}, fmt.Errorf("localPort: %v", err)
+	}
+	dest.localPort = d.LocalPort
+
+	dest.protocol = strings.ToLower(d.Protocol)
+	switch dest.protocol {
+	case "tcp", "udp", "sctp":
+	case "":
+		return destination{}, fmt.Errorf("missing protocol")
+	default:
+		return destination{}, fmt.Errorf("unsupported protocol %q, must be one of tcp, udp or sctp", d.Protocol)
+	}
+
+	if d.TargetPort != 0 {
+		if err := validatePort(d.TargetPort); err != nil {
+			return destination{}, fmt.Errorf("targetPort: %v", err)
+		}
+		dest.targetPort = d.TargetPort
+	}
+	return dest, nil
+}
+
+// splitLegacyDestination splits a destination in the legacy string format into
+// its fields. The entry is kept so that it remains the rule comment.
+func splitLegacyDestination(entry string) (types.Destination, error) {
+	fields := strings.Fields(entry)
+	d := types.Destination{Legacy: entry}
+	switch len(fields) {
+	case 1:
+		d.Target = fields[0]
+		return d, nil
+	case 3, 4:
+		port, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return d, fmt.Errorf("local port %q is not a number", fields[0])
+		}
+		if err := validatePort(port); err != nil {
+			return d, fmt.Errorf("local port: %v", err)
+		}
+		d.LocalPort = port
+		d.Protocol = fields[1]
+		d.Target = fields[2]
+		if len(fields) == 4 {
+			port, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return d, fmt.Errorf("target port %q is not a number", fields[3])
+			}
+			if err := validatePort(port); err != nil {
+				return d, fmt.Errorf("target port: %v", err)
+			}
+			d.TargetPort = port
+		}
+		return d, nil
+	default:
+		return d, fmt.Errorf("expected \"<target>\" or \"<localPort> <protocol> <target> [<targetPort>]\"")
+	}
+}
+
+// validatePort checks that port is a valid TCP, UDP or SCTP port.
+func validatePort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port %d out of range 1-65535", port)
+	}
+	return nil
+}
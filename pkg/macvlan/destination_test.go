@@ -0,0 +1,168 @@
+package macvlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+// mustParseDestinations parses destinations given in the legacy string format.
+func mustParseDestinations(t *testing.T, entries ...string) []destination {
+	dests := make([]types.Destination, 0, len(entries))
+	for _, e := range entries {
+		dests = append(dests, types.Destination{Legacy: e})
+	}
+	parsed, err := parseDestinations(dests)
+	if err != nil {
+		t.Fatalf("unexpected error parsing destinations: %v", err)
+	}
+	return parsed
+}
+
+func TestDestinationJSON(t *testing.T) {
+	ip := &types.IP{}
+	data := `{"destinations": ["80 tcp 10.100.3.1", {"localPort": 8443, "protocol": "tcp", "target": "203.0.113.27", "targetPort": 443}]}`
+	assert.NoError(t, json.Unmarshal([]byte(data), ip))
+	assert.Equal(t, []types.Destination{
+		{Legacy: "80 tcp 10.100.3.1"},
+		{LocalPort: 8443, Protocol: "tcp", Target: "203.0.113.27", TargetPort: 443},
+	}, ip.Destinations)
+	assert.Equal(t, "8443 tcp 203.0.113.27 443", ip.Destinations[1].String())
+
+	out, err := json.Marshal(ip.Destinations)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `["80 tcp 10.100.3.1", {"localPort": 8443, "protocol": "tcp", "target": "203.0.113.27", "targetPort": 443}]`, string(out))
+}
+
+func TestParseDestination(t *testing.T) {
+	tests := []struct {
+		desc     string
+		dest     types.Destination
+		expected destination
+		errMatch error
+	}{
+		{
+			desc:     "legacy target only",
+			dest:     types.Destination{Legacy: "10.100.3.1"},
+			expected: destination{target: net.ParseIP("10.100.3.1"), entry: "10.100.3.1"},
+		},
+		{
+			desc:     "legacy with ports and CIDR target",
+			dest:     types.Destination{Legacy: "8080 TCP 203.0.113.26/30 80"},
+			expected: destination{localPort: 8080, protocol: "tcp", target: net.ParseIP("203.0.113.26"), targetPort: 80, entry: "8080 TCP 203.0.113.26/30 80"},
+		},
+		{
+			desc:     "object",
+			dest:     types.Destination{LocalPort: 53, Protocol: "udp", Target: "2001:db8::53"},
+			expected: destination{localPort: 53, protocol: "udp", target: net.ParseIP("2001:db8::53"), entry: "53 udp 2001:db8::53"},
+		},
+		{
+			desc:     "object with host mask",
+			dest:     types.Destination{LocalPort: 80, Protocol: "tcp", Target: "10.100.3.1/32"},
+			expected: destination{localPort: 80, protocol: "tcp", target: net.ParseIP("10.100.3.1"), entry: "80 tcp 10.100.3.1/32"},
+		},
+		{
+			desc:     "object with network mask",
+			dest:     types.Destination{LocalPort: 80, Protocol: "tcp", Target: "10.100.3.1/30"},
+			errMatch: fmt.Errorf("target \"10.100.3.1/30\" is not a single address, only a /32 mask is allowed"),
+		},
+		{
+			desc:     "object with IPv6 network mask",
+			dest:     types.Destination{Target: "2001:db8::53/64"},
+			errMatch: fmt.Errorf("target \"2001:db8::53/64\" is not a single address, only a /128 mask is allowed"),
+		},
+		{
+			desc:     "legacy with invalid target",
+			dest:     types.Destination{Legacy: "80 tcp 10.100.3"},
+			errMatch: fmt.Errorf("target \"10.100.3\" is not an IP address"),
+		},
+		{
+			desc:     "legacy with invalid protocol",
+			dest:     types.Destination{Legacy: "80 icmp 10.100.3.1"},
+			errMatch: fmt.Errorf("unsupported protocol \"icmp\""),
+		},
+		{
+			desc:     "legacy with non-numeric port",
+			dest:     types.Destination{Legacy: "http tcp 10.100.3.1"},
+			errMatch: fmt.Errorf("local port \"http\" is not a number"),
+		},
+		{
+			desc:     "legacy with zero target port",
+			dest:     types.Destination{Legacy: "80 tcp 10.0.0.1 0"},
+			errMatch: fmt.Errorf("target port: port 0 out of range 1-65535"),
+		},
+		{
+			desc:     "legacy with target port out of range",
+			dest:     types.Destination{Legacy: "80 tcp 10.0.0.1 65536"},
+			errMatch: fmt.Errorf("target port: port 65536 out of range 1-65535"),
+		},
+		{
+			desc:     "legacy with wrong number of fields",
+			dest:     types.Destination{Legacy: "80 tcp"},
+			errMatch: fmt.Errorf("expected \"<target>\" or"),
+		},
+		{
+			desc:     "object with target port out of range",
+			dest:     types.Destination{LocalPort: 80, Protocol: "tcp", Target: "10.100.3.1", TargetPort: 70000},
+			errMatch: fmt.Errorf("targetPort: port 70000 out of range 1-65535"),
+		},
+		{
+			desc:     "object with protocol but no localPort",
+			dest:     types.Destination{Protocol: "tcp", Target: "10.100.3.1"},
+			errMatch: fmt.Errorf("protocol and targetPort require localPort"),
+		},
+		{
+			desc:     "object without protocol",
+			dest:     types.Destination{LocalPort: 80, Target: "10.100.3.1"},
+			errMatch: fmt.Errorf("missing protocol"),
+		},
+		{
+			desc:     "object without target",
+			dest:     types.Destination{LocalPort: 80, Protocol: "tcp"},
+			errMatch: fmt.Errorf("missing target"),
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			dest, err := parseDestination(tc.dest)
+			if tc.errMatch != nil {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errMatch.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, dest)
+		})
+	}
+}
+
+func TestParseDestinationsNamesEntry(t *testing.T) {
+	_, err := parseDestinations([]types.Destination{{Legacy: "10.100.3.1"}, {Legacy: "80 icmp 10.100.3.1"}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid destination 1 (\"80 icmp 10.100.3.1\")")
+
+	_, err = parseDestinations([]types.Destination{{Legacy: "80 tcp 10.100.3.1"}, {Legacy: "80 udp 10.100.3.1"}, {Legacy: "80 tcp 10.100.3.2"}})
+	assert.EqualError(t, err, "invalid destination 2 (\"80 tcp 10.100.3.2\"): local port 80/tcp is already redirected")
+
+	_, err = parseDestinations([]types.Destination{{Legacy: "10.100.3.1/30"}, {LocalPort: 80, Protocol: "tcp", Target: "10.100.3.2/30"}})
+	assert.EqualError(t, err, "invalid destination 1 (\"80 tcp 10.100.3.2/30\"): target \"10.100.3.2/30\" is not a single address, only a /32 mask is allowed")
+}
+
+func TestDestinationsByMode(t *testing.T) {
+	ip := &types.IP{Destinations: []types.Destination{{Legacy: "443 partner.example.com"}}}
+
+	dests, err := destinations(&types.NetConf{Mode: types.ModeDNSProxy, IP: ip})
+	assert.NoError(t, err)
+	assert.Empty(t, dests, "dns-proxy destinations must not be DNATed")
+
+	_, err = destinations(&types.NetConf{IP: ip})
+	assert.Error(t, err, "host names are only supported in dns-proxy mode")
+
+	_, err = destinations(&types.NetConf{Mode: types.ModeHTTPProxy, IP: ip})
+	assert.EqualError(t, err, "destinations are not supported in http-proxy mode")
+}
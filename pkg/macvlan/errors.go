@@ -0,0 +1,39 @@
+package macvlan
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+)
+
+// cniError logs the formatted message and returns it as a CNI error carrying code,
+// so that the container runtime receives a well-known error code instead of a
+// generic internal error.
+func cniError(code uint, format string, a ...interface{}) error {
+	msg := fmt.Sprintf(format, a...)
+	logging.Errorf("%s", msg)
+	return cnitypes.NewError(code, msg, "")
+}
+
+// ioErrorCode maps an error returned by netlink, sysctl or nft to a CNI error code.
+// Transient kernel errors ask the runtime to retry, everything else is an I/O failure.
+func ioErrorCode(err error) uint {
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EBUSY) {
+		return cnitypes.ErrTryAgainLater
+	}
+	return cnitypes.ErrIOFailure
+}
+
+// asCNIError returns err unchanged if it already is a CNI error and otherwise
+// wraps it with the given code.
+func asCNIError(code uint, err error) error {
+	var cniErr *cnitypes.Error
+	if errors.As(err, &cniErr) {
+		return err
+	}
+	return cnitypes.NewError(code, err.Error(), "")
+}
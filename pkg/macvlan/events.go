@@ -0,0 +1,190 @@
+package macvlan
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+// Reasons of the Events posted against the pod.
+const (
+	eventReasonConfigured     = "EgressConfigured"
+	eventReasonSetupFailed    = "EgressSetupFailed"
+	eventReasonRemoved        = "EgressRemoved"
+	eventReasonTeardownFailed = "EgressTeardownFailed"
+	// eventReasonGatewayUnreachable is posted when a gateway does not answer the
+	// gatewayProbe and its onFailure is "warn"
+	eventReasonGatewayUnreachable = "EgressGatewayUnreachable"
+)
+
+const (
+	// defaultEventInterval is the minimum time between two Events of the same
+	// reason for a pod if the configuration does not set one
+	defaultEventInterval = time.Minute
+	// eventTimeout bounds the time spent posting an Event
+	eventTimeout = 5 * time.Second
+	// eventStateRetention is how long the time of the last Event of a pod is kept
+	eventStateRetention = 24 * time.Hour
+	// maxEventMessage is the length beyond which Event messages are truncated
+	maxEventMessage = 1024
+)
+
+// createEvent posts event to the API server.
+var createEvent = func(ctx context.Context, event *corev1.Event) error {
+	clientset, err := kubeClient()
+	if err != nil {
+		return err
+	}
+	_, err = clientset.CoreV1().Events(event.Namespace).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
+
+// eventInterval returns the minimum time between two Events of the same reason
+// for a pod.
+func eventInterval(events *types.Events) (time.Duration, error) {
+	if events.Interval == "" {
+		return defaultEventInterval, nil
+	}
+	interval, err := time.ParseDuration(events.Interval)
+	if err != nil {
+		return 0, err
+	}
+	if interval < 0 {
+		return 0, fmt.Errorf("interval %s is negative", events.Interval)
+	}
+	return interval, nil
+}
+
+// postEvent posts an Event against the pod of the invocation if n enables
+// Events, unless an Event with the same reason was posted for the pod less than
+// the configured interval ago, so that crash-looping pods do not flood the API
+// server. Failures are logged and never fail the invocation.
+func postEvent(n *types.NetConf, args *skel.CmdArgs, eventType, reason, message string) {
+	if n.Events == nil {
+		return
+	}
+	k8sArgs := &types.K8sArgs{CommonArgs: cnitypes.CommonArgs{IgnoreUnknown: true}}
+	if err := cnitypes.LoadArgs(args.Args, k8sArgs); err != nil || k8sArgs.K8S_POD_NAMESPACE == "" || k8sArgs.K8S_POD_NAME == "" {
+		logging.Debugf("Not posting %s Event: no pod in CNI_ARGS", reason)
+		return
+	}
+	namespace, name := string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME)
+
+	interval, err := eventInterval(n.Events)
+	if err != nil {
+		interval = defaultEventInterval
+	}
+	now := time.Now()
+	if !allowEvent(namespace, name, reason, interval, now) {
+		logging.Debugf("Not posting %s Event for pod %s/%s: one was posted less than %s ago", reason, namespace, name, interval)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+	defer cancel()
+	if err := createEvent(ctx, newEvent(k8sArgs, eventType, reason, message, now)); err != nil {
+		logging.Errorf("failed to post %s Event for pod %s/%s: %v", reason, namespace, name, err)
+		return
+	}
+	logging.Debugf("Posted %s Event for pod %s/%s", reason, namespace, name)
+}
+
+// newEvent returns an Event against the pod named in k8sArgs.
+func newEvent(k8sArgs *types.K8sArgs, eventType, reason, message string, now time.Time) *corev1.Event {
+	if len(message) > maxEventMessage {
+		message = message[:maxEventMessage-3] + "..."
+	}
+	host, _ := os.Hostname()
+	timestamp := metav1.NewTime(now)
+	return &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: string(k8sArgs.K8S_POD_NAME) + ".",
+			Namespace:    string(k8sArgs.K8S_POD_NAMESPACE),
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  string(k8sArgs.K8S_POD_NAMESPACE),
+			Name:       string(k8sArgs.K8S_POD_NAME),
+			UID:        k8stypes.UID(k8sArgs.K8S_POD_UID),
+		},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         corev1.EventSource{Component: "egress-router-cni", Host: host},
+		FirstTimestamp: timestamp,
+		LastTimestamp:  timestamp,
+		Count:          1,
+	}
+}
+
+// eventStateDir holds one file per pod and Event reason, whose modification
+// time is the time the last such Event was posted.
+func eventStateDir() string {
+	return filepath.Join(stateDir, "events")
+}
+
+// allowEvent reports whether an Event of reason may be posted for the pod now,
+// and if so records it. The records of Events posted long ago are deleted.
+func allowEvent(namespace, name, reason string, interval time.Duration, now time.Time) bool {
+	dir := eventStateDir()
+	path := filepath.Join(dir, fmt.Sprintf("%s_%s_%s", namespace, name, reason))
+	if info, err := os.Stat(path); err == nil && now.Sub(info.ModTime()) < interval {
+		return false
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logging.Errorf("failed to record Event for pod %s/%s: %v", namespace, name, err)
+		return true
+	}
+	err := os.WriteFile(path, nil, 0600)
+	if err == nil {
+		err = os.Chtimes(path, now, now)
+	}
+	if err != nil {
+		logging.Errorf("failed to record Event for pod %s/%s: %v", namespace, name, err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && now.Sub(info.ModTime()) > eventStateRetention {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+	return true
+}
+
+// configuredEventMessage describes the egress configuration applied by ADD.
+func configuredEventMessage(n *types.NetConf, ifName string, ips []*current.IPConfig, families []egressFamily, dests []destination) string {
+	var addresses, gateways []string
+	for _, ipc := range ips {
+		addresses = append(addresses, ipc.Address.String())
+	}
+	for _, f := range families {
+		gateways = append(gateways, f.gateway.String())
+	}
+	msg := fmt.Sprintf("Configured %s with egress address %s via gateway %s", ifName, strings.Join(addresses, ", "), strings.Join(gateways, ", "))
+	switch n.Mode {
+	case "", types.ModeRedirect:
+		msg += fmt.Sprintf(", %d destinations redirected", len(dests))
+	default:
+		msg += fmt.Sprintf(" in %s mode", n.Mode)
+	}
+	if n.Filter != nil {
+		msg += fmt.Sprintf(", %d destinations allowed", len(n.Filter.Allow))
+	}
+	return msg
+}
@@ -0,0 +1,65 @@
+package macvlan
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+func TestPostEvent(t *testing.T) {
+	stateDir = t.TempDir()
+	var posted []*corev1.Event
+	defer func(f func(context.Context, *corev1.Event) error) { createEvent = f }(createEvent)
+	createEvent = func(_ context.Context, event *corev1.Event) error {
+		posted = append(posted, event)
+		return nil
+	}
+
+	args := &skel.CmdArgs{Args: "IgnoreUnknown=1;K8S_POD_NAMESPACE=egress;K8S_POD_NAME=router;K8S_POD_UID=1234"}
+	n := &types.NetConf{Events: &types.Events{Interval: "1h"}}
+
+	postEvent(&types.NetConf{}, args, corev1.EventTypeNormal, eventReasonConfigured, "configured")
+	assert.Empty(t, posted, "Events must not be posted unless enabled")
+
+	postEvent(n, &skel.CmdArgs{}, corev1.EventTypeNormal, eventReasonConfigured, "configured")
+	assert.Empty(t, posted, "Events must not be posted without a pod")
+
+	postEvent(n, args, corev1.EventTypeNormal, eventReasonConfigured, "configured")
+	postEvent(n, args, corev1.EventTypeNormal, eventReasonConfigured, "configured again")
+	postEvent(n, args, corev1.EventTypeWarning, eventReasonSetupFailed, "failed")
+	if assert.Len(t, posted, 2, "Events of the same reason must be rate limited") {
+		e := posted[0]
+		assert.Equal(t, "egress", e.Namespace)
+		assert.Equal(t, "router.", e.GenerateName)
+		assert.Equal(t, corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "egress", Name: "router", UID: "1234"}, e.InvolvedObject)
+		assert.Equal(t, corev1.EventTypeNormal, e.Type)
+		assert.Equal(t, eventReasonConfigured, e.Reason)
+		assert.Equal(t, "configured", e.Message)
+		assert.Equal(t, "egress-router-cni", e.Source.Component)
+		assert.Equal(t, int32(1), e.Count)
+		assert.Equal(t, eventReasonSetupFailed, posted[1].Reason)
+	}
+
+	n.Events.Interval = "0s"
+	postEvent(n, args, corev1.EventTypeNormal, eventReasonConfigured, "configured again")
+	assert.Len(t, posted, 3, "a zero interval must not rate limit Events")
+
+	createEvent = func(context.Context, *corev1.Event) error {
+		return fmt.Errorf("forbidden")
+	}
+	postEvent(n, args, corev1.EventTypeNormal, eventReasonRemoved, "removed")
+}
+
+func TestNewEventTruncatesMessage(t *testing.T) {
+	e := newEvent(&types.K8sArgs{}, corev1.EventTypeWarning, eventReasonSetupFailed, strings.Repeat("x", 2*maxEventMessage), time.Now())
+	assert.Len(t, e.Message, maxEventMessage)
+	assert.True(t, strings.HasSuffix(e.Message, "..."))
+}
@@ -0,0 +1,199 @@
+package macvlan
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/knftables"
+
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+// allowRule is a validated entry of the filter allowlist.
+type allowRule struct {
+	cidr *net.IPNet
+	// protocol is "tcp", "udp" or "sctp", and empty when all traffic to cidr is allowed
+	protocol string
+	port     int
+	// entry is the allowlist entry as configured, used as the nftables rule comment
+	entry string
+}
+
+// egressFilter is the validated filter configuration.
+type egressFilter struct {
+	allow  []allowRule
+	reject bool
+}
+
+// parseFilter validates the filter configuration. It returns nil if no filter is configured.
+func parseFilter(f *types.Filter) (*egressFilter, error) {
+	if f == nil {
+		return nil, nil
+	}
+	if len(f.Allow) == 0 {
+		return nil, fmt.Errorf("filter requires at least one allow entry")
+	}
+
+	filter := &egressFilter{reject: f.Reject}
+	parser := &allowParser{}
+	for i, entry := range f.Allow {
+		rule, err := parser.parse(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter allow entry %d (%q): %v", i, entry, err)
+		}
+		filter.allow = append(filter.allow, rule)
+	}
+	return filter, nil
+}
+
+// allowParser parses allowlist entries one at a time, rejecting an entry that
+// overlaps a previous one of the same set: nftables refuses overlapping
+// intervals in a set, as the allowlist sets do not merge them.
+type allowParser struct {
+	rules []allowRule
+}
+
+// parse parses and validates entry, the next allowlist entry.
+func (p *allowParser) parse(entry string) (allowRule, error) {
+	rule, err := parseAllowRule(entry)
+	if err != nil {
+		return allowRule{}, err
+	}
+	for _, r := range p.rules {
+		if r.protocol == rule.protocol && r.port == rule.port && (r.cidr.Contains(rule.cidr.IP) || rule.cidr.Contains(r.cidr.IP)) {
+			return allowRule{}, fmt.Errorf("overlaps %q", r.entry)
+		}
+	}
+	p.rules = append(p.rules, rule)
+	return rule, nil
+}
+
+// parseAllowRule parses an allowlist entry in the "<cidr> [<protocol> <port>]" format.
+// A bare IP address stands for a single host.
+func parseAllowRule(entry string) (allowRule, error) {
+	fields := strings.Fields(entry)
+	if len(fields) != 1 && len(fields) != 3 {
+		return allowRule{}, fmt.Errorf("expected \"<cidr>\" or \"<cidr> <protocol> <port>\"")
+	}
+
+	rule := allowRule{entry: entry}
+	if ip := net.ParseIP(fields[0]); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		rule.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		_, cidr, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return allowRule{}, fmt.Errorf("%q is not a CIDR or an IP address", fields[0])
+		}
+		rule.cidr = cidr
+	}
+	if len(fields) == 1 {
+		return rule, nil
+	}
+
+	rule.protocol = strings.ToLower(fields[1])
+	if rule.protocol != "tcp" && rule.protocol != "udp" && rule.protocol != "sctp" {
+		return allowRule{}, fmt.Errorf("unsupported protocol %q, must be one of tcp, udp or sctp", fields[1])
+	}
+	port, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return allowRule{}, fmt.Errorf("port %q is not a number", fields[2])
+	}
+	if err := validatePort(port); err != nil {
+		return allowRule{}, err
+	}
+	rule.port = port
+	return rule, nil
+}
+
+// generateFilterNFTablesRules adds the forward chain restricting the traffic
+// leaving through ifName to the allowlist of filter. The allowlist is held in
+// interval sets per IP family, one for whole CIDRs and one for CIDR, protocol
+// and port concatenations, each matched by a single rule. Other traffic is
+// dropped, or rejected if filter.reject is set. Nothing is added if filter is nil.
+func generateFilterNFTablesRules(tx *knftables.Transaction, ifName string, filter *egressFilter) {
+	if filter == nil {
+		return
+	}
+
+	tx.Add(&knftables.Chain{
+		Name: "forward",
+
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(knftables.ForwardHook),
+		Priority: knftables.PtrTo(knftables.FilterPriority),
+	})
+	tx.Add(&knftables.Rule{
+		Chain:   "forward",
+		Rule:    knftables.Concat("oif", ifName, "ct state established,related accept"),
+		Comment: knftables.PtrTo("established"),
+	})
+
+	for _, isIPv6 := range []bool{false, true} {
+		for _, withPorts := range []bool{false, true} {
+			name := allowSetName(isIPv6, withPorts)
+			var elements []*knftables.Element
+			for _, rule := range filter.allow {
+				if (rule.cidr.IP.To4() == nil) != isIPv6 || (rule.protocol != "") != withPorts {
+					continue
+				}
+				key := []string{rule.cidr.String()}
+				if withPorts {
+					key = append(key, rule.protocol, strconv.Itoa(rule.port))
+				}
+				elements = append(elements, &knftables.Element{
+					Set:     name,
+					Key:     key,
+					Comment: knftables.PtrTo(rule.entry),
+				})
+			}
+			if len(elements) == 0 {
+				continue
+			}
+
+			setType := nftAddrType(isIPv6)
+			match := []interface{}{"oif", ifName, nftFamily(isIPv6), "daddr"}
+			if withPorts {
+				setType += " . inet_proto . inet_service"
+				match = append(match, ". meta l4proto . th dport")
+			}
+			tx.Add(&knftables.Set{
+				Name:  name,
+				Type:  setType,
+				Flags: []knftables.SetFlag{knftables.IntervalFlag},
+			})
+			for _, e := range elements {
+				tx.Add(e)
+			}
+			tx.Add(&knftables.Rule{
+				Chain:   "forward",
+				Rule:    knftables.Concat(append(match, "@", name, "accept")...),
+				Comment: knftables.PtrTo(name),
+			})
+		}
+	}
+
+	verdict := "drop"
+	if filter.reject {
+		verdict = "reject"
+	}
+	tx.Add(&knftables.Rule{
+		Chain:   "forward",
+		Rule:    knftables.Concat("oif", ifName, verdict),
+		Comment: knftables.PtrTo(verdict),
+	})
+}
+
+// allowSetName returns the name of the allowlist set of an IP family, for whole
+// CIDRs or for CIDR, protocol and port concatenations.
+func allowSetName(isIPv6, withPorts bool) string {
+	if withPorts {
+		return "allow-ports-" + nftNFProto(isIPv6)
+	}
+	return "allow-" + nftNFProto(isIPv6)
+}
@@ -0,0 +1,165 @@
+package macvlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/knftables"
+
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		desc     string
+		filter   *types.Filter
+		errMatch error
+	}{
+		{
+			desc:   "no filter",
+			filter: nil,
+		},
+		{
+			desc:   "CIDRs, hosts and ports",
+			filter: &types.Filter{Allow: []string{"10.100.3.0/24", "203.0.113.26", "2001:db8::/32 TCP 443"}},
+		},
+		{
+			desc:   "same CIDR with other ports and families",
+			filter: &types.Filter{Allow: []string{"10.0.0.0/8 tcp 443", "10.1.0.0/16 tcp 80", "10.1.0.0/16 udp 443", "10.100.3.0/24", "2001:db8::/32"}},
+		},
+		{
+			desc:     "nested CIDRs",
+			filter:   &types.Filter{Allow: []string{"10.0.0.0/8", "203.0.113.26", "10.1.0.0/16"}},
+			errMatch: fmt.Errorf("invalid filter allow entry 2 (\"10.1.0.0/16\"): overlaps \"10.0.0.0/8\""),
+		},
+		{
+			desc:     "host in a CIDR",
+			filter:   &types.Filter{Allow: []string{"2001:db8::1 tcp 443", "2001:db8::/32 TCP 443"}},
+			errMatch: fmt.Errorf("invalid filter allow entry 1 (\"2001:db8::/32 TCP 443\"): overlaps \"2001:db8::1 tcp 443\""),
+		},
+		{
+			desc:     "duplicate entry",
+			filter:   &types.Filter{Allow: []string{"10.100.3.0/24", "10.100.3.0/24"}},
+			errMatch: fmt.Errorf("invalid filter allow entry 1 (\"10.100.3.0/24\"): overlaps \"10.100.3.0/24\""),
+		},
+		{
+			desc:     "empty allowlist",
+			filter:   &types.Filter{},
+			errMatch: fmt.Errorf("filter requires at least one allow entry"),
+		},
+		{
+			desc:     "invalid CIDR",
+			filter:   &types.Filter{Allow: []string{"10.100.3.0/24", "10.100.3.0/33"}},
+			errMatch: fmt.Errorf("invalid filter allow entry 1 (\"10.100.3.0/33\"): \"10.100.3.0/33\" is not a CIDR or an IP address"),
+		},
+		{
+			desc:     "port without protocol",
+			filter:   &types.Filter{Allow: []string{"10.100.3.0/24 443"}},
+			errMatch: fmt.Errorf("expected \"<cidr>\" or \"<cidr> <protocol> <port>\""),
+		},
+		{
+			desc:     "invalid protocol",
+			filter:   &types.Filter{Allow: []string{"10.100.3.0/24 icmp 1"}},
+			errMatch: fmt.Errorf("unsupported protocol \"icmp\""),
+		},
+		{
+			desc:     "port out of range",
+			filter:   &types.Filter{Allow: []string{"10.100.3.0/24 tcp 0"}},
+			errMatch: fmt.Errorf("port 0 out of range 1-65535"),
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			filter, err := parseFilter(tc.filter)
+			if tc.errMatch != nil {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errMatch.Error())
+				return
+			}
+			assert.NoError(t, err)
+			if tc.filter == nil {
+				assert.Nil(t, filter)
+			} else {
+				assert.Len(t, filter.allow, len(tc.filter.Allow))
+			}
+		})
+	}
+}
+
+func TestGenerateFilterNFTablesRules(t *testing.T) {
+	tests := []struct {
+		desc        string
+		filter      *types.Filter
+		forwardExpt []string
+		setsExpt    map[string][]string
+	}{
+		{
+			desc:        "no filter",
+			forwardExpt: nil,
+		},
+		{
+			desc:   "drop",
+			filter: &types.Filter{Allow: []string{"10.100.3.0/24", "203.0.113.26 tcp 443", "198.51.100.0/24", "203.0.113.27 udp 53"}},
+			forwardExpt: []string{
+				"oif net1 ct state established,related accept",
+				"oif net1 ip daddr @allow-ipv4 accept",
+				"oif net1 ip daddr . meta l4proto . th dport @allow-ports-ipv4 accept",
+				"oif net1 drop",
+			},
+			setsExpt: map[string][]string{
+				"allow-ipv4":       {"10.100.3.0/24", "198.51.100.0/24"},
+				"allow-ports-ipv4": {"203.0.113.26/32 . tcp . 443", "203.0.113.27/32 . udp . 53"},
+			},
+		},
+		{
+			desc:   "reject with IPv6",
+			filter: &types.Filter{Allow: []string{"2001:db8::/32 udp 53"}, Reject: true},
+			forwardExpt: []string{
+				"oif net1 ct state established,related accept",
+				"oif net1 ip6 daddr . meta l4proto . th dport @allow-ports-ipv6 accept",
+				"oif net1 reject",
+			},
+			setsExpt: map[string][]string{
+				"allow-ports-ipv6": {"2001:db8::/32 . udp . 53"},
+			},
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			filter, err := parseFilter(tc.filter)
+			assert.NoError(t, err)
+
+			fake := knftables.NewFake(egressTableFamily, egressTableName)
+			tx := fake.NewTransaction()
+			generateEgressNFTablesRules(tx, "eth0", "net1", []net.IP{net.ParseIP("192.168.3.10")}, nil, filter)
+			assert.NoError(t, fake.Run(context.Background(), tx))
+
+			chain, ok := fake.Table.Chains["forward"]
+			if tc.forwardExpt == nil {
+				assert.False(t, ok, "no forward chain without a filter")
+				return
+			}
+			assert.True(t, ok)
+			assert.Equal(t, knftables.FilterType, *chain.Type)
+			assert.Equal(t, knftables.ForwardHook, *chain.Hook)
+			var rules []string
+			for _, r := range chain.Rules {
+				rules = append(rules, r.Rule)
+			}
+			assert.Equal(t, tc.forwardExpt, rules)
+
+			sets := map[string][]string{}
+			for name, set := range fake.Table.Sets {
+				assert.Equal(t, []knftables.SetFlag{knftables.IntervalFlag}, set.Flags)
+				for _, e := range set.Elements {
+					sets[name] = append(sets[name], strings.Join(e.Key, " . "))
+				}
+			}
+			assert.Equal(t, tc.setsExpt, sets)
+		})
+	}
+}
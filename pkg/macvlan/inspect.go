@@ -0,0 +1,398 @@
+package macvlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"sigs.k8s.io/knftables"
+
+	"github.com/openshift/egress-router-cni/pkg/util"
+)
+
+// Report is the egress state of a pod network namespace, as found by Inspect.
+type Report struct {
+	// Link is nil if the egress interface does not exist
+	Link      *ReportLink `json:"link"`
+	Addresses []string    `json:"addresses"`
+	// Routes are the routes of the main table and of the policy routing tables
+	Routes []PlanRoute `json:"routes"`
+	// Rules are the ip rules selecting other tables than the main, local and
+	// default ones, as "ip rule" lists them
+	Rules   []string          `json:"rules,omitempty"`
+	Sysctls map[string]string `json:"sysctls"`
+	// Neighbors are the neighbor entries of the egress gateways
+	Neighbors []ReportNeighbor `json:"neighbors"`
+	// Ruleset is the egress_cni table as listed by nft, empty if it does not exist
+	Ruleset  string          `json:"ruleset"`
+	Counters []ReportCounter `json:"counters,omitempty"`
+	// Deviations lists the differences from the network configuration, if one
+	// was given
+	Deviations []string `json:"deviations"`
+}
+
+// ReportLink is the egress interface found by Inspect.
+type ReportLink struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode,omitempty"`
+	MTU  int    `json:"mtu"`
+	MAC  string `json:"mac"`
+	// Master is the host interface the egress interface is attached to
+	Master string `json:"master"`
+	State  string `json:"state"`
+}
+
+// ReportNeighbor is the neighbor entry of a gateway.
+type ReportNeighbor struct {
+	IP string `json:"ip"`
+	// MAC is empty if the gateway has no entry or it is not resolved
+	MAC   string `json:"mac,omitempty"`
+	State string `json:"state"`
+}
+
+// ReportCounter is the counter of a rule of the egress_cni table.
+type ReportCounter struct {
+	Chain   string `json:"chain"`
+	Comment string `json:"comment"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Inspect reports the egress state of the network namespace at netnsPath for the
+// egress interface ifName. If conf, a network configuration, is not nil, the
+// state is compared against what ADD would configure for it, computed as Render
+// does with opts, and the differences are listed in the Deviations of the report.
+func Inspect(netnsPath, ifName string, conf []byte, opts RenderOptions) (*Report, error) {
+	report := &Report{Sysctls: map[string]string{}, Deviations: []string{}}
+	var plan *Plan
+	if conf != nil {
+		var err error
+		opts.IfName = ifName
+		if plan, err = Render(conf, opts); err != nil {
+			report.Deviations = append(report.Deviations, fmt.Sprintf("cannot compute the expected state: %v", err))
+		}
+	}
+
+	var parentIndex int
+	err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		var err error
+		parentIndex, err = inspectNetNS(report, ifName, plan)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The master lives in the host network namespace
+	if report.Link != nil && parentIndex != 0 {
+		if master, err := util.GetNetLinkOps().LinkByIndex(parentIndex); err == nil {
+			report.Link.Master = master.Attrs().Name
+		} else {
+			report.Link.Master = fmt.Sprintf("<index %d>", parentIndex)
+		}
+	}
+
+	if plan != nil {
+		report.Deviations = append(report.Deviations, reportDeviations(report, plan)...)
+	}
+	return report, nil
+}
+
+// inspectNetNS fills report with the state of the current network namespace and
+// returns the index of the master of ifName. It must be called inside the pod
+// network namespace.
+func inspectNetNS(report *Report, ifName string, plan *Plan) (int, error) {
+	nlo := util.GetNetLinkOps()
+	link, err := nlo.LinkByName(ifName)
+	if err != nil {
+		report.Deviations = append(report.Deviations, fmt.Sprintf("interface %q not found: %v", ifName, err))
+	} else {
+		report.Link = &ReportLink{
+			Name:  ifName,
+			Type:  link.Type(),
+			Mode:  linkMode(link),
+			MTU:   link.Attrs().MTU,
+			MAC:   link.Attrs().HardwareAddr.String(),
+			State: link.Attrs().OperState.String(),
+		}
+		addrs, err := nlo.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return 0, fmt.Errorf("failed to list addresses on %q: %v", ifName, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			report.Addresses = append(report.Addresses, addr.IPNet.String())
+		}
+	}
+
+	// A zero table with the table filter lists the routes of every table
+	routes, err := nlo.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list routes: %v", err)
+	}
+	devices := map[int]string{}
+	for _, r := range routes {
+		if r.Table == unix.RT_TABLE_LOCAL || (r.Dst != nil && (r.Dst.IP.IsLinkLocalUnicast() || r.Dst.IP.IsMulticast())) {
+			continue
+		}
+		if _, ok := devices[r.LinkIndex]; !ok {
+			if l, err := nlo.LinkByIndex(r.LinkIndex); err == nil {
+				devices[r.LinkIndex] = l.Attrs().Name
+			}
+		}
+		isIPv6 := (r.Dst != nil && r.Dst.IP.To4() == nil) || (r.Dst == nil && r.Gw != nil && r.Gw.To4() == nil)
+		route := planRoute(r, devices, isIPv6)
+		if route.Table == unix.RT_TABLE_MAIN {
+			route.Table = 0
+		}
+		report.Routes = append(report.Routes, route)
+	}
+
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list ip rules: %v", err)
+	}
+	for i := range rules {
+		switch rules[i].Table {
+		case unix.RT_TABLE_MAIN, unix.RT_TABLE_LOCAL, unix.RT_TABLE_DEFAULT:
+			continue
+		}
+		report.Rules = append(report.Rules, describeRule(&rules[i]))
+	}
+
+	for _, name := range []string{ipForwardSysctl(false), ipForwardSysctl(true), fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, ifName)} {
+		if value, err := sysctl.Sysctl(name); err == nil {
+			report.Sysctls[name] = value
+		}
+	}
+
+	if link != nil {
+		for _, gw := range egressGateways(report.Routes, plan, ifName) {
+			report.Neighbors = append(report.Neighbors, gatewayNeighbor(link, gw))
+		}
+	}
+
+	ctx := context.Background()
+	if out, err := exec.CommandContext(ctx, "nft", "list", "table", string(egressTableFamily), egressTableName).Output(); err == nil {
+		report.Ruleset = string(out)
+		counters, err := listNFTCounters(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, c := range counters {
+			report.Counters = append(report.Counters, ReportCounter{Chain: c.chain, Comment: c.comment, Packets: c.packets, Bytes: c.bytes})
+		}
+	}
+	if plan != nil {
+		expected := knftables.NewFake(egressTableFamily, egressTableName)
+		if err := expected.ParseDump(plan.Ruleset); err != nil {
+			return 0, fmt.Errorf("failed to parse the expected ruleset: %v", err)
+		}
+		nft, err := knftables.New(egressTableFamily, egressTableName)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get NFTables: %v", err)
+		}
+		if err := checkNFTablesRules(ctx, nft, expected); err != nil {
+			report.Deviations = append(report.Deviations, err.Error())
+		}
+	}
+
+	if link == nil {
+		return 0, nil
+	}
+	return link.Attrs().ParentIndex, nil
+}
+
+// linkMode returns the name of the macvlan or ipvlan mode of link.
+func linkMode(link netlink.Link) string {
+	switch l := link.(type) {
+	case *netlink.Macvlan:
+		for _, name := range []string{"bridge", "private", "vepa", "passthru"} {
+			if mode, _ := modeFromString(name); mode == l.Mode {
+				return name
+			}
+		}
+		return fmt.Sprintf("%d", l.Mode)
+	case *netlink.IPVlan:
+		for _, name := range []string{"l2", "l3", "l3s"} {
+			if mode, _ := ipvlanModeFromString(name); mode == l.Mode {
+				return name
+			}
+		}
+		return fmt.Sprintf("%d", l.Mode)
+	}
+	return ""
+}
+
+// egressGateways returns the gateways of the egress interface: the ones of the
+// plan if there is one, and otherwise the ones of the default routes via ifName.
+func egressGateways(routes []PlanRoute, plan *Plan, ifName string) []net.IP {
+	if plan != nil {
+		routes = plan.Routes
+	}
+	var gateways []net.IP
+	seen := map[string]bool{}
+	for _, r := range routes {
+		if r.Device != ifName || (r.Destination != "0.0.0.0/0" && r.Destination != "::/0") || seen[r.Gateway] {
+			continue
+		}
+		if gw := net.ParseIP(r.Gateway); gw != nil {
+			gateways = append(gateways, gw)
+			seen[r.Gateway] = true
+		}
+	}
+	return gateways
+}
+
+// gatewayNeighbor returns the neighbor entry of gw on link.
+func gatewayNeighbor(link netlink.Link, gw net.IP) ReportNeighbor {
+	neighbor := ReportNeighbor{IP: gw.String(), State: "none"}
+	neighs, err := util.GetNetLinkOps().NeighList(link.Attrs().Index, netlinkFamily(gw.To4() == nil))
+	if err != nil {
+		neighbor.State = fmt.Sprintf("unknown: %v", err)
+		return neighbor
+	}
+	for _, n := range neighs {
+		if n.IP.Equal(gw) {
+			if n.HardwareAddr != nil {
+				neighbor.MAC = n.HardwareAddr.String()
+			}
+			neighbor.State = neighState(n.State)
+			break
+		}
+	}
+	return neighbor
+}
+
+// neighState returns the name of a neighbor state, as "ip neigh" shows it.
+func neighState(state int) string {
+	names := []struct {
+		state int
+		name  string
+	}{
+		{netlink.NUD_INCOMPLETE, "INCOMPLETE"},
+		{netlink.NUD_REACHABLE, "REACHABLE"},
+		{netlink.NUD_STALE, "STALE"},
+		{netlink.NUD_DELAY, "DELAY"},
+		{netlink.NUD_PROBE, "PROBE"},
+		{netlink.NUD_FAILED, "FAILED"},
+		{netlink.NUD_NOARP, "NOARP"},
+		{netlink.NUD_PERMANENT, "PERMANENT"},
+	}
+	var states []string
+	for _, n := range names {
+		if state&n.state != 0 {
+			states = append(states, n.name)
+		}
+	}
+	if len(states) == 0 {
+		return "NONE"
+	}
+	return strings.Join(states, ",")
+}
+
+// reportDeviations compares report against plan, except for the nftables
+// ruleset, which is compared live.
+func reportDeviations(report *Report, plan *Plan) []string {
+	var deviations []string
+	if l := report.Link; l != nil {
+		if l.Type != plan.Interface.Type {
+			deviations = append(deviations, fmt.Sprintf("interface %q is of type %q, expected %q", l.Name, l.Type, plan.Interface.Type))
+		} else if l.Mode != plan.Interface.Mode {
+			deviations = append(deviations, fmt.Sprintf("interface %q has %s mode %q, expected %q", l.Name, l.Type, l.Mode, plan.Interface.Mode))
+		}
+		if plan.Interface.MTU != "" && fmt.Sprint(l.MTU) != plan.Interface.MTU {
+			deviations = append(deviations, fmt.Sprintf("interface %q has MTU %d, expected %s", l.Name, l.MTU, plan.Interface.MTU))
+		}
+		if plan.Interface.Master != "" && l.Master != plan.Interface.Master {
+			deviations = append(deviations, fmt.Sprintf("interface %q is attached to %q, expected %q", l.Name, l.Master, plan.Interface.Master))
+		}
+
+		addresses := map[string]bool{}
+		for _, a := range report.Addresses {
+			addresses[a] = true
+		}
+		for _, a := range plan.Addresses {
+			if !addresses[a] {
+				deviations = append(deviations, fmt.Sprintf("address %s missing on %q", a, l.Name))
+			}
+			delete(addresses, a)
+		}
+		for _, a := range util.SortedKeys(addresses) {
+			deviations = append(deviations, fmt.Sprintf("unexpected address %s on %q", a, l.Name))
+		}
+	}
+
+	for _, expected := range plan.Routes {
+		found := false
+		for _, r := range report.Routes {
+			if r.Destination == expected.Destination && r.Device == expected.Device && r.Table == expected.Table &&
+				(r.Gateway == expected.Gateway || strings.HasPrefix(expected.Gateway, "<")) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			deviations = append(deviations, fmt.Sprintf("route missing: %s", expected))
+		}
+	}
+	for _, deleted := range plan.DeletedRoutes {
+		for _, r := range report.Routes {
+			if r.Destination == deleted.Destination && r.Device == deleted.Device && r.Table == 0 {
+				deviations = append(deviations, fmt.Sprintf("unexpected route: %s", r))
+			}
+		}
+	}
+
+	rules := map[string]bool{}
+	for _, r := range report.Rules {
+		rules[r] = true
+	}
+	for _, r := range plan.Rules {
+		if !rules[r] {
+			deviations = append(deviations, fmt.Sprintf("%s missing", r))
+		}
+	}
+
+	// The IPv6 sysctls of lo and of the interface only matter while addresses
+	// are added, and the interface may be renamed since
+	for _, name := range util.SortedKeys(plan.Sysctls) {
+		if strings.Contains(name, "disable_ipv6") {
+			continue
+		}
+		if value, ok := report.Sysctls[name]; ok && value != plan.Sysctls[name] {
+			deviations = append(deviations, fmt.Sprintf("sysctl %s is %q, expected %q", name, value, plan.Sysctls[name]))
+		}
+	}
+
+	for _, n := range report.Neighbors {
+		if strings.Contains(n.State, "FAILED") || strings.Contains(n.State, "INCOMPLETE") {
+			deviations = append(deviations, fmt.Sprintf("gateway %s is not reachable: neighbor state %s", n.IP, n.State))
+		}
+	}
+	return deviations
+}
+
+// String formats r the way "ip route" lists it.
+func (r PlanRoute) String() string {
+	desc := r.Destination
+	if r.Gateway != "" {
+		desc += " via " + r.Gateway
+	}
+	desc += " dev " + r.Device
+	if r.Table != 0 {
+		desc += fmt.Sprintf(" table %d", r.Table)
+	}
+	if r.Scope != "" {
+		desc += " scope " + r.Scope
+	}
+	return desc
+}
@@ -0,0 +1,131 @@
+package macvlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"sigs.k8s.io/knftables"
+)
+
+func TestReportDeviations(t *testing.T) {
+	plan, err := Render([]byte(`{"interfaceArgs": {"master": "eth1", "mtu": "1500"}, "ip": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1", "destinations": ["80 tcp 10.100.3.1"]}}`), RenderOptions{IfName: "net1", ClusterInterface: "eth0"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	healthy := func() *Report {
+		return &Report{
+			Link:      &ReportLink{Name: "net1", Type: "macvlan", Mode: "bridge", MTU: 1500, Master: "eth1", State: "up"},
+			Addresses: []string{"192.168.3.10/24"},
+			Routes: []PlanRoute{
+				{Destination: "192.168.3.1/32", Device: "net1", Scope: "link"},
+				{Destination: "0.0.0.0/0", Gateway: "192.168.3.1", Device: "net1"},
+				{Destination: "10.128.0.0/14", Gateway: "10.128.0.1", Device: "eth0"},
+			},
+			Sysctls: map[string]string{
+				"net.ipv4.ip_forward":          "1",
+				"net.ipv6.conf.all.forwarding": "0",
+				"net.ipv4.conf.net1.proxy_arp": "1",
+			},
+			Neighbors: []ReportNeighbor{{IP: "192.168.3.1", MAC: "52:54:00:00:00:01", State: "REACHABLE"}},
+		}
+	}
+
+	tests := []struct {
+		desc   string
+		modify func(r *Report)
+		expt   []string
+	}{
+		{
+			desc:   "healthy",
+			modify: func(r *Report) {},
+		},
+		{
+			desc: "interface",
+			modify: func(r *Report) {
+				r.Link.Mode = "private"
+				r.Link.MTU = 9000
+				r.Link.Master = "eth2"
+			},
+			expt: []string{
+				`interface "net1" has macvlan mode "private", expected "bridge"`,
+				`interface "net1" has MTU 9000, expected 1500`,
+				`interface "net1" is attached to "eth2", expected "eth1"`,
+			},
+		},
+		{
+			desc: "addresses",
+			modify: func(r *Report) {
+				r.Addresses = []string{"192.168.3.11/24"}
+			},
+			expt: []string{
+				`address 192.168.3.10/24 missing on "net1"`,
+				`unexpected address 192.168.3.11/24 on "net1"`,
+			},
+		},
+		{
+			desc: "routes",
+			modify: func(r *Report) {
+				r.Routes = []PlanRoute{
+					{Destination: "192.168.3.1/32", Device: "net1", Scope: "link"},
+					{Destination: "0.0.0.0/0", Gateway: "10.128.0.1", Device: "eth0"},
+				}
+			},
+			expt: []string{
+				"route missing: 0.0.0.0/0 via 192.168.3.1 dev net1",
+				"unexpected route: 0.0.0.0/0 via 10.128.0.1 dev eth0",
+			},
+		},
+		{
+			desc: "sysctls and gateway",
+			modify: func(r *Report) {
+				r.Sysctls["net.ipv4.ip_forward"] = "0"
+				r.Neighbors[0] = ReportNeighbor{IP: "192.168.3.1", State: "FAILED"}
+			},
+			expt: []string{
+				`sysctl net.ipv4.ip_forward is "0", expected "1"`,
+				"gateway 192.168.3.1 is not reachable: neighbor state FAILED",
+			},
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			report := healthy()
+			tc.modify(report)
+			assert.Equal(t, tc.expt, reportDeviations(report, plan))
+		})
+	}
+}
+
+func TestExpectedRulesetRoundTrip(t *testing.T) {
+	plan, err := Render([]byte(`{"ip": {"addresses": ["192.168.3.10/24", "fd00::10/64"], "gateway": "192.168.3.1", "gateways": ["fd00::1"], "destinations": ["80 tcp 10.100.3.1", "53 udp fd00:100::1 5353", "10.100.3.2"]}, "filter": {"allow": ["10.100.0.0/16", "fd00:100::/64 udp 5353"]}}`), RenderOptions{IfName: "net1", ClusterInterface: "eth0"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	expected := knftables.NewFake(egressTableFamily, egressTableName)
+	if !assert.NoError(t, expected.ParseDump(plan.Ruleset)) {
+		return
+	}
+
+	// The live table, rendered by ADD, must match the expected one parsed back from the plan
+	live := knftables.NewFake(egressTableFamily, egressTableName)
+	assert.NoError(t, live.ParseDump(plan.Ruleset))
+	assert.NoError(t, checkNFTablesRules(context.Background(), live, expected))
+}
+
+func TestGatewayNeighborState(t *testing.T) {
+	assert.Equal(t, "REACHABLE", neighState(netlink.NUD_REACHABLE))
+	assert.Equal(t, "STALE,NOARP", neighState(netlink.NUD_STALE|netlink.NUD_NOARP))
+	assert.Equal(t, "NONE", neighState(0))
+
+	routes := []PlanRoute{
+		{Destination: "192.168.3.1/32", Device: "net1"},
+		{Destination: "0.0.0.0/0", Gateway: "192.168.3.1", Device: "net1"},
+		{Destination: "::/0", Gateway: "fd00::1", Device: "net1", Table: 100},
+		{Destination: "0.0.0.0/0", Gateway: "10.128.0.1", Device: "eth0"},
+	}
+	assert.Equal(t, []net.IP{net.ParseIP("192.168.3.1"), net.ParseIP("fd00::1")}, egressGateways(routes, nil, "net1"))
+}
@@ -0,0 +1,53 @@
+package macvlan
+
+import (
+	"encoding/json"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ipam"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+// execIPAMAdd delegates address assignment to the IPAM plugin configured in the
+// "ipam" section (host-local, static, whereabouts...) and returns its result.
+func execIPAMAdd(n *types.NetConf, stdinData []byte) (*current.Result, error) {
+	r, err := ipam.ExecAdd(n.IPAM.Type, stdinData)
+	if err != nil {
+		logging.Errorf("IPAM plugin %q failed: %v", n.IPAM.Type, err)
+		return nil, asCNIError(cnitypes.ErrTryAgainLater, err)
+	}
+
+	ipamResult, err := current.NewResultFromResult(r)
+	if err != nil {
+		ipam.ExecDel(n.IPAM.Type, stdinData)
+		return nil, cniError(cnitypes.ErrDecodingFailure, "failed to convert IPAM result: %v", err)
+	}
+	if len(ipamResult.IPs) == 0 {
+		ipam.ExecDel(n.IPAM.Type, stdinData)
+		return nil, cniError(cnitypes.ErrInvalidNetworkConfig, "IPAM plugin %q returned no IP addresses", n.IPAM.Type)
+	}
+	logging.Debugf("IPAM plugin %q assigned %v", n.IPAM.Type, ipamResult.IPs)
+	return ipamResult, nil
+}
+
+// execIPAMDel releases the addresses allocated by the IPAM plugin, if the network
+// configuration delegates address assignment. Unlike ADD it only decodes the
+// configuration, so that DEL keeps working when the node has changed since.
+func execIPAMDel(stdinData []byte) error {
+	n := &types.NetConf{}
+	if err := json.Unmarshal(stdinData, n); err != nil {
+		return cniError(cnitypes.ErrDecodingFailure, "failed to load netconf: %v", err)
+	}
+	if n.IPAM.Type == "" {
+		return nil
+	}
+	if err := ipam.ExecDel(n.IPAM.Type, stdinData); err != nil {
+		logging.Errorf("IPAM plugin %q failed to release addresses: %v", n.IPAM.Type, err)
+		return asCNIError(cnitypes.ErrIOFailure, err)
+	}
+	logging.Debugf("IPAM plugin %q released addresses", n.IPAM.Type)
+	return nil
+}
@@ -0,0 +1,128 @@
+package macvlan
+
+import (
+	"fmt"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+// loadK8sArgs parses the Kubernetes pod identity out of CNI_ARGS.
+func loadK8sArgs(args string) (*types.K8sArgs, error) {
+	k8sArgs := &types.K8sArgs{CommonArgs: cnitypes.CommonArgs{IgnoreUnknown: true}}
+	if err := cnitypes.LoadArgs(args, k8sArgs); err != nil {
+		return nil, cniError(cnitypes.ErrInvalidEnvironmentVariables, "failed to parse CNI_ARGS: %v", err)
+	}
+	return k8sArgs, nil
+}
+
+// selectIP returns ip if set, and otherwise the entry of podIP for podName.
+func selectIP(ip *types.IP, podIP map[string]types.IP, podName string) *types.IP {
+	if ip != nil {
+		return ip
+	}
+	if entry, ok := podIP[podName]; ok {
+		return &entry
+	}
+	return nil
+}
+
+// mergeIP returns base with every field set in overrides replaced.
+func mergeIP(base, overrides *types.IP) *types.IP {
+	if overrides == nil {
+		return base
+	}
+	merged := types.IP{}
+	if base != nil {
+		merged = *base
+	}
+	if len(overrides.Addresses) > 0 {
+		merged.Addresses = overrides.Addresses
+	}
+	if overrides.Gateway != "" {
+		merged.Gateway = overrides.Gateway
+	}
+	if len(overrides.Gateways) > 0 {
+		merged.Gateways = overrides.Gateways
+	}
+	if len(overrides.Destinations) > 0 {
+		merged.Destinations = overrides.Destinations
+	}
+	return &merged
+}
+
+// resolveIP computes the effective "ip" section of n and stores it in n.IP.
+//
+// The inline "ip" section, or the inline "podIP" entry of the pod, is the base.
+// If "ipConfig" references a ConfigMap, its "ip" key, or the "podIP" entry of the
+// pod, replaces the base. "ipConfig.overrides" is then merged on top. Per-pod
+// entries are selected by K8S_POD_NAME, so that each replica of a Deployment can
+// get a distinct egress IP.
+func resolveIP(n *types.NetConf, cniArgs string) error {
+	k8sArgs, err := loadK8sArgs(cniArgs)
+	if err != nil {
+		return err
+	}
+	podNamespace := string(k8sArgs.K8S_POD_NAMESPACE)
+	podName := string(k8sArgs.K8S_POD_NAME)
+
+	var cmIP *types.IP
+	var cmPodIP map[string]types.IP
+	if n.IPConfig != nil && n.IPConfig.Name != "" {
+		if cmIP, cmPodIP, err = loadIPConfig(n.IPConfig, podNamespace); err != nil {
+			return err
+		}
+	}
+	ip, err := effectiveIP(n, cmIP, cmPodIP, podName)
+	if err != nil {
+		return err
+	}
+	if ip != nil {
+		logging.Debugf("Effective IP configuration for pod %s/%s: %+v", podNamespace, podName, *ip)
+	}
+	n.IP = ip
+	return nil
+}
+
+// effectiveIP returns the effective "ip" section of n for the pod podName, given
+// the decoded "ip" or "podIP" key of its ipConfig ConfigMap, if any.
+func effectiveIP(n *types.NetConf, cmIP *types.IP, cmPodIP map[string]types.IP, podName string) (*types.IP, error) {
+	ip := selectIP(n.IP, n.PodIP, podName)
+	if n.IPConfig != nil {
+		if selected := selectIP(cmIP, cmPodIP, podName); selected != nil {
+			ip = selected
+		} else if cmPodIP != nil {
+			return nil, cniError(cnitypes.ErrInvalidNetworkConfig, "ConfigMap %s/%s has no 'podIP' entry for pod %q", n.IPConfig.Namespace, n.IPConfig.Name, podName)
+		}
+		ip = mergeIP(ip, n.IPConfig.Overrides)
+	}
+
+	if (ip == nil || len(ip.Addresses) == 0) && n.IPAM.Type == "" {
+		if n.PodIP != nil && n.IP == nil {
+			return nil, cniError(cnitypes.ErrInvalidNetworkConfig, "no IP addresses configured: 'podIP' has no entry for pod %q", podName)
+		}
+		return nil, cniError(cnitypes.ErrInvalidNetworkConfig, "no IP addresses configured: neither 'ip', 'podIP', 'ipConfig' nor 'ipam' yield an address")
+	}
+	return ip, nil
+}
+
+// EffectiveIP returns the effective "ip" section of n for the pod podName, as ADD
+// resolves it, given the data of the ipConfig ConfigMap if n references one. It
+// is used by the binaries running in the egress router pod, which read the same
+// network configuration as the plugin.
+func EffectiveIP(n *types.NetConf, podName string, ipConfigData map[string]string) (*types.IP, error) {
+	var cmIP *types.IP
+	var cmPodIP map[string]types.IP
+	if n.IPConfig != nil && n.IPConfig.Name != "" {
+		if ipConfigData == nil {
+			return nil, fmt.Errorf("the IP configuration is read from ConfigMap %q, whose content must be provided", n.IPConfig.Name)
+		}
+		var err error
+		if cmIP, cmPodIP, err = parseIPConfigMap(n.IPConfig, ipConfigData); err != nil {
+			return nil, err
+		}
+	}
+	return effectiveIP(n, cmIP, cmPodIP, podName)
+}
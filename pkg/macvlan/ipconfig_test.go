@@ -0,0 +1,124 @@
+package macvlan
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+func TestResolveIP(t *testing.T) {
+	podIP := map[string]types.IP{
+		"egress-router-0": {Addresses: []string{"192.168.3.10/24"}, Gateway: "192.168.3.1"},
+		"egress-router-1": {Addresses: []string{"192.168.3.11/24"}, Gateway: "192.168.3.1"},
+	}
+	tests := []struct {
+		desc     string
+		conf     *types.NetConf
+		args     string
+		expected *types.IP
+		errMatch error
+	}{
+		{
+			desc:     "inline ip",
+			conf:     &types.NetConf{IP: &types.IP{Addresses: []string{"192.168.3.10/24"}}},
+			expected: &types.IP{Addresses: []string{"192.168.3.10/24"}},
+		},
+		{
+			desc:     "inline podIP selected by pod name",
+			conf:     &types.NetConf{PodIP: podIP},
+			args:     "IgnoreUnknown=1;K8S_POD_NAMESPACE=egress;K8S_POD_NAME=egress-router-1",
+			expected: &types.IP{Addresses: []string{"192.168.3.11/24"}, Gateway: "192.168.3.1"},
+		},
+		{
+			desc: "overrides merged on top of podIP",
+			conf: &types.NetConf{
+				PodIP:    podIP,
+				IPConfig: &types.IPConfig{Overrides: &types.IP{Gateway: "192.168.3.254", Destinations: []types.Destination{{Legacy: "80 tcp 10.0.0.1"}}}},
+			},
+			args:     "K8S_POD_NAME=egress-router-0",
+			expected: &types.IP{Addresses: []string{"192.168.3.10/24"}, Gateway: "192.168.3.254", Destinations: []types.Destination{{Legacy: "80 tcp 10.0.0.1"}}},
+		},
+		{
+			desc:     "podIP without entry for the pod",
+			conf:     &types.NetConf{PodIP: podIP},
+			args:     "K8S_POD_NAME=egress-router-2",
+			errMatch: fmt.Errorf("'podIP' has no entry for pod \"egress-router-2\""),
+		},
+		{
+			desc:     "no address at all",
+			conf:     &types.NetConf{},
+			errMatch: fmt.Errorf("no IP addresses configured"),
+		},
+		{
+			desc:     "malformed CNI_ARGS",
+			conf:     &types.NetConf{PodIP: podIP},
+			args:     "K8S_POD_NAME",
+			errMatch: fmt.Errorf("failed to parse CNI_ARGS"),
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			err := resolveIP(tc.conf, tc.args)
+			if tc.errMatch != nil {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errMatch.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, tc.conf.IP)
+		})
+	}
+}
+
+func TestParseIPConfigMap(t *testing.T) {
+	ipc := &types.IPConfig{Namespace: "egress", Name: "egress-ips"}
+	tests := []struct {
+		desc          string
+		data          map[string]string
+		expectedIP    *types.IP
+		expectedPodIP map[string]types.IP
+		errMatch      error
+	}{
+		{
+			desc:       "ip key",
+			data:       map[string]string{"ip": `{"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1"}`},
+			expectedIP: &types.IP{Addresses: []string{"192.168.3.10/24"}, Gateway: "192.168.3.1"},
+		},
+		{
+			desc:          "podIP key",
+			data:          map[string]string{"podIP": `{"egress-router-0": {"addresses": ["192.168.3.10/24"]}}`},
+			expectedPodIP: map[string]types.IP{"egress-router-0": {Addresses: []string{"192.168.3.10/24"}}},
+		},
+		{
+			desc:     "both keys",
+			data:     map[string]string{"ip": "{}", "podIP": "{}"},
+			errMatch: fmt.Errorf("ConfigMap egress/egress-ips contains both 'ip' and 'podIP'"),
+		},
+		{
+			desc:     "neither key",
+			data:     map[string]string{},
+			errMatch: fmt.Errorf("ConfigMap egress/egress-ips contains neither 'ip' nor 'podIP'"),
+		},
+		{
+			desc:     "malformed ip",
+			data:     map[string]string{"ip": "{"},
+			errMatch: fmt.Errorf("failed to parse 'ip' in ConfigMap egress/egress-ips"),
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			ip, podIP, err := parseIPConfigMap(ipc, tc.data)
+			if tc.errMatch != nil {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errMatch.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedIP, ip)
+			assert.Equal(t, tc.expectedPodIP, podIP)
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package macvlan
+
+import (
+	"fmt"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+func ipvlanModeFromString(s string) (netlink.IPVlanMode, error) {
+	switch s {
+	case "l2":
+		return netlink.IPVLAN_MODE_L2, nil
+	case "l3":
+		return netlink.IPVLAN_MODE_L3, nil
+	case "l3s":
+		return netlink.IPVLAN_MODE_L3S, nil
+	default:
+		return 0, fmt.Errorf("unknown ipvlan mode: %q", s)
+	}
+}
+
+// createIpvlan creates an ipvlan interface on the configured master. Unlike macvlan,
+// ipvlan shares the MAC address of the master, which is required on platforms
+// whose switches only accept a single MAC address per port.
+func createIpvlan(conf *types.NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
+	mode, err := ipvlanModeFromString(conf.InterfaceArgs["mode"])
+	if err != nil {
+		return nil, cniError(cnitypes.ErrInvalidNetworkConfig, "%v", err)
+	}
+
+	m, mtu, err := lookupMasterAndMTU(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// due to kernel bug we have to create with tmpName or it might
+	// collide with the name on the host and error out
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return nil, cniError(cnitypes.ErrIOFailure, "failed to generate temporary interface name: %v", err)
+	}
+
+	iv := &netlink.IPVlan{
+		LinkAttrs: netlink.LinkAttrs{
+			MTU:         mtu,
+			Name:        tmpName,
+			ParentIndex: m.Attrs().Index,
+			Namespace:   netlink.NsFd(int(netns.Fd())),
+		},
+		Mode: mode,
+	}
+
+	if err := netlink.LinkAdd(iv); err != nil {
+		return nil, cniError(ioErrorCode(err), "failed to create ipvlan: %v", err)
+	}
+	logging.Debugf("Created ipvlan interface")
+
+	return setupContainerLink(iv, tmpName, ifName, netns)
+}
@@ -3,26 +3,31 @@ package macvlan
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
-	"strings"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	cnitypes "github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/j-keck/arping"
 	"github.com/openshift/egress-router-cni/pkg/util"
 	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"sigs.k8s.io/knftables"
 
+	"github.com/openshift/egress-router-cni/pkg/dnsproxy"
+	"github.com/openshift/egress-router-cni/pkg/httpproxy"
 	"github.com/openshift/egress-router-cni/pkg/logging"
 	"github.com/openshift/egress-router-cni/pkg/types"
 )
@@ -32,13 +37,20 @@ const (
 	DisableIPv6SysctlTemplate           = "net.ipv6.conf.%s.disable_ipv6"
 )
 
+// egressTableName is the nftables table holding the egress router NAT rules. It
+// is an inet table so that a single ruleset serves both IPv4 and IPv6.
+const egressTableName = "egress_cni"
+
+// egressTableFamily is the nftables family of the egress_cni table.
+const egressTableFamily = knftables.InetFamily
+
 func loadNetConf(cluster *types.ClusterConf, bytes []byte) (*types.NetConf, error) {
 	conf := &types.NetConf{}
 	if err := json.Unmarshal(bytes, conf); err != nil {
-		return nil, logging.Errorf("failed to load netconf: %v", err)
+		return nil, cniError(cnitypes.ErrDecodingFailure, "failed to load netconf: %v", err)
 	}
 	if err := fillNetConfDefaults(conf, cluster); err != nil {
-		return nil, err
+		return nil, cnitypes.NewError(cnitypes.ErrInvalidNetworkConfig, err.Error(), "")
 	}
 
 	return conf, nil
@@ -142,7 +154,9 @@ func configureIface(ifName string, res *current.Result) error {
 	return nil
 }
 
-func getDefaultRouteInterfaceName() (string, error) {
+// getDefaultRouteInterfaceName returns the name of the interface of the first
+// default route, skipping the ones through exclude.
+func getDefaultRouteInterfaceName(exclude string) (string, error) {
 	routeToDstIP, err := util.GetNetLinkOps().RouteListFiltered(netlink.FAMILY_ALL, nil, netlink.RT_FILTER_OIF)
 	if err != nil {
 		return "", err
@@ -154,7 +168,9 @@ func getDefaultRouteInterfaceName() (string, error) {
 			if err != nil {
 				return "", err
 			}
-			return l.Attrs().Name, nil
+			if name := l.Attrs().Name; name != exclude {
+				return name, nil
+			}
 		}
 	}
 	logging.Errorf("no default route interface found")
@@ -162,37 +178,50 @@ func getDefaultRouteInterfaceName() (string, error) {
 }
 
 func fillNetConfDefaults(conf *types.NetConf, cluster *types.ClusterConf) error {
+	if conf.LogMaxSize < 0 || conf.LogMaxAge < 0 || conf.LogMaxBackups < 0 {
+		logging.Errorf("log_max_size, log_max_age and log_max_backups must not be negative")
+		return fmt.Errorf("log_max_size, log_max_age and log_max_backups must not be negative")
+	}
+	logging.SetLogRotation(conf.LogMaxSize, conf.LogMaxAge, conf.LogMaxBackups)
 	if conf.LogFile != "" {
 		logging.SetLogFile(conf.LogFile)
 	}
 	if conf.LogLevel != "" {
 		logging.SetLogLevel(conf.LogLevel)
 	}
-	if conf.InterfaceType == "" {
-		if cluster.CloudProvider == "" {
-			conf.InterfaceType = "macvlan"
-		} else {
-			logging.Errorf("must specify explicit interfaceType for cloud provider %q", cluster.CloudProvider)
-			return fmt.Errorf("must specify explicit interfaceType for cloud provider %q", cluster.CloudProvider)
+	switch logging.Format(conf.LogFormat) {
+	case "":
+	case logging.TextFormat, logging.JSONFormat:
+		logging.SetLogFormat(conf.LogFormat)
+	default:
+		logging.Errorf("unsupported log_format %q", conf.LogFormat)
+		return fmt.Errorf("unsupported log_format %q", conf.LogFormat)
+	}
+	if conf.Events != nil {
+		if _, err := eventInterval(conf.Events); err != nil {
+			logging.Errorf("invalid events interval: %v", err)
+			return fmt.Errorf("invalid events interval: %v", err)
 		}
 	}
+	if err := fillInterfaceDefaults(conf, cluster.CloudProvider); err != nil {
+		logging.Errorf("%v", err)
+		return err
+	}
 
 	switch conf.InterfaceType {
-	case "macvlan":
+	case "macvlan", "ipvlan":
+		if problems := interfaceProblems(conf); len(problems) > 0 {
+			logging.Errorf("%s", problems[0].Message)
+			return errors.New(problems[0].Message)
+		}
 		if conf.InterfaceArgs["master"] == "" {
-			defaultRouteInterface, err := getDefaultRouteInterfaceName()
+			defaultRouteInterface, err := getDefaultRouteInterfaceName("")
 			if err != nil {
 				logging.Errorf("unable to get default route interface name: %v", err)
 				return fmt.Errorf("unable to get default route interface name: %v", err)
 			}
-			if conf.InterfaceArgs == nil {
-				conf.InterfaceArgs = make(map[string]string)
-			}
 			conf.InterfaceArgs["master"] = defaultRouteInterface
 		}
-		if conf.InterfaceArgs["mode"] == "" {
-			conf.InterfaceArgs["mode"] = "bridge"
-		}
 		if conf.InterfaceArgs["mtu"] == "" {
 			mtu, err := getMTUByName(conf.InterfaceArgs["master"])
 			if err != nil {
@@ -203,163 +232,668 @@ func fillNetConfDefaults(conf *types.NetConf, cluster *types.ClusterConf) error
 		}
 	}
 
+	switch conf.Mode {
+	case "", types.ModeRedirect, types.ModeDNSProxy:
+	case types.ModeHTTPProxy:
+		if err := fillHTTPProxyDefaults(conf); err != nil {
+			logging.Errorf("invalid httpProxy: %v", err)
+			return fmt.Errorf("invalid httpProxy: %v", err)
+		}
+	default:
+		logging.Errorf("unsupported mode %q", conf.Mode)
+		return fmt.Errorf("unsupported mode %q", conf.Mode)
+	}
+
+	if _, err := parseFilter(conf.Filter); err != nil {
+		logging.Errorf("invalid filter: %v", err)
+		return fmt.Errorf("invalid filter: %v", err)
+	}
+
+	if conf.PolicyRouting != nil {
+		if err := fillPolicyRoutingDefaults(conf.PolicyRouting); err != nil {
+			logging.Errorf("invalid policyRouting: %v", err)
+			return fmt.Errorf("invalid policyRouting: %v", err)
+		}
+	}
+
+	if conf.GatewayProbe != nil {
+		if err := fillGatewayProbeDefaults(conf.GatewayProbe); err != nil {
+			logging.Errorf("invalid gatewayProbe: %v", err)
+			return fmt.Errorf("invalid gatewayProbe: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// fillInterfaceDefaults sets the interface type and mode of conf that are not
+// configured: a macvlan interface in bridge mode, or an ipvlan interface in l2
+// mode. The interface type must be configured on cloud platforms, which are
+// detected by their cloudProvider.
+func fillInterfaceDefaults(conf *types.NetConf, cloudProvider string) error {
+	if conf.InterfaceType == "" {
+		if cloudProvider != "" {
+			return fmt.Errorf("must specify explicit interfaceType for cloud provider %q", cloudProvider)
+		}
+		conf.InterfaceType = "macvlan"
+	}
+	defaultModes := map[string]string{"macvlan": "bridge", "ipvlan": "l2"}
+	if mode, ok := defaultModes[conf.InterfaceType]; ok && conf.InterfaceArgs["mode"] == "" {
+		if conf.InterfaceArgs == nil {
+			conf.InterfaceArgs = make(map[string]string)
+		}
+		conf.InterfaceArgs["mode"] = mode
+	}
 	return nil
 }
 
+// interfaceProblems checks the interface type of conf, and the mode and MTU of
+// its interfaceArgs if they are set. The master interface is node specific and
+// is only checked when the interface is created.
+func interfaceProblems(conf *types.NetConf) []Problem {
+	var parseMode func(string) error
+	switch conf.InterfaceType {
+	case "macvlan":
+		parseMode = func(s string) error {
+			_, err := modeFromString(s)
+			return err
+		}
+	case "ipvlan":
+		parseMode = func(s string) error {
+			_, err := ipvlanModeFromString(s)
+			return err
+		}
+	default:
+		return []Problem{{Pointer: "/interfaceType", Message: fmt.Sprintf("unsupported interfaceType %q", conf.InterfaceType)}}
+	}
+
+	var problems []Problem
+	if mode := conf.InterfaceArgs["mode"]; mode != "" {
+		if err := parseMode(mode); err != nil {
+			problems = append(problems, Problem{Pointer: "/interfaceArgs/mode", Message: err.Error()})
+		}
+	}
+	if mtu := conf.InterfaceArgs["mtu"]; mtu != "" {
+		if value, err := strconv.Atoi(mtu); err != nil || value <= 0 {
+			problems = append(problems, Problem{Pointer: "/interfaceArgs/mtu", Message: fmt.Sprintf("MTU %q is not a positive integer", mtu)})
+		}
+	}
+	return problems
+}
+
 func loadIPConfig(ipc *types.IPConfig, podNamespace string) (*types.IP, map[string]types.IP, error) {
+	data, err := IPConfigMapData(ipc, podNamespace)
+	if err != nil {
+		return nil, nil, cniError(cnitypes.ErrTryAgainLater, "%v", err)
+	}
+	return parseIPConfigMap(ipc, data)
+}
+
+// IPConfigMapData reads the data of the ipConfig ConfigMap ipc from the API
+// server. The ConfigMap is looked up in podNamespace unless ipc sets a namespace,
+// which is then filled in.
+func IPConfigMapData(ipc *types.IPConfig, podNamespace string) (map[string]string, error) {
 	if ipc.Namespace == "" {
 		ipc.Namespace = podNamespace
 	}
 
-	config, err := rest.InClusterConfig()
+	clientset, err := kubeClient()
 	if err != nil {
-		logging.Errorf("failed to get in-cluster config")
-		return nil, nil, fmt.Errorf("failed to get in-cluster config")
+		return nil, err
 	}
-	clientset, err := kubernetes.NewForConfig(config)
+
+	cm, err := clientset.CoreV1().ConfigMaps(ipc.Namespace).Get(context.TODO(), ipc.Name, metav1.GetOptions{})
 	if err != nil {
-		logging.Errorf("failed to get Kubernetes clientset")
-		return nil, nil, fmt.Errorf("failed to get Kubernetes clientset")
+		return nil, fmt.Errorf("failed to get ConfigMap on namespace %s with name %s: %v", ipc.Namespace, ipc.Name, err)
 	}
+	return cm.Data, nil
+}
 
-	cm, err := clientset.CoreV1().ConfigMaps(ipc.Namespace).Get(context.TODO(), ipc.Name, metav1.GetOptions{})
+// kubeClient returns a clientset for the API server of the cluster.
+func kubeClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get in-cluster config: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		logging.Errorf("failed to get ConfigMap on namespace %s with name %s", ipc.Namespace, ipc.Name)
-		return nil, nil, fmt.Errorf("failed to get ConfigMap on namespace %s with name %s", ipc.Namespace, ipc.Name)
+		return nil, fmt.Errorf("failed to get Kubernetes clientset: %v", err)
 	}
+	return clientset, nil
+}
 
-	if cm.Data["ip"] != "" {
-		if cm.Data["podIP"] != "" {
-			logging.Errorf("ConfigMap %s/%s contains both 'ip' and 'podIP'", ipc.Namespace, ipc.Name)
-			return nil, nil, fmt.Errorf("ConfigMap %s/%s contains both 'ip' and 'podIP'", ipc.Namespace, ipc.Name)
+// parseIPConfigMap decodes the 'ip' or 'podIP' key of the data of an ipConfig ConfigMap.
+func parseIPConfigMap(ipc *types.IPConfig, data map[string]string) (*types.IP, map[string]types.IP, error) {
+	if data["ip"] != "" {
+		if data["podIP"] != "" {
+			return nil, nil, cniError(cnitypes.ErrInvalidNetworkConfig, "ConfigMap %s/%s contains both 'ip' and 'podIP'", ipc.Namespace, ipc.Name)
 		}
 		ip := &types.IP{}
-		if err := json.Unmarshal([]byte(cm.Data["ip"]), ip); err != nil {
-			logging.Errorf("failed to parse 'ip' in ConfigMap %s/%s: %v", ipc.Namespace, ipc.Name, err)
-			return nil, nil, fmt.Errorf("failed to parse 'ip' in ConfigMap %s/%s: %v", ipc.Namespace, ipc.Name, err)
+		if err := json.Unmarshal([]byte(data["ip"]), ip); err != nil {
+			return nil, nil, cniError(cnitypes.ErrInvalidNetworkConfig, "failed to parse 'ip' in ConfigMap %s/%s: %v", ipc.Namespace, ipc.Name, err)
 		}
 		return ip, nil, nil
-	} else if cm.Data["podIP"] != "" {
+	} else if data["podIP"] != "" {
 		podIP := map[string]types.IP{}
-		if err := json.Unmarshal([]byte(cm.Data["podIP"]), &podIP); err != nil {
-			logging.Errorf("failed to parse 'podIP' in ConfigMap %s/%s: %v", ipc.Namespace, ipc.Name, err)
-			return nil, nil, fmt.Errorf("failed to parse 'podIP' in ConfigMap %s/%s: %v", ipc.Namespace, ipc.Name, err)
+		if err := json.Unmarshal([]byte(data["podIP"]), &podIP); err != nil {
+			return nil, nil, cniError(cnitypes.ErrInvalidNetworkConfig, "failed to parse 'podIP' in ConfigMap %s/%s: %v", ipc.Namespace, ipc.Name, err)
 		}
 		return nil, podIP, nil
 	} else {
-		return nil, nil, fmt.Errorf("ConfigMap %s/%s contains neither 'ip' nor 'podIP'", ipc.Namespace, ipc.Name)
+		return nil, nil, cniError(cnitypes.ErrInvalidNetworkConfig, "ConfigMap %s/%s contains neither 'ip' nor 'podIP'", ipc.Namespace, ipc.Name)
 	}
 }
 
-func macvlanCmdDel(args *skel.CmdArgs) error {
-	if args.Netns == "" {
-		return nil
-	}
+func macvlanCmdDel(args *skel.CmdArgs) (err error) {
 	logging.Debugf("Called CNI DEL")
 
-	// There is a netns so try to clean up. Delete can be called multiple times
-	// so don't return an error if the device is already removed.
-	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		if err := ip.DelLinkByName(args.IfName); err != nil {
-			if err != ip.ErrLinkNotFound {
-				logging.Errorf("CNI DEL failed, link not found: %s", err)
+	// DEL must succeed with a partial configuration, so the Events setting is
+	// read on its own
+	n := &types.NetConf{}
+	if json.Unmarshal(args.StdinData, n) == nil {
+		defer func() {
+			if err != nil {
+				postEvent(n, args, corev1.EventTypeWarning, eventReasonTeardownFailed, err.Error())
+			} else {
+				annotateStatus(n, args, nil)
+				postEvent(n, args, corev1.EventTypeNormal, eventReasonRemoved, fmt.Sprintf("Removed egress interface %s", args.IfName))
+			}
+		}()
+	}
+
+	// A failed ADD may have stopped anywhere, so every step below tolerates the
+	// corresponding state being missing.
+	if err := execIPAMDel(args.StdinData); err != nil {
+		return err
+	}
+
+	state, err := loadState(args.ContainerID, args.IfName)
+	if err != nil {
+		logging.Errorf("ignoring unreadable state for %s/%s: %v", args.ContainerID, args.IfName, err)
+		state = nil
+	}
+
+	if args.Netns != "" {
+		// There is a netns so try to clean up. Delete can be called multiple times
+		// so don't return an error if the device or the netns is already removed.
+		err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			if err := ip.DelLinkByName(args.IfName); err != nil {
+				if err != ip.ErrLinkNotFound {
+					return cniError(ioErrorCode(err), "CNI DEL failed to delete link %q: %v", args.IfName, err)
+				}
+				logging.Debugf("Link %q already removed", args.IfName)
+			}
+
+			if err := deleteEgressNFTables(); err != nil {
 				return err
 			}
-			logging.Debugf("CNI DEL called")
+
+			if state != nil {
+				if err := restoreState(state); err != nil {
+					return cniError(ioErrorCode(err), "%v", err)
+				}
+			}
+			return nil
+		})
+		if _, ok := err.(ns.NSPathNotExistErr); ok {
+			logging.Debugf("netns %q already removed", args.Netns)
+			err = nil
 		}
-		return nil
-	})
+		if err != nil {
+			return err
+		}
+	}
 
-	return err
+	if err := removeState(args.ContainerID, args.IfName); err != nil {
+		return cniError(cnitypes.ErrIOFailure, "failed to remove state for %s/%s: %v", args.ContainerID, args.IfName, err)
+	}
+	return nil
 }
 
-// validatePortRange validates the destination port value provided in the NAD.
-// Accepts an argument of type string and returns error if the provided port value is invalid.
-func validatePortRange(port string) error {
-	dport, err := strconv.Atoi(port)
-	if err != nil {
-		return err
-	}
-	if dport < 0 || dport > 65535 {
-		return fmt.Errorf("Port number out of range %v", port)
+// deleteEgressNFTables removes the egress_cni table from the current network
+// namespace, including the per-family ip and ip6 tables created by older releases.
+// Missing tables are not an error.
+func deleteEgressNFTables() error {
+	for _, family := range []knftables.Family{egressTableFamily, knftables.IPv4Family, knftables.IPv6Family} {
+		nft, err := knftables.New(family, egressTableName)
+		if err != nil {
+			return cniError(cnitypes.ErrIOFailure, "failed to get NFTables: %v", err)
+		}
+		tx := nft.NewTransaction()
+		// Adding the table first makes the delete succeed if it does not exist
+		tx.Add(&knftables.Table{})
+		tx.Delete(&knftables.Table{})
+		if err := nft.Run(context.Background(), tx); err != nil {
+			return cniError(cnitypes.ErrIOFailure, "failed to delete %s nftables table %q: %v", family, egressTableName, err)
+		}
+		logging.Debugf("Deleted %s nftables table %q", family, egressTableName)
 	}
 	return nil
 }
 
-// generateDNATNFTablesRules creates the necessary NFTables rules to DNAT packets to remote destination.
-// Accepts an array of strings repsenting allowedDestinations to which the router can talk to.
-// Returns an error if invalid user input is detected at any point.
-func generateDNATNFTablesRules(tx *knftables.Transaction, allowedDestinations []string) error {
+// generateDNATNFTablesRules redirects the traffic received on clusterIfName to
+// allowedDestinations. Destinations with a local port are elements of a DNAT map
+// per IP family, keyed on the protocol and local port, so that a single rule per
+// family serves all of them. Destinations without a local port redirect all
+// other traffic, and get a rule each.
+func generateDNATNFTablesRules(tx *knftables.Transaction, clusterIfName string, allowedDestinations []destination) {
 	if len(allowedDestinations) == 0 {
 		logging.Debugf("No destination information has been provided")
-		return nil
+		return
 	}
 
-	for _, allowedDestination := range allowedDestinations {
-		destination := strings.Split(allowedDestination, " ")
-		var rule string
-
-		if len(destination) == 1 {
-			// should be <IPaddress> format
-			dest := net.ParseIP(destination[0]).String()
-			rule = fmt.Sprintf("iif eth0 dnat to %s", dest)
-		} else if len(destination) == 3 || len(destination) == 4 {
-			// should be <localport protocol IPaddress [remoteport]> format
-
-			if err := validatePortRange(destination[0]); err != nil {
-				logging.Errorf("Incorrect port number provided %v: %v", destination[0], err)
-				return fmt.Errorf("Incorrect port number provided %v: %v", destination[0], err)
+	for _, isIPv6 := range []bool{false, true} {
+		var elements []*knftables.Element
+		name := dnatMapName(isIPv6)
+		for _, d := range allowedDestinations {
+			if d.localPort == 0 || (d.target.To4() == nil) != isIPv6 {
+				continue
 			}
-
-			proto := strings.ToLower(destination[1])
-			if !(proto == "tcp" || proto == "udp" || proto == "sctp") {
-				logging.Errorf("Incorrect protocol provided %v", proto)
-				return fmt.Errorf("Incorrect protocol number provided %v", proto)
-			}
-
-			dest := net.ParseIP(destination[2]).String()
-
-			if len(destination) == 4 {
-				if err := validatePortRange(destination[3]); err != nil {
-					logging.Errorf("Incorrect port number provided %v: %v", destination[3], err)
-					return fmt.Errorf("Incorrect port number provided %v: %v", destination[3], err)
-				}
-				dest += ":" + destination[3]
+			targetPort := d.targetPort
+			if targetPort == 0 {
+				targetPort = d.localPort
 			}
+			elements = append(elements, &knftables.Element{
+				Map:     name,
+				Key:     []string{d.protocol, strconv.Itoa(d.localPort)},
+				Value:   []string{d.target.String(), strconv.Itoa(targetPort)},
+				Comment: knftables.PtrTo(d.entry),
+			})
+		}
+		if len(elements) == 0 {
+			continue
+		}
 
-			rule = fmt.Sprintf("iif eth0 %s dport %s dnat to %s", proto, destination[0], dest)
-		} else {
-			logging.Errorf("Invalid destination provided %v", allowedDestination)
-			return fmt.Errorf("Invalid destination provided %v", allowedDestination)
+		tx.Add(&knftables.Map{
+			Name: name,
+			Type: knftables.Concat("inet_proto . inet_service :", nftAddrType(isIPv6), ". inet_service"),
+		})
+		for _, e := range elements {
+			tx.Add(e)
 		}
+		rule := knftables.Concat(
+			"iif", clusterIfName, "meta nfproto", nftNFProto(isIPv6),
+			"dnat", nftFamily(isIPv6), "addr . port to meta l4proto . th dport map", "@", name,
+		)
+		tx.Add(&knftables.Rule{
+			Chain:   "prerouting",
+			Rule:    rule,
+			Comment: knftables.PtrTo(name),
+		})
+		logging.Debugf("Added nftables rule: %s with %d destinations", rule, len(elements))
+	}
 
+	for _, d := range allowedDestinations {
+		if d.localPort != 0 {
+			continue
+		}
+		rule := fmt.Sprintf("iif %s dnat %s to %s", clusterIfName, nftIPFamily(d.target), d.target.String())
 		tx.Add(&knftables.Rule{
-			Chain: "prerouting",
-			Rule:  rule,
+			Chain:   "prerouting",
+			Rule:    rule,
+			Comment: knftables.PtrTo(d.entry),
 		})
 		logging.Debugf("Added nftables rule: %s", rule)
 	}
+}
+
+// dnatMapName returns the name of the DNAT map of an IP family.
+func dnatMapName(isIPv6 bool) string {
+	return "dnat-" + nftNFProto(isIPv6)
+}
+
+// generateEgressNFTablesRules fills tx with the complete egress_cni table: the NAT
+// base chains, one SNAT rule per egress address for traffic leaving through ifName,
+// the DNAT rules for allowedDestinations, applied to traffic received on
+// clusterIfName, the forward chain of filter, if any, and the count chain whose
+// counters the egress-router-agent exports. Every rule carries a comment so that
+// CHECK can match the live ruleset against the expected one.
+func generateEgressNFTablesRules(tx *knftables.Transaction, clusterIfName, ifName string, snatAddresses []net.IP, allowedDestinations []destination, filter *egressFilter) {
+	tx.Add(&knftables.Table{})
+	tx.Flush(&knftables.Table{})
+	tx.Add(&knftables.Chain{
+		Name: "prerouting",
+
+		Type:     knftables.PtrTo(knftables.NATType),
+		Hook:     knftables.PtrTo(knftables.PreroutingHook),
+		Priority: knftables.PtrTo(knftables.DNATPriority),
+	})
+	tx.Add(&knftables.Chain{
+		Name: "postrouting",
+
+		Type:     knftables.PtrTo(knftables.NATType),
+		Hook:     knftables.PtrTo(knftables.PostroutingHook),
+		Priority: knftables.PtrTo(knftables.SNATPriority),
+	})
+	for _, addr := range snatAddresses {
+		tx.Add(&knftables.Rule{
+			Chain: "postrouting",
+			Rule: knftables.Concat(
+				"oif", ifName, "snat", nftIPFamily(addr), "to", addr.String(),
+			),
+			Comment: knftables.PtrTo("snat " + addr.String()),
+		})
+	}
+
+	generateDNATNFTablesRules(tx, clusterIfName, allowedDestinations)
+	generateFilterNFTablesRules(tx, ifName, filter)
+	generateCountNFTablesRules(tx, snatAddresses, allowedDestinations)
+}
+
+// nftIPFamily returns the nftables address family keyword ("ip" or "ip6") of ip,
+// which NAT statements in an inet table must name explicitly.
+func nftIPFamily(ip net.IP) string {
+	return nftFamily(ip.To4() == nil)
+}
+
+// nftFamily returns the nftables address family keyword of an IP family.
+func nftFamily(isIPv6 bool) string {
+	if isIPv6 {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// nftNFProto returns the "meta nfproto" value of an IP family.
+func nftNFProto(isIPv6 bool) string {
+	if isIPv6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// nftAddrType returns the nftables address data type of an IP family.
+func nftAddrType(isIPv6 bool) string {
+	if isIPv6 {
+		return "ipv6_addr"
+	}
+	return "ipv4_addr"
+}
+
+// ipForwardSysctl returns the name of the forwarding sysctl enabled by ADD for the egress address family.
+func ipForwardSysctl(isIPv6 bool) string {
+	if isIPv6 {
+		return "net.ipv6.conf.all.forwarding"
+	}
+	return "net.ipv4.ip_forward"
+}
+
+// netlinkFamily returns the netlink address family for the egress address family.
+func netlinkFamily(isIPv6 bool) int {
+	if isIPv6 {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+// ipFamilyName returns the human readable name of the egress address family.
+func ipFamilyName(isIPv6 bool) string {
+	if isIPv6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// egressFamily is the egress configuration of one IP family: the address used as
+// SNAT source and the gateway of the default route via the egress interface.
+type egressFamily struct {
+	isIPv6  bool
+	address net.IP
+	gateway net.IP
+}
+
+// parseGateways returns the gateways configured in the "ip" section, keyed by
+// whether they are IPv6.
+func parseGateways(conf *types.IP) (map[bool]net.IP, error) {
+	gateways := map[bool]net.IP{}
+	if conf == nil {
+		return gateways, nil
+	}
+	all := conf.Gateways
+	if conf.Gateway != "" {
+		all = append([]string{conf.Gateway}, conf.Gateways...)
+	}
+	for _, g := range all {
+		if err := addGateway(gateways, g); err != nil {
+			return nil, cniError(cnitypes.ErrInvalidNetworkConfig, "%v", err)
+		}
+	}
+	return gateways, nil
+}
 
+// addGateway parses the gateway g and adds it to gateways, which holds at most
+// one gateway per IP family.
+func addGateway(gateways map[bool]net.IP, g string) error {
+	gw := net.ParseIP(g)
+	if gw == nil {
+		return fmt.Errorf("invalid gateway %q", g)
+	}
+	isIPv6 := gw.To4() == nil
+	if _, ok := gateways[isIPv6]; ok {
+		return fmt.Errorf("more than one %s gateway configured", ipFamilyName(isIPv6))
+	}
+	gateways[isIPv6] = gw
 	return nil
 }
 
-func macvlanCmdAdd(args *skel.CmdArgs) error {
+// staticIPConfigs builds the CNI IP configuration for every address of the inline
+// "ip" section, each with the configured gateway of its family.
+func staticIPConfigs(conf *types.IP) ([]*current.IPConfig, error) {
+	gateways, err := parseGateways(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var ipcs []*current.IPConfig
+	for _, address := range conf.Addresses {
+		ipc, err := staticIPConfig(address, gateways)
+		if err != nil {
+			return nil, cniError(cnitypes.ErrInvalidNetworkConfig, "%v", err)
+		}
+		ipcs = append(ipcs, ipc)
+	}
+	return ipcs, nil
+}
+
+// staticIPConfig builds the CNI IP configuration of address, with the gateway of
+// its family in gateways.
+func staticIPConfig(address string, gateways map[bool]net.IP) (*current.IPConfig, error) {
+	egressIP, ipnet, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	isIPv6 := isIPv6CIDR(ipnet)
+	gw, ok := gateways[isIPv6]
+	if !ok {
+		return nil, fmt.Errorf("no %s gateway configured for address %q", ipFamilyName(isIPv6), address)
+	}
+
+	// Assume L2 interface only
+	ipc := &current.IPConfig{
+		Version: "4",
+		Address: net.IPNet{IP: egressIP, Mask: ipnet.Mask},
+		Gateway: gw,
+	}
+	if isIPv6 {
+		ipc.Version = "6"
+	}
+	return ipc, nil
+}
+
+// parseAddress parses an address of the "ip" section, in CIDR notation.
+func parseAddress(address string) (net.IP, *net.IPNet, error) {
+	ip, ipnet, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse IP address %q: %v", address, err)
+	}
+	return ip, ipnet, nil
+}
+
+// egressFamilies returns the egress configuration of every IP family present in
+// ips. The first address of each family is its SNAT source. Gateways configured in
+// the "ip" section win over the ones in ips, which may come from IPAM.
+func egressFamilies(ips []*current.IPConfig, conf *types.IP) ([]egressFamily, error) {
+	gateways, err := parseGateways(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var families []egressFamily
+	for _, ipc := range firstOfEachFamily(ips) {
+		isIPv6 := ipc.Address.IP.To4() == nil
+		gw := ipc.Gateway
+		if configured, ok := gateways[isIPv6]; ok {
+			gw = configured
+		}
+		if gw == nil {
+			return nil, cniError(cnitypes.ErrInvalidNetworkConfig, "no %s gateway configured for %s", ipFamilyName(isIPv6), ipc.Address.IP)
+		}
+		families = append(families, egressFamily{isIPv6: isIPv6, address: ipc.Address.IP, gateway: gw})
+	}
+	return families, nil
+}
+
+// firstOfEachFamily returns the first address of each IP family in ips, in
+// order: the SNAT sources of the egress families.
+func firstOfEachFamily(ips []*current.IPConfig) []*current.IPConfig {
+	var first []*current.IPConfig
+	seen := map[bool]bool{}
+	for _, ipc := range ips {
+		isIPv6 := ipc.Address.IP.To4() == nil
+		if !seen[isIPv6] {
+			seen[isIPv6] = true
+			first = append(first, ipc)
+		}
+	}
+	return first
+}
+
+// snatAddresses returns the SNAT source address of every egress family.
+func snatAddresses(families []egressFamily) []net.IP {
+	addresses := make([]net.IP, 0, len(families))
+	for _, f := range families {
+		addresses = append(addresses, f.address)
+	}
+	return addresses
+}
+
+// destinations parses the destinations configured in the "ip" section, if any.
+func destinations(n *types.NetConf) ([]destination, error) {
+	if n.IP == nil || len(n.IP.Destinations) == 0 {
+		return nil, nil
+	}
+	switch n.Mode {
+	case "", types.ModeRedirect:
+		return parseDestinations(n.IP.Destinations)
+	case types.ModeDNSProxy:
+		// The destinations are forwarded by egress-router-dns-proxy, not by DNAT rules
+		_, err := dnsproxy.ParseDestinations(n.IP.Destinations)
+		return nil, err
+	default:
+		return nil, fmt.Errorf("destinations are not supported in %s mode", n.Mode)
+	}
+}
+
+// fillHTTPProxyDefaults sets the default port of the HTTP proxy and validates its allowlist.
+func fillHTTPProxyDefaults(conf *types.NetConf) error {
+	if conf.HTTPProxy == nil || len(conf.HTTPProxy.Allowlist) == 0 {
+		return fmt.Errorf("%s mode requires an allowlist", types.ModeHTTPProxy)
+	}
+	if _, err := httpproxy.ParseAllowlist(conf.HTTPProxy.Allowlist); err != nil {
+		return err
+	}
+	if conf.HTTPProxy.Port == 0 {
+		conf.HTTPProxy.Port = httpproxy.DefaultPort
+	}
+	return validatePort(conf.HTTPProxy.Port)
+}
+
+// clusterInterfaceName returns the cluster-facing interface of the pod: the
+// configured clusterInterface, else the container interface reported by the
+// previous plugin of the chain, else the interface of the default route. It must
+// be called inside the container network namespace.
+func clusterInterfaceName(n *types.NetConf, prevResult *current.Result, ifName string) (string, error) {
+	if n.ClusterInterface != "" {
+		return n.ClusterInterface, nil
+	}
+	if prevResult != nil {
+		for _, iface := range prevResult.Interfaces {
+			if iface.Sandbox != "" && iface.Name != ifName {
+				logging.Debugf("Using cluster interface %q from prevResult", iface.Name)
+				return iface.Name, nil
+			}
+		}
+	}
+	name, err := getDefaultRouteInterfaceName(ifName)
+	if err != nil {
+		return "", cniError(cnitypes.ErrInvalidNetworkConfig, "unable to discover the cluster interface, set clusterInterface: %v", err)
+	}
+	logging.Debugf("Using cluster interface %q from the default route", name)
+	return name, nil
+}
+
+func macvlanCmdAdd(args *skel.CmdArgs) (err error) {
 	n, err := loadNetConf(&types.ClusterConf{}, args.StdinData)
 	logging.Debugf("Called CNI ADD")
 	if err != nil {
 		return err
 	}
-	logging.Debugf("Gateway: %s", n.IP.Gateway)
-	logging.Debugf("IP Source Addresses: %s", n.IP.Addresses)
-	logging.Debugf("IP Destinations: %v", n.IP.Destinations)
+	var configured string
+	defer func() {
+		if err != nil {
+			postEvent(n, args, corev1.EventTypeWarning, eventReasonSetupFailed, err.Error())
+		} else {
+			postEvent(n, args, corev1.EventTypeNormal, eventReasonConfigured, configured)
+		}
+	}()
+	if err := resolveIP(n, args.Args); err != nil {
+		return err
+	}
+	useIPAM := n.IPAM.Type != ""
+	if n.IP != nil {
+		logging.Debugf("Gateway: %s", n.IP.Gateway)
+		logging.Debugf("IP Source Addresses: %s", n.IP.Addresses)
+		logging.Debugf("IP Destinations: %v", n.IP.Destinations)
+	}
+	if useIPAM {
+		logging.Debugf("IPAM: %s", n.IPAM.Type)
+	}
+
+	// Validate the configuration before touching the container network namespace
+	var staticIPCs []*current.IPConfig
+	if !useIPAM {
+		if staticIPCs, err = staticIPConfigs(n.IP); err != nil {
+			return err
+		}
+	}
+	allowedDestinations, err := destinations(n)
+	if err != nil {
+		return cniError(cnitypes.ErrInvalidNetworkConfig, "%v", err)
+	}
+	filter, err := parseFilter(n.Filter)
+	if err != nil {
+		return cniError(cnitypes.ErrInvalidNetworkConfig, "invalid filter: %v", err)
+	}
+
+	// The result of the previous plugin of the chain, if any, names the
+	// cluster-facing interface
+	var prevResult *current.Result
+	if n.RawPrevResult != nil {
+		if err := version.ParsePrevResult(&n.NetConf); err != nil {
+			return cniError(cnitypes.ErrDecodingFailure, "failed to parse prevResult: %v", err)
+		}
+		if prevResult, err = current.NewResultFromResult(n.PrevResult); err != nil {
+			return cniError(cnitypes.ErrDecodingFailure, "failed to convert prevResult: %v", err)
+		}
+	}
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", netns, err)
+		return cniError(cnitypes.ErrUnknownContainer, "failed to open netns %q: %v", args.Netns, err)
 	}
 	defer netns.Close()
 
-	macvlanInterface, err := createMacvlan(n, args.IfName, netns)
+	macvlanInterface, err := createInterface(n, args.IfName, netns)
 	if err != nil {
 		return err
 	}
@@ -373,30 +907,23 @@ func macvlanCmdAdd(args *skel.CmdArgs) error {
 		}
 	}()
 
-	ip, ipnet, err := net.ParseCIDR(n.IP.Addresses[0])
-	if err != nil {
-		logging.Errorf("unable to parse IP address %q: %v", n.IP.Addresses[0], err)
-		return fmt.Errorf("unable to parse IP address %q: %v", n.IP.Addresses[0], err)
-	}
-	gw := net.ParseIP(n.IP.Gateway)
-	allowedDestinations := n.IP.Destinations
-
-	isIPv6 := isIPv6CIDR(ipnet)
-
-	// Assume L2 interface only
 	result := &current.Result{CNIVersion: n.CNIVersion, Interfaces: []*current.Interface{macvlanInterface}}
-	if isIPv6 {
-		result.IPs = append(result.IPs, &current.IPConfig{
-			Version: "6",
-			Address: net.IPNet{IP: ip, Mask: ipnet.Mask},
-			Gateway: gw,
-		})
+	if useIPAM {
+		var ipamResult *current.Result
+		if ipamResult, err = execIPAMAdd(n, args.StdinData); err != nil {
+			return err
+		}
+		// Release the IPAM allocation if anything below fails
+		defer func() {
+			if err != nil {
+				ipam.ExecDel(n.IPAM.Type, args.StdinData)
+			}
+		}()
+		result.IPs = ipamResult.IPs
+		result.Routes = ipamResult.Routes
+		result.DNS = ipamResult.DNS
 	} else {
-		result.IPs = append(result.IPs, &current.IPConfig{
-			Version: "4",
-			Address: net.IPNet{IP: ip, Mask: ipnet.Mask},
-			Gateway: gw,
-		})
+		result.IPs = staticIPCs
 	}
 
 	for _, ipc := range result.IPs {
@@ -404,151 +931,119 @@ func macvlanCmdAdd(args *skel.CmdArgs) error {
 		ipc.Interface = current.Int(0)
 	}
 
+	families, err := egressFamilies(result.IPs, n.IP)
+	if err != nil {
+		return err
+	}
+
+	var ruleset string
+	var probeWarnings []string
 	err = netns.Do(func(_ ns.NetNS) error {
 		// Configure interfaces IPAM
 		if err := configureIface(args.IfName, result); err != nil {
-			return err
+			return asCNIError(cnitypes.ErrIOFailure, err)
 		}
 
 		// Get macvlan interface
 		macvlanLink, err := netlink.LinkByName(args.IfName)
 		if err != nil {
-			logging.Errorf("could not get interface: %v", err)
-			return fmt.Errorf("could not get interface: %v", err)
-		}
-
-		// Add route to gateway on macvlan interface
-		var destIpNet net.IPNet
-		if isIPv6 {
-			destIpNet = net.IPNet{
-				IP:   gw,
-				Mask: net.CIDRMask(128, 128),
-			}
-			logging.Debugf("Adding IPv6 route to gateway %s on macvlan interface", gw)
-		} else {
-			destIpNet = net.IPNet{
-				IP:   gw,
-				Mask: net.CIDRMask(32, 32),
-			}
-			logging.Debugf("Adding IPv4 route to gateway %s on macvlan interface", gw)
-		}
-		newGatewayRoute := netlink.Route{
-			LinkIndex: macvlanLink.Attrs().Index,
-			Dst:       &destIpNet,
-		}
-
-		if err := netlink.RouteAdd(&newGatewayRoute); err != nil {
-			logging.Errorf("failed to add new gateway default route : %v", err)
-			return fmt.Errorf("failed to add new gateway default route : %v", err)
+			return cniError(ioErrorCode(err), "could not get interface: %v", err)
 		}
 
-		// Get default interface
-		existingLink, err := netlink.LinkByName("eth0")
+		// Get the cluster-facing interface
+		clusterIfName, err := clusterInterfaceName(n, prevResult, args.IfName)
 		if err != nil {
-			logging.Errorf("couldn't get interface eth0: %v", err)
-			return fmt.Errorf("couldn't get interface eth0: %v", err)
-		}
-
-		// Enable IP forwarding
-		ipFamily := "ipv4"
-		if isIPv6 {
-			ipFamily = "ipv6"
+			return err
 		}
-		_, err = sysctl.Sysctl(fmt.Sprintf("net.%s.ip_forward", ipFamily), "1")
+		existingLink, err := netlink.LinkByName(clusterIfName)
 		if err != nil {
-			logging.Errorf("failed to enable %s forwarding: %v", ipFamily, err)
-			return fmt.Errorf("failed to enable %s forwarding: %v", ipFamily, err)
-		}
-
-		// Delete default route
-		var routes []netlink.Route
-		if isIPv6 {
-			routes, _ = netlink.RouteList(existingLink, netlink.FAMILY_V6)
-		} else {
-			routes, _ = netlink.RouteList(existingLink, netlink.FAMILY_V4)
+			return cniError(ioErrorCode(err), "couldn't get cluster interface %q: %v", clusterIfName, err)
 		}
 
-		for _, r := range routes {
-			if r.Dst == nil {
-				if err := netlink.RouteDel(&r); err != nil {
-					logging.Errorf("failed to delete existing default route : %v", err)
-					return fmt.Errorf("failed to delete existing default route : %v", err)
+		// Record the forwarding sysctls and default routes before changing them so
+		// that DEL can restore them
+		state := &egressState{ClusterInterface: clusterIfName, Sysctls: map[string]string{}}
+		existingDefaultRoutes := map[bool][]netlink.Route{}
+		for _, f := range families {
+			routes, _ := netlink.RouteList(existingLink, netlinkFamily(f.isIPv6))
+			for _, r := range routes {
+				if r.Dst != nil {
+					continue
+				}
+				existingDefaultRoutes[f.isIPv6] = append(existingDefaultRoutes[f.isIPv6], r)
+				if r.Gw != nil && n.PolicyRouting == nil {
+					state.DefaultRoutes = append(state.DefaultRoutes, savedRoute{
+						Interface: existingLink.Attrs().Name,
+						Gateway:   r.Gw.String(),
+						Priority:  r.Priority,
+						Table:     r.Table,
+					})
 				}
-				logging.Debugf("deleted default route %v", r)
+			}
+			if value, err := sysctl.Sysctl(ipForwardSysctl(f.isIPv6)); err == nil {
+				state.Sysctls[ipForwardSysctl(f.isIPv6)] = value
 			}
 		}
-
-		// Create new default route
-		newDefaultRoute := netlink.Route{
-			LinkIndex: macvlanLink.Attrs().Index,
-			Dst:       nil,
-			Gw:        gw,
+		if n.PolicyRouting != nil {
+			state.PolicyTable = n.PolicyRouting.Table
+		}
+		if err := saveState(args.ContainerID, args.IfName, state); err != nil {
+			return cniError(cnitypes.ErrIOFailure, "failed to save state for %s/%s: %v", args.ContainerID, args.IfName, err)
 		}
 
-		if err := netlink.RouteAdd(&newDefaultRoute); err != nil {
-			// Check if we already have route installed
-			if !os.IsExist(err) {
-				logging.Errorf("failed to add new default route, gw %v : %v", gw, err)
-				return fmt.Errorf("failed to add new default route, gw %v : %v", gw, err)
+		for _, f := range families {
+			if n.PolicyRouting != nil {
+				var clusterGateway net.IP
+				if routes := existingDefaultRoutes[f.isIPv6]; len(routes) > 0 {
+					clusterGateway = routes[0].Gw
+				}
+				if err := setupPolicyRouting(n.PolicyRouting, macvlanLink, existingLink, f, clusterGateway); err != nil {
+					return err
+				}
+			} else if err := setupEgressRoutes(macvlanLink, f, existingDefaultRoutes[f.isIPv6]); err != nil {
+				return err
 			}
-			logging.Debugf("Use existing route with gateway %v", gw)
-		} else {
-			logging.Debugf("Added new default route with gateway %v", gw)
 		}
+
 		contVeth, err := net.InterfaceByName(args.IfName)
 		if err != nil {
-			return fmt.Errorf("failed to look up %q: %v", args.IfName, err)
+			return cniError(cnitypes.ErrIOFailure, "failed to look up %q: %v", args.IfName, err)
 		}
 
 		for _, ipc := range result.IPs {
-			if ipc.Version == "4" || ipc.Version == "6" {
+			if ipc.Version == "4" {
 				_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
 			}
 		}
 
-		var nft knftables.Interface
-		if isIPv6 {
-			nft, err = knftables.New(knftables.IPv6Family, "egress_cni")
-		} else {
-			nft, err = knftables.New(knftables.IPv4Family, "egress_cni")
+		if probeWarnings, err = probeGateways(n.GatewayProbe, macvlanLink, families); err != nil {
+			return err
 		}
+
+		nft, err := knftables.New(egressTableFamily, egressTableName)
 		if err != nil {
-			logging.Errorf("failed to get NFTables: %v", err)
-			return fmt.Errorf("failed to get NFTables: %v", err)
+			return cniError(cnitypes.ErrIOFailure, "failed to get NFTables: %v", err)
 		}
 
-		tx := nft.NewTransaction()
-		tx.Add(&knftables.Table{})
-		tx.Flush(&knftables.Table{})
-		tx.Add(&knftables.Chain{
-			Name: "prerouting",
-
-			Type:     knftables.PtrTo(knftables.NATType),
-			Hook:     knftables.PtrTo(knftables.PreroutingHook),
-			Priority: knftables.PtrTo(knftables.DNATPriority),
-		})
-		tx.Add(&knftables.Chain{
-			Name: "postrouting",
+		// On a reused network namespace, connections DNATed by the previous rules
+		// must not keep going to targets that are no longer configured
+		installed, err := installedDestinations(context.Background(), nft)
+		if err != nil {
+			logging.Errorf("not flushing stale conntrack entries: %v", err)
+		}
 
-			Type:     knftables.PtrTo(knftables.NATType),
-			Hook:     knftables.PtrTo(knftables.PostroutingHook),
-			Priority: knftables.PtrTo(knftables.SNATPriority),
-		})
-		tx.Add(&knftables.Rule{
-			Chain: "postrouting",
-			Rule: knftables.Concat(
-				"oif", args.IfName, "snat to", ip.String(),
-			),
-		})
+		tx := nft.NewTransaction()
+		generateEgressNFTablesRules(tx, clusterIfName, args.IfName, snatAddresses(families), allowedDestinations, filter)
+		ruleset = tx.String()
 
-		if err := generateDNATNFTablesRules(tx, allowedDestinations); err != nil {
-			logging.Errorf("Invalid destination %v: %v", allowedDestinations, err)
-			return fmt.Errorf("Invalid destination %v: %v", allowedDestinations, err)
+		if err := nft.Run(context.Background(), tx); err != nil {
+			return cniError(cnitypes.ErrIOFailure, "failed to set nftables rules: %v", err)
 		}
 
-		if err := nft.Run(context.Background(), tx); err != nil {
-			logging.Errorf("Failed to set nftables rules: %v", err)
-			return fmt.Errorf("failed to set nftables rules: %v", err)
+		if stale := staleDestinations(installed, allowedDestinations); len(stale) > 0 {
+			if err := flushConntrack(stale); err != nil {
+				logging.Errorf("%v", err)
+			}
 		}
 		return nil
 	})
@@ -556,8 +1051,78 @@ func macvlanCmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	result.DNS = n.DNS
-	return cnitypes.PrintResult(result, n.CNIVersion)
+	if len(n.DNS.Nameservers) > 0 || !useIPAM {
+		result.DNS = n.DNS
+	}
+	if err := cnitypes.PrintResult(result, n.CNIVersion); err != nil {
+		return cniError(cnitypes.ErrIOFailure, "failed to print result: %v", err)
+	}
+	for _, warning := range probeWarnings {
+		postEvent(n, args, corev1.EventTypeWarning, eventReasonGatewayUnreachable, warning)
+	}
+	annotateStatus(n, args, egressStatus(n, macvlanInterface, result.IPs, families, ruleset))
+	configured = configuredEventMessage(n, args.IfName, result.IPs, families, allowedDestinations)
+	return nil
+}
+
+// setupEgressRoutes makes the egress interface the default route of one IP family:
+// it adds a host route to the gateway, enables forwarding, replaces the existing
+// default routes and installs the default route via the gateway.
+func setupEgressRoutes(link netlink.Link, f egressFamily, existingDefaultRoutes []netlink.Route) error {
+	gw := f.gateway
+	routes := egressRoutes(link, f)
+
+	// Add route to gateway on macvlan interface
+	logging.Debugf("Adding %s route to gateway %s on macvlan interface", ipFamilyName(f.isIPv6), gw)
+	if err := netlink.RouteAdd(&routes[0]); err != nil && !os.IsExist(err) {
+		return cniError(ioErrorCode(err), "failed to add new gateway default route : %v", err)
+	}
+
+	// Enable IP forwarding
+	if _, err := sysctl.Sysctl(ipForwardSysctl(f.isIPv6), "1"); err != nil {
+		return cniError(cnitypes.ErrIOFailure, "failed to enable forwarding (%s): %v", ipForwardSysctl(f.isIPv6), err)
+	}
+
+	// Delete default route
+	for _, r := range existingDefaultRoutes {
+		if err := netlink.RouteDel(&r); err != nil {
+			return cniError(ioErrorCode(err), "failed to delete existing default route : %v", err)
+		}
+		logging.Debugf("deleted default route %v", r)
+	}
+
+	// Create new default route
+	if err := netlink.RouteAdd(&routes[1]); err != nil {
+		// Check if we already have route installed
+		if !os.IsExist(err) {
+			return cniError(ioErrorCode(err), "failed to add new default route, gw %v : %v", gw, err)
+		}
+		logging.Debugf("Use existing route with gateway %v", gw)
+	} else {
+		logging.Debugf("Added new default route with gateway %v", gw)
+	}
+	return nil
+}
+
+// egressRoutes returns the routes of one IP family installed in the main table
+// by setupEgressRoutes: a host route to the gateway and the default route via the
+// gateway, both on link.
+func egressRoutes(link netlink.Link, f egressFamily) []netlink.Route {
+	bits := 32
+	if f.isIPv6 {
+		bits = 128
+	}
+	return []netlink.Route{
+		{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &net.IPNet{IP: f.gateway, Mask: net.CIDRMask(bits, bits)},
+		},
+		{
+			LinkIndex: link.Attrs().Index,
+			Dst:       nil,
+			Gw:        f.gateway,
+		},
+	}
 }
 
 func getMTUByName(ifName string) (int, error) {
@@ -584,29 +1149,49 @@ func modeFromString(s string) (netlink.MacvlanMode, error) {
 	}
 }
 
-func createMacvlan(conf *types.NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
-	macvlan := &current.Interface{}
-
-	mode, err := modeFromString(conf.InterfaceArgs["mode"])
-	if err != nil {
-		return nil, err
+// createInterface creates the egress interface selected by conf.InterfaceType
+// inside netns and names it ifName.
+func createInterface(conf *types.NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
+	switch conf.InterfaceType {
+	case "macvlan":
+		return createMacvlan(conf, ifName, netns)
+	case "ipvlan":
+		return createIpvlan(conf, ifName, netns)
+	default:
+		return nil, cniError(cnitypes.ErrInvalidNetworkConfig, "unsupported interfaceType %q", conf.InterfaceType)
 	}
+}
 
+// lookupMasterAndMTU returns the master link and the MTU configured in conf.InterfaceArgs.
+func lookupMasterAndMTU(conf *types.NetConf) (netlink.Link, int, error) {
 	m, err := netlink.LinkByName(conf.InterfaceArgs["master"])
 	if err != nil {
-		return nil, fmt.Errorf("failed to lookup master %q: %v", conf.InterfaceArgs["master"], err)
+		return nil, 0, cniError(cnitypes.ErrInvalidNetworkConfig, "failed to lookup master %q: %v", conf.InterfaceArgs["master"], err)
 	}
 
 	mtu, err := strconv.Atoi(conf.InterfaceArgs["mtu"])
 	if err != nil {
-		return nil, fmt.Errorf("failed to convert MTU to integer: %v", conf.InterfaceArgs["mtu"])
+		return nil, 0, cniError(cnitypes.ErrInvalidNetworkConfig, "failed to convert MTU to integer: %v", conf.InterfaceArgs["mtu"])
+	}
+	return m, mtu, nil
+}
+
+func createMacvlan(conf *types.NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
+	mode, err := modeFromString(conf.InterfaceArgs["mode"])
+	if err != nil {
+		return nil, cniError(cnitypes.ErrInvalidNetworkConfig, "%v", err)
+	}
+
+	m, mtu, err := lookupMasterAndMTU(conf)
+	if err != nil {
+		return nil, err
 	}
 
 	// due to kernel bug we have to create with tmpName or it might
 	// collide with the name on the host and error out
 	tmpName, err := ip.RandomVethName()
 	if err != nil {
-		return nil, err
+		return nil, cniError(cnitypes.ErrIOFailure, "failed to generate temporary interface name: %v", err)
 	}
 
 	mv := &netlink.Macvlan{
@@ -620,37 +1205,44 @@ func createMacvlan(conf *types.NetConf, ifName string, netns ns.NetNS) (*current
 	}
 
 	if err := netlink.LinkAdd(mv); err != nil {
-		logging.Errorf("failed to create macvlan: %v", err)
-		return nil, fmt.Errorf("failed to create macvlan: %v", err)
+		return nil, cniError(ioErrorCode(err), "failed to create macvlan: %v", err)
 	}
 	logging.Debugf("Created macvlan interface")
 
-	err = netns.Do(func(_ ns.NetNS) error {
+	return setupContainerLink(mv, tmpName, ifName, netns)
+}
+
+// setupContainerLink enables proxy ARP on the link just created in netns under
+// tmpName, renames it to ifName and returns its description for the CNI result.
+// The link is deleted if any step fails.
+func setupContainerLink(link netlink.Link, tmpName, ifName string, netns ns.NetNS) (*current.Interface, error) {
+	contIface := &current.Interface{}
+	linkType := link.Type()
+
+	err := netns.Do(func(_ ns.NetNS) error {
 		// TODO: duplicate following lines for ipv6 support, when it will be added in other places
 		ipv4SysctlValueName := fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, tmpName)
 		if _, err := sysctl.Sysctl(ipv4SysctlValueName, "1"); err != nil {
 			// remove the newly added link and ignore errors, because we already are in a failed state
-			_ = netlink.LinkDel(mv)
-			return fmt.Errorf("failed to set proxy_arp on newly added interface %q: %v", tmpName, err)
+			_ = netlink.LinkDel(link)
+			return cniError(cnitypes.ErrIOFailure, "failed to set proxy_arp on newly added interface %q: %v", tmpName, err)
 		}
 
 		err := ip.RenameLink(tmpName, ifName)
 		if err != nil {
-			_ = netlink.LinkDel(mv)
-			logging.Errorf("failed to rename macvlan to %q: %v", ifName, err)
-			return fmt.Errorf("failed to rename macvlan to %q: %v", ifName, err)
+			_ = netlink.LinkDel(link)
+			return cniError(ioErrorCode(err), "failed to rename %s to %q: %v", linkType, ifName, err)
 		}
-		logging.Debugf("Renamed macvlan to %q", ifName)
-		macvlan.Name = ifName
+		logging.Debugf("Renamed %s to %q", linkType, ifName)
+		contIface.Name = ifName
 
-		// Re-fetch macvlan to get all properties/attributes
-		contMacvlan, err := netlink.LinkByName(ifName)
+		// Re-fetch link to get all properties/attributes
+		contLink, err := netlink.LinkByName(ifName)
 		if err != nil {
-			logging.Errorf("failed to refetch macvlan %q: %v", ifName, err)
-			return fmt.Errorf("failed to refetch macvlan %q: %v", ifName, err)
+			return cniError(ioErrorCode(err), "failed to refetch %s %q: %v", linkType, ifName, err)
 		}
-		macvlan.Mac = contMacvlan.Attrs().HardwareAddr.String()
-		macvlan.Sandbox = netns.Path()
+		contIface.Mac = contLink.Attrs().HardwareAddr.String()
+		contIface.Sandbox = netns.Path()
 
 		return nil
 	})
@@ -658,21 +1250,40 @@ func createMacvlan(conf *types.NetConf, ifName string, netns ns.NetNS) (*current
 		return nil, err
 	}
 
-	return macvlan, nil
+	return contIface, nil
 }
 
 func CmdCheck(args *skel.CmdArgs) error {
-	return nil
+	setLogContext("CHECK", args)
+	return macvlanCmdCheck(args)
 }
 
 func CmdAdd(args *skel.CmdArgs) error {
+	setLogContext("ADD", args)
 	return macvlanCmdAdd(args)
 }
 
 func CmdDel(args *skel.CmdArgs) error {
+	setLogContext("DEL", args)
 	return macvlanCmdDel(args)
 }
 
+// setLogContext makes every subsequent log line carry the CNI command and the
+// identity of the attachment and of its pod.
+func setLogContext(command string, args *skel.CmdArgs) {
+	k8sArgs := &types.K8sArgs{CommonArgs: cnitypes.CommonArgs{IgnoreUnknown: true}}
+	// A malformed CNI_ARGS is reported by the command itself
+	_ = cnitypes.LoadArgs(args.Args, k8sArgs)
+	logging.SetLogContext(
+		logging.Field{Key: "command", Value: command},
+		logging.Field{Key: "containerID", Value: args.ContainerID},
+		logging.Field{Key: "netns", Value: args.Netns},
+		logging.Field{Key: "ifName", Value: args.IfName},
+		logging.Field{Key: "podNamespace", Value: string(k8sArgs.K8S_POD_NAMESPACE)},
+		logging.Field{Key: "podName", Value: string(k8sArgs.K8S_POD_NAME)},
+	)
+}
+
 func isIPv6CIDR(cidr *net.IPNet) bool {
 	return cidr.IP != nil && cidr.IP.To4() == nil
 }
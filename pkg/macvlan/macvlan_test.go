@@ -1,15 +1,20 @@
 package macvlan
 
 import (
+	"context"
 	"fmt"
 	"github.com/openshift/egress-router-cni/pkg/types"
+	"net"
+	"strings"
 	"testing"
 
+	"github.com/containernetworking/cni/pkg/types/current"
 	egresstest "github.com/openshift/egress-router-cni/pkg/testing"
 	netlink_mocks "github.com/openshift/egress-router-cni/pkg/testing/mocks/github.com/vishvananda/netlink"
 	util "github.com/openshift/egress-router-cni/pkg/util"
 	util_mocks "github.com/openshift/egress-router-cni/pkg/util/mocks"
 	"github.com/vishvananda/netlink"
+	"sigs.k8s.io/knftables"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -47,6 +52,83 @@ func TestFillNetConfDefaults(t *testing.T) {
 				{OnCallMethodName: "Attrs", OnCallMethodArgType: []string{}, RetArgList: []interface{}{&netlink.LinkAttrs{MTU: 1500}}},
 			},
 		},
+		{
+			desc:           "ipvlan interface defaults to l2 mode",
+			inpNetConf:     &types.NetConf{InterfaceType: "ipvlan"},
+			inpClusterConf: &types.ClusterConf{},
+			outNetConf: &types.NetConf{
+				InterfaceType: "ipvlan",
+				InterfaceArgs: map[string]string{"master": "eno1", "mode": "l2", "mtu": "1500"},
+			},
+			netOpsMockHelper: []egresstest.TestifyMockHelper{
+				{OnCallMethodName: "RouteListFiltered", OnCallMethodArgType: []string{"int", "*netlink.Route", "uint64"}, RetArgList: []interface{}{[]netlink.Route{{LinkIndex: 0}}, nil}},
+				{OnCallMethodName: "LinkByIndex", OnCallMethodArgType: []string{"int"}, RetArgList: []interface{}{mockLink, nil}},
+				{OnCallMethodName: "LinkByName", OnCallMethodArgType: []string{"string"}, RetArgList: []interface{}{mockLink, nil}},
+			},
+			linkMockHelper: []egresstest.TestifyMockHelper{
+				{OnCallMethodName: "Attrs", OnCallMethodArgType: []string{}, RetArgList: []interface{}{&netlink.LinkAttrs{Name: "eno1"}}},
+				{OnCallMethodName: "Attrs", OnCallMethodArgType: []string{}, RetArgList: []interface{}{&netlink.LinkAttrs{MTU: 1500}}},
+			},
+		},
+		{
+			desc:           "ipvlan interface keeps explicit arguments",
+			inpNetConf:     &types.NetConf{InterfaceType: "ipvlan", InterfaceArgs: map[string]string{"master": "ens3", "mode": "l3s", "mtu": "9000"}},
+			inpClusterConf: &types.ClusterConf{CloudProvider: "testProvider"},
+			outNetConf: &types.NetConf{
+				InterfaceType: "ipvlan",
+				InterfaceArgs: map[string]string{"master": "ens3", "mode": "l3s", "mtu": "9000"},
+			},
+		},
+		{
+			desc: "http-proxy mode defaults the proxy port",
+			inpNetConf: &types.NetConf{InterfaceType: "ipvlan", InterfaceArgs: map[string]string{"master": "ens3", "mode": "l2", "mtu": "1500"},
+				Mode: types.ModeHTTPProxy, HTTPProxy: &types.HTTPProxy{Allowlist: []string{"*.example.com"}}},
+			inpClusterConf: &types.ClusterConf{},
+			outNetConf: &types.NetConf{InterfaceType: "ipvlan", InterfaceArgs: map[string]string{"master": "ens3", "mode": "l2", "mtu": "1500"},
+				Mode: types.ModeHTTPProxy, HTTPProxy: &types.HTTPProxy{Port: 8080, Allowlist: []string{"*.example.com"}}},
+		},
+		{
+			desc:           "http-proxy mode without allowlist",
+			inpNetConf:     &types.NetConf{InterfaceType: "nonMacVlanIface", Mode: types.ModeHTTPProxy},
+			inpClusterConf: &types.ClusterConf{},
+			errMatch:       fmt.Errorf("invalid httpProxy: http-proxy mode requires an allowlist"),
+		},
+		{
+			desc:           "unsupported mode",
+			inpNetConf:     &types.NetConf{InterfaceType: "nonMacVlanIface", Mode: "socks"},
+			inpClusterConf: &types.ClusterConf{},
+			errMatch:       fmt.Errorf("unsupported mode \"socks\""),
+		},
+		{
+			desc:           "negative log rotation limit",
+			inpNetConf:     &types.NetConf{InterfaceType: "nonMacVlanIface", LogMaxBackups: -1},
+			inpClusterConf: &types.ClusterConf{},
+			errMatch:       fmt.Errorf("log_max_size, log_max_age and log_max_backups must not be negative"),
+		},
+		{
+			desc:           "unsupported log format",
+			inpNetConf:     &types.NetConf{InterfaceType: "nonMacVlanIface", LogFormat: "xml"},
+			inpClusterConf: &types.ClusterConf{},
+			errMatch:       fmt.Errorf("unsupported log_format \"xml\""),
+		},
+		{
+			desc:           "invalid events interval",
+			inpNetConf:     &types.NetConf{InterfaceType: "nonMacVlanIface", Events: &types.Events{Interval: "often"}},
+			inpClusterConf: &types.ClusterConf{},
+			errMatch:       fmt.Errorf("invalid events interval: time: invalid duration \"often\""),
+		},
+		{
+			desc:           "gatewayProbe defaults to failing ADD",
+			inpNetConf:     &types.NetConf{InterfaceType: "nonMacVlanIface", GatewayProbe: &types.GatewayProbe{}},
+			inpClusterConf: &types.ClusterConf{},
+			outNetConf:     &types.NetConf{InterfaceType: "nonMacVlanIface", GatewayProbe: &types.GatewayProbe{OnFailure: types.GatewayProbeFail}},
+		},
+		{
+			desc:           "invalid gatewayProbe action",
+			inpNetConf:     &types.NetConf{InterfaceType: "nonMacVlanIface", GatewayProbe: &types.GatewayProbe{OnFailure: "ignore"}},
+			inpClusterConf: &types.ClusterConf{},
+			errMatch:       fmt.Errorf("invalid gatewayProbe: unsupported onFailure \"ignore\", must be \"fail\" or \"warn\""),
+		},
 		{
 			desc:           "missing explicit interface type when cloud provider specified",
 			inpNetConf:     &types.NetConf{},
@@ -104,3 +186,223 @@ func TestFillNetConfDefaults(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateEgressNFTablesRules(t *testing.T) {
+	tests := []struct {
+		desc            string
+		snatAddresses   []string
+		destinations    []string
+		postroutingExpt []string
+		preroutingExpt  []string
+		dnatExpt        map[string][]string
+	}{
+		{
+			desc:            "IPv4 only",
+			snatAddresses:   []string{"192.168.3.10"},
+			destinations:    []string{"10.100.3.1", "8080 tcp 203.0.113.26 80"},
+			postroutingExpt: []string{"oif net1 snat ip to 192.168.3.10"},
+			preroutingExpt: []string{
+				"iif eth0 meta nfproto ipv4 dnat ip addr . port to meta l4proto . th dport map @dnat-ipv4",
+				"iif eth0 dnat ip to 10.100.3.1",
+			},
+			dnatExpt: map[string][]string{"dnat-ipv4": {"tcp . 8080 : 203.0.113.26 . 80"}},
+		},
+		{
+			desc:            "dual-stack",
+			snatAddresses:   []string{"192.168.3.10", "2001:db8::10"},
+			destinations:    []string{"80 udp 10.100.3.1", "8443 tcp 2001:db8:1::27 443", "2001:db8:1::1"},
+			postroutingExpt: []string{"oif net1 snat ip to 192.168.3.10", "oif net1 snat ip6 to 2001:db8::10"},
+			preroutingExpt: []string{
+				"iif eth0 meta nfproto ipv4 dnat ip addr . port to meta l4proto . th dport map @dnat-ipv4",
+				"iif eth0 meta nfproto ipv6 dnat ip6 addr . port to meta l4proto . th dport map @dnat-ipv6",
+				"iif eth0 dnat ip6 to 2001:db8:1::1",
+			},
+			dnatExpt: map[string][]string{
+				"dnat-ipv4": {"udp . 80 : 10.100.3.1 . 80"},
+				"dnat-ipv6": {"tcp . 8443 : 2001:db8:1::27 . 443"},
+			},
+		},
+		{
+			desc:            "legacy destinations in CIDR notation redirect to the address only",
+			snatAddresses:   []string{"192.168.3.10"},
+			destinations:    []string{"10.100.3.1/30", "8080 TCP 203.0.113.26/30 80"},
+			postroutingExpt: []string{"oif net1 snat ip to 192.168.3.10"},
+			preroutingExpt: []string{
+				"iif eth0 meta nfproto ipv4 dnat ip addr . port to meta l4proto . th dport map @dnat-ipv4",
+				"iif eth0 dnat ip to 10.100.3.1",
+			},
+			dnatExpt: map[string][]string{"dnat-ipv4": {"tcp . 8080 : 203.0.113.26 . 80"}},
+		},
+		{
+			desc:            "many port destinations share one rule",
+			snatAddresses:   []string{"192.168.3.10"},
+			destinations:    []string{"80 tcp 10.100.3.1", "81 tcp 10.100.3.2", "82 udp 10.100.3.3 8082", "83 sctp 10.100.3.4"},
+			postroutingExpt: []string{"oif net1 snat ip to 192.168.3.10"},
+			preroutingExpt:  []string{"iif eth0 meta nfproto ipv4 dnat ip addr . port to meta l4proto . th dport map @dnat-ipv4"},
+			dnatExpt: map[string][]string{"dnat-ipv4": {
+				"tcp . 80 : 10.100.3.1 . 80",
+				"tcp . 81 : 10.100.3.2 . 81",
+				"udp . 82 : 10.100.3.3 . 8082",
+				"sctp . 83 : 10.100.3.4 . 83",
+			}},
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			var addresses []net.IP
+			for _, a := range tc.snatAddresses {
+				addresses = append(addresses, net.ParseIP(a))
+			}
+
+			fake := knftables.NewFake(egressTableFamily, egressTableName)
+			tx := fake.NewTransaction()
+			generateEgressNFTablesRules(tx, "eth0", "net1", addresses, mustParseDestinations(t, tc.destinations...), nil)
+			assert.NoError(t, fake.Run(context.Background(), tx))
+
+			ruleText := func(chain string) []string {
+				var rules []string
+				for _, r := range fake.Table.Chains[chain].Rules {
+					rules = append(rules, r.Rule)
+				}
+				return rules
+			}
+			assert.Equal(t, tc.postroutingExpt, ruleText("postrouting"))
+			assert.Equal(t, tc.preroutingExpt, ruleText("prerouting"))
+
+			dnat := map[string][]string{}
+			for name, m := range fake.Table.Maps {
+				for _, e := range m.Elements {
+					dnat[name] = append(dnat[name], strings.Join(e.Key, " . ")+" : "+strings.Join(e.Value, " . "))
+				}
+			}
+			assert.Equal(t, tc.dnatExpt, dnat)
+		})
+	}
+}
+
+func TestStaticIPConfigs(t *testing.T) {
+	tests := []struct {
+		desc     string
+		ip       *types.IP
+		families []egressFamily
+		errMatch error
+	}{
+		{
+			desc: "IPv4 address with gateway",
+			ip:   &types.IP{Addresses: []string{"192.168.3.10/24"}, Gateway: "192.168.3.1"},
+			families: []egressFamily{
+				{isIPv6: false, address: net.ParseIP("192.168.3.10"), gateway: net.ParseIP("192.168.3.1")},
+			},
+		},
+		{
+			desc: "dual-stack addresses with per-family gateways",
+			ip:   &types.IP{Addresses: []string{"192.168.3.10/24", "192.168.3.11/24", "2001:db8::10/64"}, Gateway: "192.168.3.1", Gateways: []string{"2001:db8::1"}},
+			families: []egressFamily{
+				{isIPv6: false, address: net.ParseIP("192.168.3.10"), gateway: net.ParseIP("192.168.3.1")},
+				{isIPv6: true, address: net.ParseIP("2001:db8::10"), gateway: net.ParseIP("2001:db8::1")},
+			},
+		},
+		{
+			desc:     "IPv6 address without IPv6 gateway",
+			ip:       &types.IP{Addresses: []string{"192.168.3.10/24", "2001:db8::10/64"}, Gateway: "192.168.3.1"},
+			errMatch: fmt.Errorf("no IPv6 gateway configured for address \"2001:db8::10/64\""),
+		},
+		{
+			desc:     "two gateways of the same family",
+			ip:       &types.IP{Addresses: []string{"192.168.3.10/24"}, Gateway: "192.168.3.1", Gateways: []string{"192.168.3.2"}},
+			errMatch: fmt.Errorf("more than one IPv4 gateway configured"),
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			ipcs, err := staticIPConfigs(tc.ip)
+			if tc.errMatch != nil {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errMatch.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, ipcs, len(tc.ip.Addresses))
+
+			families, err := egressFamilies(ipcs, tc.ip)
+			assert.NoError(t, err)
+			assert.Equal(t, len(tc.families), len(families))
+			for i := range families {
+				assert.Equal(t, tc.families[i].isIPv6, families[i].isIPv6)
+				assert.True(t, tc.families[i].address.Equal(families[i].address))
+				assert.True(t, tc.families[i].gateway.Equal(families[i].gateway))
+			}
+		})
+	}
+}
+
+func TestClusterInterfaceName(t *testing.T) {
+	mockNetLinkOps := new(util_mocks.NetLinkOps)
+	mockLink := new(netlink_mocks.Link)
+	util.SetNetLinkOpMockInst(mockNetLinkOps)
+
+	prevResult := &current.Result{Interfaces: []*current.Interface{
+		{Name: "veth1234"},
+		{Name: "ens5", Sandbox: "/var/run/netns/pod"},
+	}}
+	tests := []struct {
+		desc             string
+		conf             *types.NetConf
+		prevResult       *current.Result
+		expected         string
+		errMatch         error
+		netOpsMockHelper []egresstest.TestifyMockHelper
+		linkMockHelper   []egresstest.TestifyMockHelper
+	}{
+		{
+			desc:       "configured clusterInterface",
+			conf:       &types.NetConf{ClusterInterface: "pod0"},
+			prevResult: prevResult,
+			expected:   "pod0",
+		},
+		{
+			desc:       "container interface from prevResult",
+			conf:       &types.NetConf{},
+			prevResult: prevResult,
+			expected:   "ens5",
+		},
+		{
+			desc:     "default route skipping the egress interface",
+			conf:     &types.NetConf{},
+			expected: "ens5",
+			netOpsMockHelper: []egresstest.TestifyMockHelper{
+				{OnCallMethodName: "RouteListFiltered", OnCallMethodArgType: []string{"int", "*netlink.Route", "uint64"}, RetArgList: []interface{}{[]netlink.Route{{LinkIndex: 3}, {LinkIndex: 2}}, nil}},
+				{OnCallMethodName: "LinkByIndex", OnCallMethodArgType: []string{"int"}, RetArgList: []interface{}{mockLink, nil}, CallTimes: 2},
+			},
+			linkMockHelper: []egresstest.TestifyMockHelper{
+				{OnCallMethodName: "Attrs", OnCallMethodArgType: []string{}, RetArgList: []interface{}{&netlink.LinkAttrs{Name: "net1"}}},
+				{OnCallMethodName: "Attrs", OnCallMethodArgType: []string{}, RetArgList: []interface{}{&netlink.LinkAttrs{Name: "ens5"}}},
+			},
+		},
+		{
+			desc:     "no default route",
+			conf:     &types.NetConf{},
+			errMatch: fmt.Errorf("unable to discover the cluster interface, set clusterInterface"),
+			netOpsMockHelper: []egresstest.TestifyMockHelper{
+				{OnCallMethodName: "RouteListFiltered", OnCallMethodArgType: []string{"int", "*netlink.Route", "uint64"}, RetArgList: []interface{}{[]netlink.Route{}, nil}},
+			},
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			egresstest.ProcessMockFnList(&mockNetLinkOps.Mock, tc.netOpsMockHelper)
+			egresstest.ProcessMockFnList(&mockLink.Mock, tc.linkMockHelper)
+
+			name, err := clusterInterfaceName(tc.conf, tc.prevResult, "net1")
+			if tc.errMatch != nil {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errMatch.Error())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.expected, name)
+			}
+			mockLink.AssertExpectations(t)
+			mockNetLinkOps.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package macvlan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/knftables"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+// countChainName is the chain holding the counters exported as metrics.
+const countChainName = "count"
+
+// generateCountNFTablesRules adds the count chain, which counts the forwarded
+// traffic per egress address and per destination. NAT rules only see the first
+// packet of each connection, so the chain runs in the forward hook, after the
+// filter, and matches the conntrack entries of the connections: the ones
+// SNATed to an egress address, and the ones DNATed to a destination, by their
+// original destination port or, for destinations without a local port, by their
+// target. Both directions of a connection are counted. A destination with a
+// local port returns once counted, so that the connections it redirects are not
+// counted again by a destination without a local port with the same target.
+func generateCountNFTablesRules(tx *knftables.Transaction, snatAddresses []net.IP, allowedDestinations []destination) {
+	tx.Add(&knftables.Chain{
+		Name: countChainName,
+
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(knftables.ForwardHook),
+		Priority: knftables.PtrTo(knftables.FilterPriority + "+10"),
+	})
+	for _, addr := range snatAddresses {
+		isIPv6 := addr.To4() == nil
+		tx.Add(&knftables.Rule{
+			Chain: countChainName,
+			Rule: knftables.Concat(
+				"meta nfproto", nftNFProto(isIPv6), "ct status snat ct reply", nftFamily(isIPv6), "daddr", addr.String(), "counter",
+			),
+			Comment: knftables.PtrTo("snat " + addr.String()),
+		})
+	}
+	for _, d := range allowedDestinations {
+		if d.localPort == 0 {
+			continue
+		}
+		isIPv6 := d.target.To4() == nil
+		tx.Add(&knftables.Rule{
+			Chain: countChainName,
+			Rule: knftables.Concat(
+				"meta nfproto", nftNFProto(isIPv6), "ct status dnat meta l4proto", d.protocol,
+				"ct original proto-dst", d.localPort, "counter return",
+			),
+			Comment: knftables.PtrTo(d.entry),
+		})
+	}
+	for _, d := range allowedDestinations {
+		if d.localPort != 0 {
+			continue
+		}
+		isIPv6 := d.target.To4() == nil
+		tx.Add(&knftables.Rule{
+			Chain: countChainName,
+			Rule: knftables.Concat(
+				"meta nfproto", nftNFProto(isIPv6), "ct status dnat ct reply", nftFamily(isIPv6), "saddr", d.target.String(), "counter",
+			),
+			Comment: knftables.PtrTo(d.entry),
+		})
+	}
+}
+
+// nftCounter is the counter of a rule of the egress_cni table.
+type nftCounter struct {
+	chain   string
+	comment string
+	packets uint64
+	bytes   uint64
+}
+
+// listNFTCounters returns the counters of the rules of the egress_cni table.
+// knftables does not report the statements of rules, so the table is listed with
+// nft directly. It must be called inside the container network namespace.
+func listNFTCounters(ctx context.Context) ([]nftCounter, error) {
+	out, err := exec.CommandContext(ctx, "nft", "--json", "list", "table", string(egressTableFamily), egressTableName).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nftables table %q: %v", egressTableName, err)
+	}
+	return parseNFTCounters(out)
+}
+
+// parseNFTCounters extracts the rule counters from the JSON output of nft.
+func parseNFTCounters(data []byte) ([]nftCounter, error) {
+	var ruleset struct {
+		Nftables []struct {
+			Rule *struct {
+				Chain   string                       `json:"chain"`
+				Comment string                       `json:"comment"`
+				Expr    []map[string]json.RawMessage `json:"expr"`
+			} `json:"rule"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(data, &ruleset); err != nil {
+		return nil, fmt.Errorf("failed to parse nft output: %v", err)
+	}
+
+	var counters []nftCounter
+	for _, object := range ruleset.Nftables {
+		if object.Rule == nil {
+			continue
+		}
+		for _, expr := range object.Rule.Expr {
+			raw, ok := expr["counter"]
+			if !ok {
+				continue
+			}
+			var counter struct {
+				Packets uint64 `json:"packets"`
+				Bytes   uint64 `json:"bytes"`
+			}
+			if err := json.Unmarshal(raw, &counter); err != nil {
+				return nil, fmt.Errorf("failed to parse counter of rule %q: %v", object.Rule.Comment, err)
+			}
+			counters = append(counters, nftCounter{
+				chain:   object.Rule.Chain,
+				comment: object.Rule.Comment,
+				packets: counter.Packets,
+				bytes:   counter.Bytes,
+			})
+		}
+	}
+	return counters, nil
+}
+
+// metric is one sample of a metric family.
+type metric struct {
+	labels string
+	value  uint64
+}
+
+// writeMetrics writes the counters of the count chain in the Prometheus text
+// format. The rules of the destinations are recognized by their comment, which is
+// the configured destination, and the rules of the egress addresses by their
+// "snat <address>" comment. The traffic of a destination leaves from the egress
+// address of the family of its target.
+func writeMetrics(w io.Writer, counters []nftCounter) {
+	egressIPs := map[bool]string{}
+	for _, c := range counters {
+		if c.chain != countChainName || !strings.HasPrefix(c.comment, "snat ") {
+			continue
+		}
+		addr := strings.TrimPrefix(c.comment, "snat ")
+		if ip := net.ParseIP(addr); ip != nil {
+			egressIPs[ip.To4() == nil] = addr
+		}
+	}
+
+	families := map[string][]metric{}
+	for _, c := range counters {
+		if c.chain != countChainName {
+			continue
+		}
+		var prefix, labels string
+		if strings.HasPrefix(c.comment, "snat ") {
+			prefix = "egress_router_snat"
+			labels = fmt.Sprintf(`egress_ip="%s"`, escapeLabel(strings.TrimPrefix(c.comment, "snat ")))
+		} else {
+			d, err := parseDestination(types.Destination{Legacy: c.comment})
+			if err != nil {
+				logging.Debugf("Not exporting the counter of rule %q: %v", c.comment, err)
+				continue
+			}
+			protocol := d.protocol
+			if protocol == "" {
+				protocol = "all"
+			}
+			prefix = "egress_router_dnat"
+			labels = fmt.Sprintf(`destination="%s",egress_ip="%s",protocol="%s",target="%s"`,
+				escapeLabel(d.entry), egressIPs[d.target.To4() == nil], protocol, d.target)
+		}
+		families[prefix+"_packets_total"] = append(families[prefix+"_packets_total"], metric{labels, c.packets})
+		families[prefix+"_bytes_total"] = append(families[prefix+"_bytes_total"], metric{labels, c.bytes})
+	}
+
+	help := map[string]string{
+		"egress_router_dnat_packets_total": "Packets of the connections redirected to a destination, in both directions.",
+		"egress_router_dnat_bytes_total":   "Bytes of the connections redirected to a destination, in both directions.",
+		"egress_router_snat_packets_total": "Packets of the connections forwarded from an egress address, in both directions.",
+		"egress_router_snat_bytes_total":   "Bytes of the connections forwarded from an egress address, in both directions.",
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help[name], name)
+		for _, m := range families[name] {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, m.labels, m.value)
+		}
+	}
+}
+
+// escapeLabel escapes a Prometheus label value.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// MetricsHandler serves the counters of the egress_cni table in the Prometheus
+// text format. It must be used inside the pod network namespace.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counters, err := listNFTCounters(r.Context())
+		if err != nil {
+			logging.Errorf("%v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, counters)
+	})
+}
@@ -0,0 +1,80 @@
+package macvlan
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/knftables"
+)
+
+const nftCountersJSON = `{"nftables": [
+  {"metainfo": {"version": "1.0.9", "release_name": "Old Doc Yak #3", "json_schema_version": 1}},
+  {"table": {"family": "inet", "name": "egress_cni", "handle": 1}},
+  {"chain": {"family": "inet", "table": "egress_cni", "name": "count", "handle": 3, "type": "filter", "hook": "forward", "prio": 10, "policy": "accept"}},
+  {"rule": {"family": "inet", "table": "egress_cni", "chain": "prerouting", "handle": 7, "comment": "dnat-ipv4",
+    "expr": [{"match": {"op": "==", "left": {"meta": {"key": "iif"}}, "right": "eth0"}}, {"dnat": {"family": "ip", "addr": {"map": {"key": {"concat": [{"meta": {"key": "l4proto"}}, {"payload": {"protocol": "th", "field": "dport"}}]}, "data": "@dnat-ipv4"}}}}]}},
+  {"rule": {"family": "inet", "table": "egress_cni", "chain": "count", "handle": 9, "comment": "snat 192.168.3.10",
+    "expr": [{"match": {"op": "==", "left": {"meta": {"key": "nfproto"}}, "right": "ipv4"}}, {"match": {"op": "in", "left": {"ct": {"key": "status"}}, "right": "snat"}}, {"match": {"op": "==", "left": {"ct": {"key": "daddr", "family": "ip", "dir": "reply"}}, "right": "192.168.3.10"}}, {"counter": {"packets": 120, "bytes": 72000}}]}},
+  {"rule": {"family": "inet", "table": "egress_cni", "chain": "count", "handle": 10, "comment": "8443 tcp 203.0.113.27 443",
+    "expr": [{"match": {"op": "==", "left": {"meta": {"key": "nfproto"}}, "right": "ipv4"}}, {"match": {"op": "in", "left": {"ct": {"key": "status"}}, "right": "dnat"}}, {"match": {"op": "==", "left": {"meta": {"key": "l4proto"}}, "right": "tcp"}}, {"match": {"op": "==", "left": {"ct": {"key": "proto-dst", "dir": "original"}}, "right": 8443}}, {"counter": {"packets": 100, "bytes": 60000}}, {"return": null}]}},
+  {"rule": {"family": "inet", "table": "egress_cni", "chain": "count", "handle": 11, "comment": "10.100.3.2",
+    "expr": [{"match": {"op": "==", "left": {"meta": {"key": "nfproto"}}, "right": "ipv4"}}, {"match": {"op": "in", "left": {"ct": {"key": "status"}}, "right": "dnat"}}, {"match": {"op": "==", "left": {"ct": {"key": "saddr", "family": "ip", "dir": "reply"}}, "right": "10.100.3.2"}}, {"counter": {"packets": 20, "bytes": 1200}}]}}
+]}`
+
+func TestWriteMetrics(t *testing.T) {
+	counters, err := parseNFTCounters([]byte(nftCountersJSON))
+	assert.NoError(t, err)
+	assert.Equal(t, []nftCounter{
+		{chain: "count", comment: "snat 192.168.3.10", packets: 120, bytes: 72000},
+		{chain: "count", comment: "8443 tcp 203.0.113.27 443", packets: 100, bytes: 60000},
+		{chain: "count", comment: "10.100.3.2", packets: 20, bytes: 1200},
+	}, counters)
+
+	var out bytes.Buffer
+	writeMetrics(&out, counters)
+	assert.Equal(t, `# HELP egress_router_dnat_bytes_total Bytes of the connections redirected to a destination, in both directions.
+# TYPE egress_router_dnat_bytes_total counter
+egress_router_dnat_bytes_total{destination="8443 tcp 203.0.113.27 443",egress_ip="192.168.3.10",protocol="tcp",target="203.0.113.27"} 60000
+egress_router_dnat_bytes_total{destination="10.100.3.2",egress_ip="192.168.3.10",protocol="all",target="10.100.3.2"} 1200
+# HELP egress_router_dnat_packets_total Packets of the connections redirected to a destination, in both directions.
+# TYPE egress_router_dnat_packets_total counter
+egress_router_dnat_packets_total{destination="8443 tcp 203.0.113.27 443",egress_ip="192.168.3.10",protocol="tcp",target="203.0.113.27"} 100
+egress_router_dnat_packets_total{destination="10.100.3.2",egress_ip="192.168.3.10",protocol="all",target="10.100.3.2"} 20
+# HELP egress_router_snat_bytes_total Bytes of the connections forwarded from an egress address, in both directions.
+# TYPE egress_router_snat_bytes_total counter
+egress_router_snat_bytes_total{egress_ip="192.168.3.10"} 72000
+# HELP egress_router_snat_packets_total Packets of the connections forwarded from an egress address, in both directions.
+# TYPE egress_router_snat_packets_total counter
+egress_router_snat_packets_total{egress_ip="192.168.3.10"} 120
+`, out.String())
+
+	_, err = parseNFTCounters([]byte("not json"))
+	assert.Error(t, err)
+}
+
+func TestGenerateCountNFTablesRules(t *testing.T) {
+	fake := knftables.NewFake(egressTableFamily, egressTableName)
+	tx := fake.NewTransaction()
+	tx.Add(&knftables.Table{})
+	generateCountNFTablesRules(tx,
+		[]net.IP{net.ParseIP("192.168.3.10"), net.ParseIP("fd00::10")},
+		mustParseDestinations(t, "10.100.3.2", "80 tcp 10.100.3.1", "53 udp fd00:100::1 5353"))
+	assert.NoError(t, fake.Run(context.Background(), tx))
+
+	var rules []string
+	for _, r := range fake.Table.Chains[countChainName].Rules {
+		rules = append(rules, r.Rule)
+	}
+	// Destinations with a local port come first and return, so that the
+	// destination without one only counts the other connections to its target
+	assert.Equal(t, []string{
+		"meta nfproto ipv4 ct status snat ct reply ip daddr 192.168.3.10 counter",
+		"meta nfproto ipv6 ct status snat ct reply ip6 daddr fd00::10 counter",
+		"meta nfproto ipv4 ct status dnat meta l4proto tcp ct original proto-dst 80 counter return",
+		"meta nfproto ipv6 ct status dnat meta l4proto udp ct original proto-dst 53 counter return",
+		"meta nfproto ipv4 ct status dnat ct reply ip saddr 10.100.3.2 counter",
+	}, rules)
+}
@@ -0,0 +1,205 @@
+package macvlan
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+const (
+	// defaultPolicyRoutingTable is the routing table used for egress traffic when
+	// policyRouting does not name one.
+	defaultPolicyRoutingTable = 100
+	// defaultPolicyRoutingPriority is the priority of the egress ip rules when
+	// policyRouting does not set one. It sorts before the main table (32766).
+	defaultPolicyRoutingPriority = 1000
+)
+
+// fillPolicyRoutingDefaults sets the default table and priority of pr and
+// validates its cluster CIDRs.
+func fillPolicyRoutingDefaults(pr *types.PolicyRouting) error {
+	if pr.Table == 0 {
+		pr.Table = defaultPolicyRoutingTable
+	}
+	switch pr.Table {
+	case unix.RT_TABLE_DEFAULT, unix.RT_TABLE_MAIN, unix.RT_TABLE_LOCAL:
+		return fmt.Errorf("table %d is reserved", pr.Table)
+	}
+	if pr.Table < 0 {
+		return fmt.Errorf("invalid table %d", pr.Table)
+	}
+
+	if pr.Priority == 0 {
+		pr.Priority = defaultPolicyRoutingPriority
+	}
+	if pr.Priority < 0 || pr.Priority >= 32766 {
+		return fmt.Errorf("priority %d must be between 1 and 32765 to sort before the main table", pr.Priority)
+	}
+
+	_, err := parseClusterCIDRs(pr.ClusterCIDRs)
+	return err
+}
+
+// parseClusterCIDRs parses the cluster and service networks of policyRouting.
+func parseClusterCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster CIDR %q: %v", cidr, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// policyRoutes returns the routes of one IP family installed in the policy
+// routing table: a host route to the egress gateway and the default route via
+// the egress link, and a route via the cluster link for every cluster CIDR of the
+// family. clusterGateway is the gateway of the original default route of the
+// cluster link; if it is nil the cluster CIDRs are routed on-link.
+func policyRoutes(pr *types.PolicyRouting, link, clusterLink netlink.Link, f egressFamily, clusterGateway net.IP) ([]netlink.Route, error) {
+	bits := 32
+	if f.isIPv6 {
+		bits = 128
+	}
+	routes := []netlink.Route{
+		{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &net.IPNet{IP: f.gateway, Mask: net.CIDRMask(bits, bits)},
+			Scope:     netlink.SCOPE_LINK,
+			Table:     pr.Table,
+		},
+		{
+			LinkIndex: link.Attrs().Index,
+			Gw:        f.gateway,
+			Table:     pr.Table,
+		},
+	}
+
+	clusterCIDRs, err := parseClusterCIDRs(pr.ClusterCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	for _, cidr := range clusterCIDRs {
+		if isIPv6CIDR(cidr) != f.isIPv6 {
+			continue
+		}
+		route := netlink.Route{
+			LinkIndex: clusterLink.Attrs().Index,
+			Dst:       cidr,
+			Table:     pr.Table,
+		}
+		if clusterGateway != nil {
+			route.Gw = clusterGateway
+		} else {
+			route.Scope = netlink.SCOPE_LINK
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// policyRules returns the ip rules of one IP family selecting the policy routing
+// table: one for traffic received on the cluster link, which covers everything
+// DNATed towards the egress destinations, and one for traffic sourced from the
+// egress address.
+func policyRules(pr *types.PolicyRouting, clusterLink netlink.Link, f egressFamily) []*netlink.Rule {
+	bits := 32
+	if f.isIPv6 {
+		bits = 128
+	}
+
+	iifRule := netlink.NewRule()
+	iifRule.Family = netlinkFamily(f.isIPv6)
+	iifRule.Priority = pr.Priority
+	iifRule.Table = pr.Table
+	iifRule.IifName = clusterLink.Attrs().Name
+
+	srcRule := netlink.NewRule()
+	srcRule.Family = netlinkFamily(f.isIPv6)
+	srcRule.Priority = pr.Priority
+	srcRule.Table = pr.Table
+	srcRule.Src = &net.IPNet{IP: f.address, Mask: net.CIDRMask(bits, bits)}
+
+	return []*netlink.Rule{iifRule, srcRule}
+}
+
+// describeRule formats rule the way "ip rule" lists it.
+func describeRule(rule *netlink.Rule) string {
+	selector := "all"
+	if rule.Src != nil {
+		selector = rule.Src.String()
+	}
+	desc := fmt.Sprintf("ip rule %d: from %s", rule.Priority, selector)
+	if rule.IifName != "" {
+		desc += " iif " + rule.IifName
+	}
+	return fmt.Sprintf("%s lookup %d", desc, rule.Table)
+}
+
+// setupPolicyRouting routes the egress traffic of one IP family through the
+// policy routing table, leaving the main table of the pod untouched.
+func setupPolicyRouting(pr *types.PolicyRouting, link, clusterLink netlink.Link, f egressFamily, clusterGateway net.IP) error {
+	if _, err := sysctl.Sysctl(ipForwardSysctl(f.isIPv6), "1"); err != nil {
+		return cniError(cnitypes.ErrIOFailure, "failed to enable forwarding (%s): %v", ipForwardSysctl(f.isIPv6), err)
+	}
+
+	routes, err := policyRoutes(pr, link, clusterLink, f, clusterGateway)
+	if err != nil {
+		return cniError(cnitypes.ErrInvalidNetworkConfig, "invalid policyRouting: %v", err)
+	}
+	for i := range routes {
+		if err := netlink.RouteAdd(&routes[i]); err != nil && !os.IsExist(err) {
+			return cniError(ioErrorCode(err), "failed to add route %v to table %d: %v", routes[i], pr.Table, err)
+		}
+		logging.Debugf("Added route %v to table %d", routes[i], pr.Table)
+	}
+
+	for _, rule := range policyRules(pr, clusterLink, f) {
+		if err := netlink.RuleAdd(rule); err != nil && !os.IsExist(err) {
+			return cniError(ioErrorCode(err), "failed to add %s rule to table %d: %v", ipFamilyName(f.isIPv6), pr.Table, err)
+		}
+		logging.Debugf("Added %s", describeRule(rule))
+	}
+	return nil
+}
+
+// deletePolicyRouting removes the ip rules selecting table and the routes left in
+// it. It must be called inside the container network namespace.
+func deletePolicyRouting(table int) error {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return fmt.Errorf("failed to list ip rules: %v", err)
+		}
+		for i := range rules {
+			if rules[i].Table != table {
+				continue
+			}
+			if err := netlink.RuleDel(&rules[i]); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to delete %s: %v", describeRule(&rules[i]), err)
+			}
+			logging.Debugf("Deleted %s", describeRule(&rules[i]))
+		}
+
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return fmt.Errorf("failed to list routes in table %d: %v", table, err)
+		}
+		for i := range routes {
+			if err := netlink.RouteDel(&routes[i]); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to delete route %v from table %d: %v", routes[i], table, err)
+			}
+		}
+	}
+	return nil
+}
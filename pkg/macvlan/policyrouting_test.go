@@ -0,0 +1,92 @@
+package macvlan
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+func TestFillPolicyRoutingDefaults(t *testing.T) {
+	tests := []struct {
+		desc     string
+		pr       *types.PolicyRouting
+		expected *types.PolicyRouting
+		errMatch error
+	}{
+		{
+			desc:     "defaults",
+			pr:       &types.PolicyRouting{},
+			expected: &types.PolicyRouting{Table: defaultPolicyRoutingTable, Priority: defaultPolicyRoutingPriority},
+		},
+		{
+			desc:     "explicit table, priority and cluster CIDRs",
+			pr:       &types.PolicyRouting{Table: 200, Priority: 500, ClusterCIDRs: []string{"10.128.0.0/14", "172.30.0.0/16"}},
+			expected: &types.PolicyRouting{Table: 200, Priority: 500, ClusterCIDRs: []string{"10.128.0.0/14", "172.30.0.0/16"}},
+		},
+		{
+			desc:     "main table",
+			pr:       &types.PolicyRouting{Table: 254},
+			errMatch: fmt.Errorf("table 254 is reserved"),
+		},
+		{
+			desc:     "priority after the main table",
+			pr:       &types.PolicyRouting{Priority: 32766},
+			errMatch: fmt.Errorf("priority 32766 must be between 1 and 32765"),
+		},
+		{
+			desc:     "invalid cluster CIDR",
+			pr:       &types.PolicyRouting{ClusterCIDRs: []string{"10.128.0.0"}},
+			errMatch: fmt.Errorf("invalid cluster CIDR \"10.128.0.0\""),
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			err := fillPolicyRoutingDefaults(tc.pr)
+			if tc.errMatch != nil {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errMatch.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, tc.pr)
+		})
+	}
+}
+
+func TestPolicyRoutesAndRules(t *testing.T) {
+	link := &netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Index: 3, Name: "net1"}}
+	clusterLink := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Index: 2, Name: "eth0"}}
+	pr := &types.PolicyRouting{Table: 100, Priority: 1000, ClusterCIDRs: []string{"10.128.0.0/14", "172.30.0.0/16", "fd01::/48"}}
+	f := egressFamily{address: net.ParseIP("192.168.3.10"), gateway: net.ParseIP("192.168.3.1")}
+
+	routes, err := policyRoutes(pr, link, clusterLink, f, net.ParseIP("10.128.0.1"))
+	assert.NoError(t, err)
+	assert.Len(t, routes, 4, "the IPv6 cluster CIDR must be skipped for IPv4")
+	for _, r := range routes {
+		assert.Equal(t, 100, r.Table)
+	}
+	assert.Equal(t, "192.168.3.1/32", routes[0].Dst.String())
+	assert.Nil(t, routes[1].Dst)
+	assert.Equal(t, "192.168.3.1", routes[1].Gw.String())
+	assert.Equal(t, 3, routes[1].LinkIndex)
+	assert.Equal(t, "10.128.0.0/14", routes[2].Dst.String())
+	assert.Equal(t, "10.128.0.1", routes[2].Gw.String())
+	assert.Equal(t, 2, routes[2].LinkIndex)
+	assert.Equal(t, "172.30.0.0/16", routes[3].Dst.String())
+
+	routes, err = policyRoutes(pr, link, clusterLink, f, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, routes[2].Gw)
+	assert.Equal(t, netlink.SCOPE_LINK, routes[2].Scope, "cluster CIDRs are on-link without a cluster gateway")
+
+	rules := policyRules(pr, clusterLink, f)
+	assert.Len(t, rules, 2)
+	assert.Equal(t, "ip rule 1000: from all iif eth0 lookup 100", describeRule(rules[0]))
+	assert.Equal(t, "ip rule 1000: from 192.168.3.10/32 lookup 100", describeRule(rules[1]))
+	assert.Equal(t, netlink.FAMILY_V4, rules[1].Family)
+}
@@ -0,0 +1,263 @@
+package macvlan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+	"github.com/openshift/egress-router-cni/pkg/util"
+)
+
+const (
+	// defaultGatewayProbeTimeout is how long a gateway has to answer the probe if
+	// the configuration does not set a timeout
+	defaultGatewayProbeTimeout = 3 * time.Second
+	// gatewayProbeRetry is the interval between two ARP requests, or two attempts
+	// to resolve an IPv6 gateway
+	gatewayProbeRetry = time.Second
+	// neighborPollInterval is the interval between two reads of the neighbor
+	// table while an IPv6 gateway is being resolved
+	neighborPollInterval = 100 * time.Millisecond
+	// discardPort is the UDP port of the datagrams sent to IPv6 gateways to
+	// trigger neighbor discovery
+	discardPort = 9
+	// arpRequest and arpReply are the ARP operations
+	arpRequest = 1
+	arpReply   = 2
+)
+
+// fillGatewayProbeDefaults sets the default action of gp and validates it.
+func fillGatewayProbeDefaults(gp *types.GatewayProbe) error {
+	if gp.OnFailure == "" {
+		gp.OnFailure = types.GatewayProbeFail
+	}
+	if err := validateGatewayProbeAction(gp.OnFailure); err != nil {
+		return err
+	}
+	_, err := gatewayProbeTimeout(gp)
+	return err
+}
+
+// validateGatewayProbeAction checks the onFailure action of gatewayProbe.
+func validateGatewayProbeAction(action string) error {
+	switch action {
+	case "", types.GatewayProbeFail, types.GatewayProbeWarn:
+		return nil
+	}
+	return fmt.Errorf("unsupported onFailure %q, must be %q or %q", action, types.GatewayProbeFail, types.GatewayProbeWarn)
+}
+
+// gatewayProbeTimeout returns how long a gateway has to answer the probe.
+func gatewayProbeTimeout(gp *types.GatewayProbe) (time.Duration, error) {
+	if gp.Timeout == "" {
+		return defaultGatewayProbeTimeout, nil
+	}
+	timeout, err := time.ParseDuration(gp.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout: %v", err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("timeout %s is not positive", gp.Timeout)
+	}
+	return timeout, nil
+}
+
+// probeGateways checks that the gateway of each family answers on link. With
+// GatewayProbeFail, the first gateway that does not answer fails ADD; with
+// GatewayProbeWarn, the gateways that do not answer are logged and returned as
+// warnings. The gateways are probed one after the other as the probes must run
+// on the thread that entered the pod network namespace. Interfaces that do not
+// resolve their neighbors, such as ipvlan in l3 or l3s mode, are not probed.
+func probeGateways(gp *types.GatewayProbe, link netlink.Link, families []egressFamily) ([]string, error) {
+	if gp == nil {
+		return nil, nil
+	}
+	if link.Attrs().RawFlags&unix.IFF_NOARP != 0 {
+		logging.Debugf("Not probing the gateways on %s, which does not resolve neighbors", link.Attrs().Name)
+		return nil, nil
+	}
+	timeout, err := gatewayProbeTimeout(gp)
+	if err != nil {
+		return nil, cniError(cnitypes.ErrInvalidNetworkConfig, "invalid gatewayProbe: %v", err)
+	}
+	var warnings []string
+	for _, f := range families {
+		err := probeGateway(link, f.address, f.gateway, timeout)
+		if err == nil {
+			logging.Debugf("Gateway %s answered on %s", f.gateway, link.Attrs().Name)
+			continue
+		}
+		if gp.OnFailure == types.GatewayProbeWarn {
+			warning := fmt.Sprintf("gateway %s is not reachable on %s: %v", f.gateway, link.Attrs().Name, err)
+			logging.Errorf("%s", warning)
+			warnings = append(warnings, warning)
+			continue
+		}
+		// The gateway may only be down for now, so let the runtime retry
+		return nil, cniError(cnitypes.ErrTryAgainLater, "gateway %s is not reachable on %s: %v", f.gateway, link.Attrs().Name, err)
+	}
+	return warnings, nil
+}
+
+// probeGateway checks that gw answers on link within timeout, with ARP for IPv4
+// and neighbor discovery for IPv6, using src as the source address. It must be
+// called inside the pod network namespace.
+var probeGateway = func(link netlink.Link, src, gw net.IP, timeout time.Duration) error {
+	if gw.To4() != nil {
+		return arpProbe(link, src, gw, timeout)
+	}
+	return ndpProbe(link, src, gw, timeout)
+}
+
+// arpProbe sends ARP requests for gw from src on link until one is answered or
+// timeout expires. It uses a packet socket of its own, so that concurrent
+// probes do not share a socket or a timeout.
+func arpProbe(link netlink.Link, src, gw net.IP, timeout time.Duration) error {
+	iface, err := net.InterfaceByIndex(link.Attrs().Index)
+	if err != nil {
+		return err
+	}
+	proto := htons(unix.ETH_P_ARP)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return fmt.Errorf("failed to open ARP socket: %v", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: proto, Ifindex: iface.Index}); err != nil {
+		return fmt.Errorf("failed to bind ARP socket to %s: %v", iface.Name, err)
+	}
+	broadcast := &unix.SockaddrLinklayer{Protocol: proto, Ifindex: iface.Index, Halen: 6, Addr: [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}}
+	request := marshalARPRequest(iface.HardwareAddr, src, gw)
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 128)
+	for {
+		if time.Until(deadline) <= 0 {
+			return fmt.Errorf("no ARP reply within %s", timeout)
+		}
+		if err := unix.Sendto(fd, request, 0, broadcast); err != nil {
+			return fmt.Errorf("failed to send ARP request: %v", err)
+		}
+		retry := time.Now().Add(gatewayProbeRetry)
+		if retry.After(deadline) {
+			retry = deadline
+		}
+		for wait := time.Until(retry); wait > 0; wait = time.Until(retry) {
+			tv := unix.NsecToTimeval(wait.Nanoseconds())
+			if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+				return fmt.Errorf("failed to set ARP socket timeout: %v", err)
+			}
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to receive ARP reply: %v", err)
+			}
+			if isARPReply(buf[:n], src, gw) {
+				return nil
+			}
+		}
+	}
+}
+
+// marshalARPRequest returns an Ethernet ARP request from mac and src asking for
+// the link-layer address of dst.
+func marshalARPRequest(mac net.HardwareAddr, src, dst net.IP) []byte {
+	b := new(bytes.Buffer)
+	_ = binary.Write(b, binary.BigEndian, []uint16{1, unix.ETH_P_IP})
+	b.Write([]byte{6, 4})
+	_ = binary.Write(b, binary.BigEndian, uint16(arpRequest))
+	b.Write(mac)
+	b.Write(src.To4())
+	b.Write(make([]byte, 6))
+	b.Write(dst.To4())
+	return b.Bytes()
+}
+
+// isARPReply returns whether packet is an Ethernet ARP reply from gw to src.
+func isARPReply(packet []byte, src, gw net.IP) bool {
+	if len(packet) < 28 || binary.BigEndian.Uint16(packet[6:8]) != arpReply || packet[4] != 6 || packet[5] != 4 {
+		return false
+	}
+	return net.IP(packet[14:18]).Equal(gw) && net.IP(packet[24:28]).Equal(src)
+}
+
+// htons converts a short from host to network byte order.
+func htons(i uint16) uint16 {
+	return binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, i))
+}
+
+// ndpProbe makes the kernel resolve gw on link, by sending it a UDP datagram
+// from src, and waits for its neighbor entry to be resolved or timeout to
+// expire. A failed resolution is retried.
+func ndpProbe(link netlink.Link, src, gw net.IP, timeout time.Duration) error {
+	name := link.Attrs().Name
+	dialer := net.Dialer{
+		LocalAddr: &net.UDPAddr{IP: src},
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.BindToDevice(int(fd), name)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	dst := &net.UDPAddr{IP: gw, Port: discardPort}
+	if gw.IsLinkLocalUnicast() {
+		dst.Zone = name
+	}
+	conn, err := dialer.Dial("udp6", dst.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(timeout)
+	var lastSent time.Time
+	state := 0
+	for time.Now().Before(deadline) {
+		resolved, s, err := gatewayResolved(link, gw)
+		if err != nil {
+			return err
+		}
+		if resolved {
+			return nil
+		}
+		state = s
+		if time.Since(lastSent) >= gatewayProbeRetry {
+			// Sending fails with EHOSTUNREACH after a failed resolution
+			_, _ = conn.Write([]byte{0})
+			lastSent = time.Now()
+		}
+		time.Sleep(neighborPollInterval)
+	}
+	return fmt.Errorf("no neighbor advertisement within %s, neighbor state %s", timeout, neighState(state))
+}
+
+// gatewayResolved returns whether the neighbor entry of gw on link holds its
+// link-layer address, and the state of the entry.
+func gatewayResolved(link netlink.Link, gw net.IP) (bool, int, error) {
+	neighs, err := util.GetNetLinkOps().NeighList(link.Attrs().Index, netlinkFamily(gw.To4() == nil))
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to list neighbors of %s: %v", link.Attrs().Name, err)
+	}
+	for _, n := range neighs {
+		if n.IP.Equal(gw) {
+			resolved := netlink.NUD_REACHABLE | netlink.NUD_STALE | netlink.NUD_DELAY | netlink.NUD_PROBE | netlink.NUD_PERMANENT
+			return n.State&resolved != 0 && len(n.HardwareAddr) > 0, n.State, nil
+		}
+	}
+	return false, 0, nil
+}
@@ -0,0 +1,167 @@
+package macvlan
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/openshift/egress-router-cni/pkg/types"
+	util "github.com/openshift/egress-router-cni/pkg/util"
+	util_mocks "github.com/openshift/egress-router-cni/pkg/util/mocks"
+)
+
+func TestProbeGateways(t *testing.T) {
+	defer func(f func(netlink.Link, net.IP, net.IP, time.Duration) error) { probeGateway = f }(probeGateway)
+	var probed []string
+	probeGateway = func(_ netlink.Link, src, gw net.IP, timeout time.Duration) error {
+		probed = append(probed, fmt.Sprintf("%s from %s within %s", gw, src, timeout))
+		if gw.Equal(net.ParseIP("fd00::1")) {
+			return fmt.Errorf("no neighbor advertisement within %s, neighbor state FAILED", timeout)
+		}
+		return nil
+	}
+
+	link := &netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: "net1", Index: 2}}
+	families := []egressFamily{
+		{address: net.ParseIP("192.168.3.10"), gateway: net.ParseIP("192.168.3.1")},
+		{isIPv6: true, address: net.ParseIP("fd00::10"), gateway: net.ParseIP("fd00::1")},
+	}
+
+	tests := []struct {
+		desc     string
+		probe    *types.GatewayProbe
+		noARP    bool
+		probed   []string
+		warnings []string
+		errMatch string
+	}{
+		{
+			desc: "disabled",
+		},
+		{
+			desc:     "fail",
+			probe:    &types.GatewayProbe{OnFailure: types.GatewayProbeFail},
+			probed:   []string{"192.168.3.1 from 192.168.3.10 within 3s", "fd00::1 from fd00::10 within 3s"},
+			errMatch: "gateway fd00::1 is not reachable on net1: no neighbor advertisement within 3s, neighbor state FAILED",
+		},
+		{
+			desc:     "warn",
+			probe:    &types.GatewayProbe{Timeout: "500ms", OnFailure: types.GatewayProbeWarn},
+			probed:   []string{"192.168.3.1 from 192.168.3.10 within 500ms", "fd00::1 from fd00::10 within 500ms"},
+			warnings: []string{"gateway fd00::1 is not reachable on net1: no neighbor advertisement within 500ms, neighbor state FAILED"},
+		},
+		{
+			desc:  "interface without neighbor resolution",
+			probe: &types.GatewayProbe{OnFailure: types.GatewayProbeFail},
+			noARP: true,
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			probed = nil
+			link.RawFlags = 0
+			if tc.noARP {
+				link.RawFlags = unix.IFF_NOARP
+			}
+			warnings, err := probeGateways(tc.probe, link, families)
+			assert.Equal(t, tc.probed, probed)
+			assert.Equal(t, tc.warnings, warnings)
+			if tc.errMatch == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.errMatch)
+				assert.Equal(t, uint(cnitypes.ErrTryAgainLater), err.(*cnitypes.Error).Code)
+			}
+		})
+	}
+}
+
+func TestARPPackets(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:00:00:10")
+	src, gw := net.ParseIP("192.168.3.10"), net.ParseIP("192.168.3.1")
+	request := marshalARPRequest(mac, src, gw)
+	assert.Equal(t, []byte{
+		0, 1, 8, 0, 6, 4, 0, 1,
+		0x52, 0x54, 0, 0, 0, 0x10, 192, 168, 3, 10,
+		0, 0, 0, 0, 0, 0, 192, 168, 3, 1,
+	}, request)
+	assert.False(t, isARPReply(request, src, gw))
+
+	reply := []byte{
+		0, 1, 8, 0, 6, 4, 0, 2,
+		0x52, 0x54, 0, 0, 0, 0x01, 192, 168, 3, 1,
+		0x52, 0x54, 0, 0, 0, 0x10, 192, 168, 3, 10,
+	}
+	assert.True(t, isARPReply(reply, src, gw))
+	assert.False(t, isARPReply(reply, src, net.ParseIP("192.168.3.2")))
+	assert.False(t, isARPReply(reply, net.ParseIP("192.168.3.11"), gw))
+	assert.False(t, isARPReply(reply[:20], src, gw))
+}
+
+func TestGatewayResolved(t *testing.T) {
+	mockNetLinkOps := new(util_mocks.NetLinkOps)
+	util.SetNetLinkOpMockInst(mockNetLinkOps)
+
+	link := &netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: "net1", Index: 2}}
+	gw := net.ParseIP("fd00::1")
+	mac, _ := net.ParseMAC("52:54:00:00:00:01")
+
+	tests := []struct {
+		desc     string
+		neighs   []netlink.Neigh
+		resolved bool
+		state    int
+	}{
+		{
+			desc:   "no entry",
+			neighs: []netlink.Neigh{{IP: net.ParseIP("fd00::2"), HardwareAddr: mac, State: netlink.NUD_REACHABLE}},
+		},
+		{
+			desc:   "resolution in progress",
+			neighs: []netlink.Neigh{{IP: gw, State: netlink.NUD_INCOMPLETE}},
+			state:  netlink.NUD_INCOMPLETE,
+		},
+		{
+			desc:   "resolution failed",
+			neighs: []netlink.Neigh{{IP: gw, State: netlink.NUD_FAILED}},
+			state:  netlink.NUD_FAILED,
+		},
+		{
+			desc:     "resolved",
+			neighs:   []netlink.Neigh{{IP: gw, HardwareAddr: mac, State: netlink.NUD_REACHABLE}},
+			resolved: true,
+			state:    netlink.NUD_REACHABLE,
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			mockNetLinkOps.On("NeighList", 2, netlink.FAMILY_V6).Return(tc.neighs, nil).Once()
+			resolved, state, err := gatewayResolved(link, gw)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.resolved, resolved)
+			assert.Equal(t, tc.state, state)
+			mockNetLinkOps.AssertExpectations(t)
+		})
+	}
+}
+
+func TestGatewayProbeTimeout(t *testing.T) {
+	timeout, err := gatewayProbeTimeout(&types.GatewayProbe{})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultGatewayProbeTimeout, timeout)
+
+	timeout, err = gatewayProbeTimeout(&types.GatewayProbe{Timeout: "1500ms"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1500*time.Millisecond, timeout)
+
+	_, err = gatewayProbeTimeout(&types.GatewayProbe{Timeout: "-1s"})
+	assert.EqualError(t, err, "timeout -1s is not positive")
+}
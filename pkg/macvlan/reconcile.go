@@ -0,0 +1,168 @@
+package macvlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/vishvananda/netlink"
+	"sigs.k8s.io/knftables"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+	"github.com/openshift/egress-router-cni/pkg/util"
+)
+
+// Reconciler keeps the egress_cni table of a running egress router pod in sync
+// with the ipConfig ConfigMap of its network configuration, so that destinations
+// can be changed without recreating the pod. Addresses and gateways are not
+// reconciled. It must be used inside the pod network namespace.
+type Reconciler struct {
+	conf          *types.NetConf
+	podName       string
+	clusterIfName string
+	ifName        string
+	snatAddresses []net.IP
+	nft           knftables.Interface
+	// applied holds the destinations of the last ruleset applied by the Reconciler
+	applied []destination
+}
+
+// NewReconciler returns a Reconciler for the egress interface ifName of the pod
+// podNamespace/podName, configured by conf. The DNAT rules apply to traffic
+// received on clusterIfName, unless conf sets clusterInterface.
+func NewReconciler(conf *types.NetConf, podNamespace, podName, ifName, clusterIfName string) (*Reconciler, error) {
+	nft, err := knftables.New(egressTableFamily, egressTableName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get NFTables: %v", err)
+	}
+	return newReconciler(conf, podNamespace, podName, ifName, clusterIfName, nft)
+}
+
+func newReconciler(conf *types.NetConf, podNamespace, podName, ifName, clusterIfName string, nft knftables.Interface) (*Reconciler, error) {
+	if conf.IPConfig == nil || conf.IPConfig.Name == "" {
+		return nil, fmt.Errorf("the configuration does not reference an ipConfig ConfigMap")
+	}
+	if conf.Mode != "" && conf.Mode != types.ModeRedirect {
+		return nil, fmt.Errorf("the %s mode has no rules to reconcile", conf.Mode)
+	}
+	if conf.IPConfig.Namespace == "" {
+		conf.IPConfig.Namespace = podNamespace
+	}
+
+	// Unlike in ADD, the cluster interface cannot be found from the default
+	// route, which ADD may have removed
+	if conf.ClusterInterface != "" {
+		clusterIfName = conf.ClusterInterface
+	}
+	if clusterIfName == "" {
+		return nil, fmt.Errorf("the cluster interface is unknown, set clusterInterface")
+	}
+
+	// Start from the rules installed by ADD or by a previous run of the agent, so
+	// that the first update flushes the connections of the destinations it changes
+	installed, err := installedDestinations(context.Background(), nft)
+	if err != nil {
+		return nil, err
+	}
+	snatAddresses, err := installedSNATAddresses(context.Background(), nft, ifName)
+	if err != nil {
+		return nil, err
+	}
+	return &Reconciler{
+		conf:          conf,
+		podName:       podName,
+		clusterIfName: clusterIfName,
+		ifName:        ifName,
+		snatAddresses: snatAddresses,
+		nft:           nft,
+		applied:       installed,
+	}, nil
+}
+
+// installedSNATAddresses returns the SNAT sources of the rules installed by ADD.
+// Without them, it picks the SNAT sources among the addresses of ifName like
+// ADD does, the first address of each IP family.
+func installedSNATAddresses(ctx context.Context, nft knftables.Interface, ifName string) ([]net.IP, error) {
+	rules, err := nft.ListRules(ctx, "postrouting")
+	if err != nil && !knftables.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to list rules in nftables chain %q: %v", "postrouting", err)
+	}
+	var addresses []net.IP
+	for _, rule := range rules {
+		if addr, ok := strings.CutPrefix(ruleComment(rule), "snat "); ok {
+			if ip := net.ParseIP(addr); ip != nil {
+				addresses = append(addresses, ip)
+			}
+		}
+	}
+	if len(addresses) > 0 {
+		return addresses, nil
+	}
+
+	link, err := util.GetNetLinkOps().LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find egress interface %q: %v", ifName, err)
+	}
+	addrs, err := util.GetNetLinkOps().AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %q: %v", ifName, err)
+	}
+	var ips []*current.IPConfig
+	for _, a := range addrs {
+		if a.IP.IsGlobalUnicast() {
+			ips = append(ips, &current.IPConfig{Address: *a.IPNet})
+		}
+	}
+	for _, ipc := range firstOfEachFamily(ips) {
+		addresses = append(addresses, ipc.Address.IP)
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no egress address on %q", ifName)
+	}
+	return addresses, nil
+}
+
+// ConfigMap returns the namespace and name of the ipConfig ConfigMap.
+func (r *Reconciler) ConfigMap() (string, string) {
+	return r.conf.IPConfig.Namespace, r.conf.IPConfig.Name
+}
+
+// Apply replaces the egress_cni table with the ruleset for data, the content of
+// the ipConfig ConfigMap, in a single transaction. The table is left unchanged if
+// data is invalid. Connections DNATed to destinations that were removed or
+// changed are then dropped from conntrack.
+func (r *Reconciler) Apply(ctx context.Context, data map[string]string) error {
+	cmIP, cmPodIP, err := parseIPConfigMap(r.conf.IPConfig, data)
+	if err != nil {
+		return err
+	}
+	n := *r.conf
+	if n.IP, err = effectiveIP(r.conf, cmIP, cmPodIP, r.podName); err != nil {
+		return err
+	}
+	allowedDestinations, err := destinations(&n)
+	if err != nil {
+		return err
+	}
+	filter, err := parseFilter(n.Filter)
+	if err != nil {
+		return fmt.Errorf("invalid filter: %v", err)
+	}
+
+	tx := r.nft.NewTransaction()
+	generateEgressNFTablesRules(tx, r.clusterIfName, r.ifName, r.snatAddresses, allowedDestinations, filter)
+	if err := r.nft.Run(ctx, tx); err != nil {
+		return fmt.Errorf("failed to set nftables rules: %v", err)
+	}
+	logging.Verbosef("Applied %d destinations from ConfigMap %s/%s", len(allowedDestinations), r.conf.IPConfig.Namespace, r.conf.IPConfig.Name)
+
+	stale := staleDestinations(r.applied, allowedDestinations)
+	r.applied = allowedDestinations
+	if len(stale) > 0 {
+		return flushConntrack(stale)
+	}
+	return nil
+}
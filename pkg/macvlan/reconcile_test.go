@@ -0,0 +1,148 @@
+package macvlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/vishvananda/netlink"
+	"sigs.k8s.io/knftables"
+
+	"github.com/openshift/egress-router-cni/pkg/types"
+	util "github.com/openshift/egress-router-cni/pkg/util"
+	util_mocks "github.com/openshift/egress-router-cni/pkg/util/mocks"
+)
+
+func TestReconcilerApply(t *testing.T) {
+	mockNetLinkOps := new(util_mocks.NetLinkOps)
+	util.SetNetLinkOpMockInst(mockNetLinkOps)
+
+	fake := knftables.NewFake(egressTableFamily, egressTableName)
+	r := &Reconciler{
+		conf: &types.NetConf{
+			IPConfig: &types.IPConfig{Namespace: "egress", Name: "egress-router"},
+		},
+		podName:       "egress-router-0",
+		clusterIfName: "eth0",
+		ifName:        "net1",
+		snatAddresses: []net.IP{net.ParseIP("192.168.3.10")},
+		nft:           fake,
+	}
+	elements := func() []string {
+		var comments []string
+		if m := fake.Table.Maps["dnat-ipv4"]; m != nil {
+			for _, e := range m.Elements {
+				comments = append(comments, *e.Comment)
+			}
+		}
+		return comments
+	}
+
+	// The first ruleset has nothing to flush
+	err := r.Apply(context.Background(), map[string]string{
+		"ip": `{"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1", "destinations": ["80 tcp 10.100.3.1", "8443 tcp 203.0.113.27 443"]}`,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"80 tcp 10.100.3.1", "8443 tcp 203.0.113.27 443"}, elements())
+	mockNetLinkOps.AssertNotCalled(t, "ConntrackDeleteFilter", mock.Anything, mock.Anything, mock.Anything)
+
+	// Changing a target flushes the connections DNATed to the previous one
+	mockNetLinkOps.On("ConntrackDeleteFilter", netlink.ConntrackTableType(netlink.ConntrackTable), netlink.InetFamily(netlink.FAMILY_V4), mock.AnythingOfType("*macvlan.staleConntrackFilter")).Return(uint(1), nil).Once()
+	err = r.Apply(context.Background(), map[string]string{
+		"podIP": `{"egress-router-0": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1", "destinations": ["80 tcp 10.100.3.1", "8443 tcp 203.0.113.28 443"]}}`,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"80 tcp 10.100.3.1", "8443 tcp 203.0.113.28 443"}, elements())
+	mockNetLinkOps.AssertExpectations(t)
+	filter := mockNetLinkOps.Calls[0].Arguments.Get(2).(*staleConntrackFilter)
+	assert.Equal(t, mustParseDestinations(t, "8443 tcp 203.0.113.27 443"), filter.stale)
+
+	// An invalid ConfigMap leaves the rules in place
+	err = r.Apply(context.Background(), map[string]string{
+		"ip": `{"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1", "destinations": ["80 icmp 10.100.3.1"]}`,
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"80 tcp 10.100.3.1", "8443 tcp 203.0.113.28 443"}, elements())
+
+	err = r.Apply(context.Background(), map[string]string{
+		"podIP": `{"egress-router-1": {"addresses": ["192.168.3.11/24"]}}`,
+	})
+	assert.EqualError(t, err, "ConfigMap egress/egress-router has no 'podIP' entry for pod \"egress-router-0\"")
+}
+
+func TestNewReconciler(t *testing.T) {
+	mockNetLinkOps := new(util_mocks.NetLinkOps)
+	util.SetNetLinkOpMockInst(mockNetLinkOps)
+
+	link := &netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: "net1", Index: 2}}
+	addr := func(s string) netlink.Addr {
+		ip, ipNet, _ := net.ParseCIDR(s)
+		ipNet.IP = ip
+		return netlink.Addr{IPNet: ipNet}
+	}
+
+	tests := []struct {
+		desc             string
+		clusterInterface string
+		installed        []string
+		linkAddrs        []netlink.Addr
+		clusterIfName    string
+		snatAddresses    []net.IP
+	}{
+		{
+			// ADD removed the default route of the cluster interface, which must not be looked up
+			desc:          "cluster interface without default route",
+			installed:     []string{"192.168.3.10"},
+			clusterIfName: "eth0",
+			snatAddresses: []net.IP{net.ParseIP("192.168.3.10")},
+		},
+		{
+			desc:             "cluster interface configured",
+			clusterInterface: "eth1",
+			installed:        []string{"192.168.3.10"},
+			clusterIfName:    "eth1",
+			snatAddresses:    []net.IP{net.ParseIP("192.168.3.10")},
+		},
+		{
+			desc:          "two addresses in one family, SNAT rules installed by ADD",
+			installed:     []string{"192.168.3.11", "fd00::10"},
+			clusterIfName: "eth0",
+			snatAddresses: []net.IP{net.ParseIP("192.168.3.11"), net.ParseIP("fd00::10")},
+		},
+		{
+			desc:          "two addresses in one family, no SNAT rules",
+			linkAddrs:     []netlink.Addr{addr("192.168.3.10/24"), addr("192.168.3.11/24"), addr("fe80::1/64"), addr("fd00::10/64")},
+			clusterIfName: "eth0",
+			snatAddresses: []net.IP{net.ParseIP("192.168.3.10"), net.ParseIP("fd00::10")},
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			fake := knftables.NewFake(egressTableFamily, egressTableName)
+			if tc.installed != nil {
+				var addresses []net.IP
+				for _, a := range tc.installed {
+					addresses = append(addresses, net.ParseIP(a))
+				}
+				tx := fake.NewTransaction()
+				generateEgressNFTablesRules(tx, "eth0", "net1", addresses, nil, nil)
+				assert.NoError(t, fake.Run(context.Background(), tx))
+			} else {
+				mockNetLinkOps.On("LinkByName", "net1").Return(link, nil).Once()
+				mockNetLinkOps.On("AddrList", link, netlink.FAMILY_ALL).Return(tc.linkAddrs, nil).Once()
+			}
+
+			conf := &types.NetConf{ClusterInterface: tc.clusterInterface, IPConfig: &types.IPConfig{Name: "egress-router"}}
+			r, err := newReconciler(conf, "egress", "egress-router-0", "net1", "eth0", fake)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tc.clusterIfName, r.clusterIfName)
+			assert.Equal(t, tc.snatAddresses, r.snatAddresses)
+			mockNetLinkOps.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package macvlan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"sigs.k8s.io/knftables"
+
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+// Plan describes the changes ADD would make in the container network namespace.
+type Plan struct {
+	Interface PlanInterface `json:"interface"`
+	Addresses []string      `json:"addresses"`
+	Routes    []PlanRoute   `json:"routes"`
+	// DeletedRoutes are the default routes of the cluster interface that the
+	// egress routes replace
+	DeletedRoutes []PlanRoute `json:"deletedRoutes,omitempty"`
+	// Rules are the policy routing rules, as "ip rule" lists them
+	Rules   []string          `json:"rules,omitempty"`
+	Sysctls map[string]string `json:"sysctls"`
+	// RulesetHash is the hash of the egress_cni ruleset, as published in the
+	// status annotation of the pod
+	RulesetHash string `json:"rulesetHash"`
+	// Ruleset is the egress_cni ruleset in nft syntax
+	Ruleset string `json:"ruleset,omitempty"`
+}
+
+// PlanInterface is the egress interface created by ADD.
+type PlanInterface struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Master is empty if the interface of the default route of the node is used
+	Master string `json:"master,omitempty"`
+	Mode   string `json:"mode"`
+	// MTU is empty if the MTU of the master is used
+	MTU string `json:"mtu,omitempty"`
+}
+
+// PlanRoute is a route of the Plan.
+type PlanRoute struct {
+	Destination string `json:"destination"`
+	Gateway     string `json:"gateway,omitempty"`
+	Device      string `json:"device"`
+	Table       int    `json:"table,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// RenderOptions provides what Render cannot learn from the configuration.
+type RenderOptions struct {
+	// IfName is the name of the egress interface, CNI_IFNAME
+	IfName string
+	// ClusterInterface is the cluster interface of the pod, used unless the
+	// configuration sets clusterInterface
+	ClusterInterface string
+	// PodName selects the podIP entries, like K8S_POD_NAME
+	PodName string
+	// IPConfigData is the data of the ipConfig ConfigMap, if the configuration
+	// references one
+	IPConfigData map[string]string
+}
+
+// Render computes the changes ADD would make for the network configuration data,
+// without touching the network or the API server. The ruleset is generated by
+// the same code as ADD, into a fake nftables table.
+func Render(data []byte, opts RenderOptions) (*Plan, error) {
+	if problems := Validate(data); len(problems) > 0 {
+		lines := make([]string, 0, len(problems))
+		for _, p := range problems {
+			lines = append(lines, p.String())
+		}
+		return nil, fmt.Errorf("invalid configuration:\n%s", strings.Join(lines, "\n"))
+	}
+	n := &types.NetConf{}
+	if err := json.Unmarshal(data, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if err := fillInterfaceDefaults(n, ""); err != nil {
+		return nil, err
+	}
+	plan := &Plan{
+		Interface: PlanInterface{
+			Name:   opts.IfName,
+			Type:   n.InterfaceType,
+			Master: n.InterfaceArgs["master"],
+			Mode:   n.InterfaceArgs["mode"],
+			MTU:    n.InterfaceArgs["mtu"],
+		},
+		Sysctls: map[string]string{},
+	}
+	if n.Mode == types.ModeHTTPProxy {
+		if err := fillHTTPProxyDefaults(n); err != nil {
+			return nil, fmt.Errorf("invalid httpProxy: %v", err)
+		}
+	}
+	if n.PolicyRouting != nil {
+		if err := fillPolicyRoutingDefaults(n.PolicyRouting); err != nil {
+			return nil, fmt.Errorf("invalid policyRouting: %v", err)
+		}
+	}
+
+	if n.IPAM.Type != "" {
+		return nil, fmt.Errorf("the addresses are assigned by the %q IPAM plugin and cannot be rendered", n.IPAM.Type)
+	}
+	var err error
+	if n.IP, err = EffectiveIP(n, opts.PodName, opts.IPConfigData); err != nil {
+		return nil, err
+	}
+	ips, err := staticIPConfigs(n.IP)
+	if err != nil {
+		return nil, err
+	}
+	families, err := egressFamilies(ips, n.IP)
+	if err != nil {
+		return nil, err
+	}
+	allowedDestinations, err := destinations(n)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := parseFilter(n.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter: %v", err)
+	}
+	clusterIfName := n.ClusterInterface
+	if clusterIfName == "" {
+		clusterIfName = opts.ClusterInterface
+	}
+
+	for _, ipc := range ips {
+		plan.Addresses = append(plan.Addresses, ipc.Address.String())
+	}
+
+	// Stand-in links, so that routes and rules come from the same code as ADD
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: opts.IfName, Index: 1}}
+	clusterLink := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: clusterIfName, Index: 2}}
+	devices := map[int]string{1: opts.IfName, 2: clusterIfName}
+	plan.Sysctls[fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, opts.IfName)] = "1"
+	for _, f := range families {
+		plan.Sysctls[ipForwardSysctl(f.isIPv6)] = "1"
+		if f.isIPv6 {
+			plan.Sysctls[fmt.Sprintf(DisableIPv6SysctlTemplate, "lo")] = "0"
+			plan.Sysctls[fmt.Sprintf(DisableIPv6SysctlTemplate, opts.IfName)] = "0"
+		}
+
+		var routes []netlink.Route
+		if n.PolicyRouting != nil {
+			if routes, err = policyRoutes(n.PolicyRouting, link, clusterLink, f, nil); err != nil {
+				return nil, fmt.Errorf("invalid policyRouting: %v", err)
+			}
+			for _, rule := range policyRules(n.PolicyRouting, clusterLink, f) {
+				plan.Rules = append(plan.Rules, describeRule(rule))
+			}
+		} else {
+			routes = egressRoutes(link, f)
+			plan.DeletedRoutes = append(plan.DeletedRoutes, PlanRoute{Destination: defaultDestination(f.isIPv6), Device: clusterIfName})
+		}
+		for _, r := range routes {
+			route := planRoute(r, devices, f.isIPv6)
+			if r.LinkIndex == clusterLink.Index && r.Dst != nil {
+				// ADD routes the cluster CIDRs via the gateway of the original
+				// default route of the cluster interface, which is not known here
+				route.Gateway = fmt.Sprintf("<default gateway of %s>", clusterIfName)
+				route.Scope = ""
+			}
+			plan.Routes = append(plan.Routes, route)
+		}
+	}
+
+	fake := knftables.NewFake(egressTableFamily, egressTableName)
+	tx := fake.NewTransaction()
+	generateEgressNFTablesRules(tx, clusterIfName, opts.IfName, snatAddresses(families), allowedDestinations, filter)
+	plan.RulesetHash = rulesetHash(tx.String())
+	if err := fake.Run(context.Background(), tx); err != nil {
+		return nil, fmt.Errorf("failed to render nftables rules: %v", err)
+	}
+	plan.Ruleset = fake.Dump()
+	return plan, nil
+}
+
+// planRoute describes r, whose link index is a key of devices.
+func planRoute(r netlink.Route, devices map[int]string, isIPv6 bool) PlanRoute {
+	route := PlanRoute{Destination: defaultDestination(isIPv6), Device: devices[r.LinkIndex], Table: r.Table}
+	if r.Dst != nil {
+		route.Destination = r.Dst.String()
+	}
+	if r.Gw != nil {
+		route.Gateway = r.Gw.String()
+	}
+	if r.Scope == netlink.SCOPE_LINK {
+		route.Scope = "link"
+	}
+	return route
+}
+
+// defaultDestination returns the destination of the default route of a family.
+func defaultDestination(isIPv6 bool) string {
+	if isIPv6 {
+		return "::/0"
+	}
+	return "0.0.0.0/0"
+}
@@ -0,0 +1,100 @@
+package macvlan
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRender(t *testing.T) {
+	opts := RenderOptions{IfName: "net1", ClusterInterface: "eth0", PodName: "router-1"}
+
+	t.Run("redirect", func(t *testing.T) {
+		plan, err := Render([]byte(`{"interfaceType": "ipvlan", "interfaceArgs": {"master": "eth1", "mtu": "1400"}, "ip": {"addresses": ["192.168.3.10/24", "fd00::10/64"], "gateway": "192.168.3.1", "gateways": ["fd00::1"], "destinations": ["80 tcp 10.100.3.1", "10.100.3.2"]}}`), opts)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, PlanInterface{Name: "net1", Type: "ipvlan", Master: "eth1", Mode: "l2", MTU: "1400"}, plan.Interface)
+		assert.Equal(t, []string{"192.168.3.10/24", "fd00::10/64"}, plan.Addresses)
+		assert.Equal(t, []PlanRoute{
+			{Destination: "192.168.3.1/32", Device: "net1"},
+			{Destination: "0.0.0.0/0", Gateway: "192.168.3.1", Device: "net1"},
+			{Destination: "fd00::1/128", Device: "net1"},
+			{Destination: "::/0", Gateway: "fd00::1", Device: "net1"},
+		}, plan.Routes)
+		assert.Equal(t, []PlanRoute{{Destination: "0.0.0.0/0", Device: "eth0"}, {Destination: "::/0", Device: "eth0"}}, plan.DeletedRoutes)
+		assert.Empty(t, plan.Rules)
+		assert.Equal(t, map[string]string{
+			"net.ipv4.conf.net1.proxy_arp":    "1",
+			"net.ipv4.ip_forward":             "1",
+			"net.ipv6.conf.all.forwarding":    "1",
+			"net.ipv6.conf.lo.disable_ipv6":   "0",
+			"net.ipv6.conf.net1.disable_ipv6": "0",
+		}, plan.Sysctls)
+		assert.True(t, strings.HasPrefix(plan.RulesetHash, "sha256:"))
+		for _, rule := range []string{
+			"add rule inet egress_cni prerouting iif eth0 meta nfproto ipv4 dnat ip addr . port to meta l4proto . th dport map @dnat-ipv4 comment \"dnat-ipv4\"\n",
+			"add rule inet egress_cni prerouting iif eth0 dnat ip to 10.100.3.2 comment \"10.100.3.2\"\n",
+			"add rule inet egress_cni postrouting oif net1 snat ip6 to fd00::10 comment \"snat fd00::10\"\n",
+			"add rule inet egress_cni count meta nfproto ipv4 ct status dnat meta l4proto tcp ct original proto-dst 80 counter return comment \"80 tcp 10.100.3.1\"\n",
+			"add element inet egress_cni dnat-ipv4 { tcp . 80 comment \"80 tcp 10.100.3.1\" : 10.100.3.1 . 80 }\n",
+		} {
+			assert.Contains(t, plan.Ruleset, rule)
+		}
+	})
+
+	t.Run("policy routing with ConfigMap", func(t *testing.T) {
+		withConfigMap := opts
+		withConfigMap.IPConfigData = map[string]string{"podIP": `{"router-1": {"addresses": ["192.168.3.11/24"], "gateway": "192.168.3.1", "destinations": ["10.100.3.2"]}}`}
+		plan, err := Render([]byte(`{"clusterInterface": "ens3", "ipConfig": {"name": "egress"}, "policyRouting": {"clusterCIDRs": ["10.128.0.0/14"]}}`), withConfigMap)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, []string{"192.168.3.11/24"}, plan.Addresses)
+		assert.Equal(t, []PlanRoute{
+			{Destination: "192.168.3.1/32", Device: "net1", Table: 100, Scope: "link"},
+			{Destination: "0.0.0.0/0", Gateway: "192.168.3.1", Device: "net1", Table: 100},
+			{Destination: "10.128.0.0/14", Gateway: "<default gateway of ens3>", Device: "ens3", Table: 100},
+		}, plan.Routes)
+		assert.Empty(t, plan.DeletedRoutes)
+		assert.Equal(t, []string{"ip rule 1000: from all iif ens3 lookup 100", "ip rule 1000: from 192.168.3.11/32 lookup 100"}, plan.Rules)
+		assert.Contains(t, plan.Ruleset, "add rule inet egress_cni prerouting iif ens3 dnat ip to 10.100.3.2 comment \"10.100.3.2\"\n")
+	})
+
+	tests := []struct {
+		desc     string
+		conf     string
+		errMatch string
+	}{
+		{
+			desc:     "invalid configuration",
+			conf:     `{"mode": "socks", "ip": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.4.1"}}`,
+			errMatch: "invalid configuration:\n/mode: unsupported mode \"socks\"\n/ip/gateway: gateway 192.168.4.1 is not in the subnet of any IPv4 address",
+		},
+		{
+			desc:     "IPAM",
+			conf:     `{"ipam": {"type": "whereabouts"}}`,
+			errMatch: "the addresses are assigned by the \"whereabouts\" IPAM plugin and cannot be rendered",
+		},
+		{
+			desc:     "missing ConfigMap",
+			conf:     `{"ipConfig": {"name": "egress"}}`,
+			errMatch: "the IP configuration is read from ConfigMap \"egress\", whose content must be provided",
+		},
+		{
+			desc:     "missing pod entry",
+			conf:     `{"podIP": {"router-0": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1"}}}`,
+			errMatch: "no IP addresses configured: 'podIP' has no entry for pod \"router-1\"",
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			_, err := Render([]byte(tc.conf), opts)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.errMatch)
+			}
+		})
+	}
+}
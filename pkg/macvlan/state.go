@@ -0,0 +1,121 @@
+package macvlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+)
+
+// stateDir holds one state file per attachment, recording what ADD changed in the
+// container network namespace so that DEL can put it back.
+var stateDir = "/var/lib/cni/egress-router"
+
+// savedRoute is a default route removed by ADD.
+type savedRoute struct {
+	Interface string `json:"interface"`
+	Gateway   string `json:"gateway"`
+	Priority  int    `json:"priority,omitempty"`
+	Table     int    `json:"table,omitempty"`
+}
+
+// egressState is the content of an attachment state file.
+type egressState struct {
+	// ClusterInterface is the cluster-facing interface used by ADD.
+	ClusterInterface string `json:"clusterInterface,omitempty"`
+	// DefaultRoutes are the default routes deleted from the cluster-side interface.
+	DefaultRoutes []savedRoute `json:"defaultRoutes,omitempty"`
+	// Sysctls maps the sysctls set by ADD to their original value.
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+	// PolicyTable is the routing table populated by ADD in policy routing mode.
+	PolicyTable int `json:"policyTable,omitempty"`
+}
+
+func stateFile(containerID, ifName string) string {
+	return filepath.Join(stateDir, fmt.Sprintf("%s-%s.json", containerID, ifName))
+}
+
+// saveState atomically writes the state file of the attachment.
+func saveState(containerID, ifName string, state *egressState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+	path := stateFile(containerID, ifName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadState reads the state file of the attachment. It returns nil without an
+// error if ADD never got as far as writing one.
+func loadState(containerID, ifName string) (*egressState, error) {
+	data, err := os.ReadFile(stateFile(containerID, ifName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	state := &egressState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// removeState deletes the state file of the attachment, if any.
+func removeState(containerID, ifName string) error {
+	if err := os.Remove(stateFile(containerID, ifName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// restoreState undoes the changes recorded in state. It must be called inside the
+// container network namespace. Routes whose interface no longer exists are skipped.
+func restoreState(state *egressState) error {
+	if state.PolicyTable != 0 {
+		if err := deletePolicyRouting(state.PolicyTable); err != nil {
+			return err
+		}
+		logging.Debugf("Deleted policy routing table %d", state.PolicyTable)
+	}
+
+	for name, value := range state.Sysctls {
+		if _, err := sysctl.Sysctl(name, value); err != nil {
+			return fmt.Errorf("failed to restore sysctl %s to %q: %v", name, value, err)
+		}
+		logging.Debugf("Restored sysctl %s to %q", name, value)
+	}
+
+	for _, r := range state.DefaultRoutes {
+		link, err := netlink.LinkByName(r.Interface)
+		if err != nil {
+			logging.Debugf("Not restoring default route via %s: interface %q not found", r.Gateway, r.Interface)
+			continue
+		}
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Gw:        net.ParseIP(r.Gateway),
+			Priority:  r.Priority,
+			Table:     r.Table,
+		}
+		if err := netlink.RouteAdd(route); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to restore default route via %s dev %s: %v", r.Gateway, r.Interface, err)
+		}
+		logging.Debugf("Restored default route via %s dev %s", r.Gateway, r.Interface)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package macvlan
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	stateDir = t.TempDir()
+
+	state, err := loadState("container", "net1")
+	assert.NoError(t, err)
+	assert.Nil(t, state, "missing state file must not be an error")
+
+	saved := &egressState{
+		DefaultRoutes: []savedRoute{{Interface: "eth0", Gateway: "10.128.0.1", Table: 254}},
+		Sysctls:       map[string]string{"net.ipv4.ip_forward": "0"},
+	}
+	assert.NoError(t, saveState("container", "net1", saved))
+
+	state, err = loadState("container", "net1")
+	assert.NoError(t, err)
+	assert.Equal(t, saved, state)
+
+	assert.NoError(t, removeState("container", "net1"))
+	assert.NoError(t, removeState("container", "net1"), "removing twice must be idempotent")
+
+	state, err = loadState("container", "net1")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+}
@@ -0,0 +1,114 @@
+package macvlan
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+// statusTimeout bounds the time spent patching the status annotation.
+const statusTimeout = 5 * time.Second
+
+// patchPod applies a JSON merge patch to a pod.
+var patchPod = func(ctx context.Context, namespace, name string, patch []byte) error {
+	clientset, err := kubeClient()
+	if err != nil {
+		return err
+	}
+	_, err = clientset.CoreV1().Pods(namespace).Patch(ctx, name, k8stypes.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// rulesetHash returns the hash of a rendered nftables ruleset.
+func rulesetHash(ruleset string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(ruleset)))
+}
+
+// egressStatus returns the Status of the egress interface iface configured by
+// ADD. The effective IP configuration is n.IP, with the addresses and gateways
+// replaced by the ones actually assigned, which may come from IPAM.
+func egressStatus(n *types.NetConf, iface *current.Interface, ips []*current.IPConfig, families []egressFamily, ruleset string) *types.Status {
+	effective := types.IP{}
+	if n.IP != nil {
+		effective = *n.IP
+	}
+	effective.Addresses = nil
+	for _, ipc := range ips {
+		effective.Addresses = append(effective.Addresses, ipc.Address.String())
+	}
+	effective.Gateway, effective.Gateways = "", nil
+	for i, f := range families {
+		if i == 0 {
+			effective.Gateway = f.gateway.String()
+		} else {
+			effective.Gateways = append(effective.Gateways, f.gateway.String())
+		}
+	}
+	return &types.Status{
+		IP:          &effective,
+		MAC:         iface.Mac,
+		Master:      n.InterfaceArgs["master"],
+		RulesetHash: rulesetHash(ruleset),
+	}
+}
+
+// annotateStatus sets the status annotation of the pod of the invocation to
+// status, or removes it if status is nil. It does nothing unless n enables the
+// annotation. Failures are logged and never fail the invocation; a missing pod
+// is not a failure on removal.
+func annotateStatus(n *types.NetConf, args *skel.CmdArgs, status *types.Status) {
+	if !n.StatusAnnotation {
+		return
+	}
+	k8sArgs := &types.K8sArgs{CommonArgs: cnitypes.CommonArgs{IgnoreUnknown: true}}
+	if err := cnitypes.LoadArgs(args.Args, k8sArgs); err != nil || k8sArgs.K8S_POD_NAMESPACE == "" || k8sArgs.K8S_POD_NAME == "" {
+		logging.Debugf("Not annotating the pod: no pod in CNI_ARGS")
+		return
+	}
+	namespace, name := string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME)
+
+	// A null value removes the annotation in a JSON merge patch
+	var value *string
+	if status != nil {
+		data, err := json.Marshal(status)
+		if err != nil {
+			logging.Errorf("failed to encode the status of pod %s/%s: %v", namespace, name, err)
+			return
+		}
+		s := string(data)
+		value = &s
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{types.StatusAnnotation: value},
+		},
+	})
+	if err != nil {
+		logging.Errorf("failed to encode the status patch of pod %s/%s: %v", namespace, name, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+	defer cancel()
+	if err := patchPod(ctx, namespace, name, patch); err != nil {
+		if status == nil && apierrors.IsNotFound(err) {
+			logging.Debugf("Pod %s/%s already removed", namespace, name)
+			return
+		}
+		logging.Errorf("failed to annotate pod %s/%s with its egress status: %v", namespace, name, err)
+		return
+	}
+	logging.Debugf("Annotated pod %s/%s with its egress status", namespace, name)
+}
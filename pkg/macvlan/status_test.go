@@ -0,0 +1,77 @@
+package macvlan
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+func TestEgressStatus(t *testing.T) {
+	n := &types.NetConf{
+		InterfaceArgs: map[string]string{"master": "eth1"},
+		IP:            &types.IP{Destinations: []types.Destination{{Legacy: "80 tcp 10.100.3.1"}}},
+	}
+	iface := &current.Interface{Name: "net1", Mac: "0a:58:0a:00:00:05"}
+	ips := []*current.IPConfig{
+		{Address: net.IPNet{IP: net.ParseIP("192.168.3.10"), Mask: net.CIDRMask(24, 32)}},
+		{Address: net.IPNet{IP: net.ParseIP("fd00::10"), Mask: net.CIDRMask(64, 128)}},
+	}
+	families := []egressFamily{
+		{address: net.ParseIP("192.168.3.10"), gateway: net.ParseIP("192.168.3.1")},
+		{isIPv6: true, address: net.ParseIP("fd00::10"), gateway: net.ParseIP("fd00::1")},
+	}
+
+	status := egressStatus(n, iface, ips, families, "add table inet egress_cni\n")
+	assert.Equal(t, &types.Status{
+		IP: &types.IP{
+			Addresses:    []string{"192.168.3.10/24", "fd00::10/64"},
+			Gateway:      "192.168.3.1",
+			Gateways:     []string{"fd00::1"},
+			Destinations: n.IP.Destinations,
+		},
+		MAC:         "0a:58:0a:00:00:05",
+		Master:      "eth1",
+		RulesetHash: rulesetHash("add table inet egress_cni\n"),
+	}, status)
+	assert.Empty(t, n.IP.Addresses, "the configuration must not be modified")
+	assert.NotEqual(t, status.RulesetHash, rulesetHash("add table inet egress_cni\nflush table inet egress_cni\n"))
+}
+
+func TestAnnotateStatus(t *testing.T) {
+	type patch struct {
+		namespace, name, data string
+	}
+	var patches []patch
+	var patchErr error
+	defer func(f func(context.Context, string, string, []byte) error) { patchPod = f }(patchPod)
+	patchPod = func(_ context.Context, namespace, name string, data []byte) error {
+		patches = append(patches, patch{namespace, name, string(data)})
+		return patchErr
+	}
+
+	args := &skel.CmdArgs{Args: "IgnoreUnknown=1;K8S_POD_NAMESPACE=egress;K8S_POD_NAME=router"}
+	status := &types.Status{IP: &types.IP{Addresses: []string{"192.168.3.10/24"}, Gateway: "192.168.3.1"}, RulesetHash: "sha256:00"}
+
+	annotateStatus(&types.NetConf{}, args, status)
+	assert.Empty(t, patches, "the pod must not be annotated unless enabled")
+
+	n := &types.NetConf{StatusAnnotation: true}
+	annotateStatus(n, &skel.CmdArgs{}, status)
+	assert.Empty(t, patches, "nothing must be patched without a pod")
+
+	annotateStatus(n, args, status)
+	patchErr = apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "router")
+	annotateStatus(n, args, nil)
+	assert.Equal(t, []patch{
+		{"egress", "router", `{"metadata":{"annotations":{"egress-router.openshift.io/status":"{\"ip\":{\"addresses\":[\"192.168.3.10/24\"],\"gateway\":\"192.168.3.1\",\"destinations\":null},\"rulesetHash\":\"sha256:00\"}"}}}`},
+		{"egress", "router", `{"metadata":{"annotations":{"egress-router.openshift.io/status":null}}}`},
+	}, patches)
+}
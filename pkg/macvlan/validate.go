@@ -0,0 +1,292 @@
+package macvlan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/openshift/egress-router-cni/pkg/dnsproxy"
+	"github.com/openshift/egress-router-cni/pkg/httpproxy"
+	"github.com/openshift/egress-router-cni/pkg/logging"
+	"github.com/openshift/egress-router-cni/pkg/types"
+)
+
+// Problem is an error in a network configuration, located by a JSON pointer
+// (RFC 6901) into the configuration. The empty pointer is the whole document.
+type Problem struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.Pointer == "" {
+		return p.Message
+	}
+	return fmt.Sprintf("%s: %s", p.Pointer, p.Message)
+}
+
+// validator collects the problems of a network configuration.
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) addf(pointer, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+}
+
+// pointer appends reference tokens to the JSON pointer base, escaping them.
+func pointer(base string, tokens ...interface{}) string {
+	for _, t := range tokens {
+		s := strings.NewReplacer("~", "~0", "/", "~1").Replace(fmt.Sprint(t))
+		base += "/" + s
+	}
+	return base
+}
+
+// Validate checks the network configuration data the way ADD would, and returns
+// every problem found rather than the first one. It only looks at the
+// configuration: the master interface, the ipConfig ConfigMap and the IPAM
+// result are not available, so the parts of the configuration that depend on
+// them are not checked.
+func Validate(data []byte) []Problem {
+	v := &validator{}
+	n := &types.NetConf{}
+	if err := json.Unmarshal(data, n); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			var tokens []interface{}
+			for _, field := range strings.Split(typeErr.Field, ".") {
+				tokens = append(tokens, field)
+			}
+			v.addf(pointer("", tokens...), "failed to load netconf: %v", err)
+		} else {
+			v.addf("", "failed to load netconf: %v", err)
+		}
+		return v.problems
+	}
+
+	v.validateInterface(n)
+	v.validateLogging(n)
+	v.validateMode(n)
+
+	useIPAM := n.IPAM.Type != ""
+	useConfigMap := n.IPConfig != nil && n.IPConfig.Name != ""
+	if n.IP != nil {
+		v.validateIP(n.IP, "/ip", n.Mode, !useIPAM)
+		if len(n.IP.Addresses) == 0 && n.PodIP == nil && !useConfigMap && !useIPAM {
+			v.addf("/ip/addresses", "no IP addresses configured: neither 'ip', 'podIP', 'ipConfig' nor 'ipam' yield an address")
+		}
+	} else if n.PodIP == nil && !useConfigMap && !useIPAM {
+		v.addf("", "no IP addresses configured: neither 'ip', 'podIP', 'ipConfig' nor 'ipam' yield an address")
+	}
+	names := make([]string, 0, len(n.PodIP))
+	for name := range n.PodIP {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ip := n.PodIP[name]
+		v.validateIP(&ip, pointer("/podIP", name), n.Mode, !useIPAM)
+	}
+	if n.IPConfig != nil && n.IPConfig.Overrides != nil {
+		// Overrides are merged on top of another section, so they need not be complete
+		v.validateIP(n.IPConfig.Overrides, "/ipConfig/overrides", n.Mode, false)
+	}
+
+	if n.Filter != nil {
+		if len(n.Filter.Allow) == 0 {
+			v.addf("/filter/allow", "filter requires at least one allow entry")
+		}
+		parser := &allowParser{}
+		for i, entry := range n.Filter.Allow {
+			if _, err := parser.parse(entry); err != nil {
+				v.addf(pointer("/filter/allow", i), "invalid filter allow entry %q: %v", entry, err)
+			}
+		}
+	}
+
+	if n.GatewayProbe != nil {
+		if _, err := gatewayProbeTimeout(n.GatewayProbe); err != nil {
+			v.addf("/gatewayProbe/timeout", "invalid gatewayProbe: %v", err)
+		}
+		if err := validateGatewayProbeAction(n.GatewayProbe.OnFailure); err != nil {
+			v.addf("/gatewayProbe/onFailure", "invalid gatewayProbe: %v", err)
+		}
+	}
+
+	if n.PolicyRouting != nil {
+		pr := *n.PolicyRouting
+		pr.ClusterCIDRs = nil
+		if err := fillPolicyRoutingDefaults(&pr); err != nil {
+			v.addf("/policyRouting", "invalid policyRouting: %v", err)
+		}
+		for i, cidr := range n.PolicyRouting.ClusterCIDRs {
+			if _, err := parseClusterCIDRs([]string{cidr}); err != nil {
+				v.addf(pointer("/policyRouting/clusterCIDRs", i), "%v", err)
+			}
+		}
+	}
+	return v.problems
+}
+
+// validateInterface checks the interface type and its arguments, with their
+// defaults, as ADD does. The master interface and its MTU are node specific and
+// are not checked.
+func (v *validator) validateInterface(n *types.NetConf) {
+	conf := *n
+	conf.InterfaceArgs = make(map[string]string, len(n.InterfaceArgs))
+	for k, value := range n.InterfaceArgs {
+		conf.InterfaceArgs[k] = value
+	}
+	if err := fillInterfaceDefaults(&conf, ""); err != nil {
+		v.addf("/interfaceType", "%v", err)
+		return
+	}
+	v.problems = append(v.problems, interfaceProblems(&conf)...)
+}
+
+// validateLogging checks the logging and Events settings.
+func (v *validator) validateLogging(n *types.NetConf) {
+	switch logging.Format(n.LogFormat) {
+	case "", logging.TextFormat, logging.JSONFormat:
+	default:
+		v.addf("/log_format", "unsupported log_format %q", n.LogFormat)
+	}
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"log_max_size", n.LogMaxSize},
+		{"log_max_age", n.LogMaxAge},
+		{"log_max_backups", n.LogMaxBackups},
+	} {
+		if limit.value < 0 {
+			v.addf(pointer("", limit.name), "%s must not be negative", limit.name)
+		}
+	}
+	if n.Events != nil {
+		if _, err := eventInterval(n.Events); err != nil {
+			v.addf("/events/interval", "invalid events interval: %v", err)
+		}
+	}
+}
+
+// validateMode checks the egress mode and the configuration of the HTTP proxy.
+func (v *validator) validateMode(n *types.NetConf) {
+	switch n.Mode {
+	case "", types.ModeRedirect, types.ModeDNSProxy:
+	case types.ModeHTTPProxy:
+		if n.HTTPProxy == nil || len(n.HTTPProxy.Allowlist) == 0 {
+			v.addf("/httpProxy/allowlist", "%s mode requires an allowlist", types.ModeHTTPProxy)
+			return
+		}
+		for i, entry := range n.HTTPProxy.Allowlist {
+			if _, err := httpproxy.ParseAllowlist([]string{entry}); err != nil {
+				v.addf(pointer("/httpProxy/allowlist", i), "%v", err)
+			}
+		}
+		if n.HTTPProxy.Port != 0 {
+			if err := validatePort(n.HTTPProxy.Port); err != nil {
+				v.addf("/httpProxy/port", "%v", err)
+			}
+		}
+	default:
+		v.addf("/mode", "unsupported mode %q", n.Mode)
+	}
+}
+
+// validateIP checks an "ip" section located at base with the parsers of ADD, and
+// that each gateway is in the subnet of one of the addresses of its family. If
+// requireGateway is set, every address must have a gateway of its family.
+func (v *validator) validateIP(ip *types.IP, base, mode string, requireGateway bool) {
+	type gateway struct {
+		ptr string
+		ip  net.IP
+	}
+	var parsed []gateway
+	gateways := map[bool]net.IP{}
+	add := func(ptr, g string) {
+		if err := addGateway(gateways, g); err != nil {
+			v.addf(ptr, "%v", err)
+			return
+		}
+		parsed = append(parsed, gateway{ptr: ptr, ip: net.ParseIP(g)})
+	}
+	if ip.Gateway != "" {
+		add(pointer(base, "gateway"), ip.Gateway)
+	}
+	for i, g := range ip.Gateways {
+		add(pointer(base, "gateways", i), g)
+	}
+
+	subnets := map[bool][]*net.IPNet{}
+	for i, address := range ip.Addresses {
+		addr, subnet, err := parseAddress(address)
+		if err == nil {
+			isIPv6 := addr.To4() == nil
+			subnets[isIPv6] = append(subnets[isIPv6], subnet)
+			if requireGateway {
+				_, err = staticIPConfig(address, gateways)
+			}
+		}
+		if err != nil {
+			v.addf(pointer(base, "addresses", i), "%v", err)
+		}
+	}
+
+	for _, gw := range parsed {
+		isIPv6 := gw.ip.To4() == nil
+		if len(subnets[isIPv6]) == 0 || containsIP(subnets[isIPv6], gw.ip) {
+			continue
+		}
+		v.addf(gw.ptr, "gateway %s is not in the subnet of any %s address", gw.ip, ipFamilyName(isIPv6))
+	}
+
+	v.validateDestinations(ip.Destinations, pointer(base, "destinations"), mode)
+}
+
+// containsIP returns whether one of subnets contains ip.
+func containsIP(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateDestinations checks the destinations located at base for mode, with
+// the parsers of ADD and of the DNS proxy.
+func (v *validator) validateDestinations(dests []types.Destination, base, mode string) {
+	var parse func(types.Destination) error
+	switch mode {
+	case "", types.ModeRedirect:
+		parser := newDestinationParser()
+		parse = func(d types.Destination) error {
+			_, err := parser.parse(d)
+			return err
+		}
+	case types.ModeDNSProxy:
+		parser := dnsproxy.NewParser()
+		parse = func(d types.Destination) error {
+			_, err := parser.Parse(d)
+			return err
+		}
+	case types.ModeHTTPProxy:
+		if len(dests) > 0 {
+			v.addf(base, "destinations are not supported in %s mode", mode)
+		}
+		return
+	default:
+		// The mode itself is reported as unsupported
+		return
+	}
+	for i, d := range dests {
+		if err := parse(d); err != nil {
+			v.addf(pointer(base, i), "invalid destination %q: %v", d.String(), err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package macvlan
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		desc string
+		conf string
+		expt []Problem
+	}{
+		{
+			desc: "valid redirect configuration",
+			conf: `{"interfaceType": "macvlan", "interfaceArgs": {"mode": "bridge", "mtu": "1500"}, "ip": {"addresses": ["192.168.3.10/24", "fd00::10/64"], "gateway": "192.168.3.1", "gateways": ["fd00::1"], "destinations": ["80 tcp 10.100.3.1", {"localPort": 80, "protocol": "tcp", "target": "fd00:100::1"}, "10.100.3.2"]}}`,
+		},
+		{
+			desc: "valid IPAM configuration",
+			conf: `{"ipam": {"type": "host-local"}, "ip": {"destinations": ["10.100.3.2"]}}`,
+		},
+		{
+			desc: "valid dns-proxy configuration",
+			conf: `{"mode": "dns-proxy", "ipConfig": {"name": "egress"}, "podIP": {"router-0": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1", "destinations": ["443 www.example.com"]}}}`,
+		},
+		{
+			desc: "undecodable configuration",
+			conf: `{"ip": {"addresses": "192.168.3.10/24"}}`,
+			expt: []Problem{{"/ip/addresses", "failed to load netconf: json: cannot unmarshal string into Go struct field NetConf.ip.addresses of type []string"}},
+		},
+		{
+			desc: "no address",
+			conf: `{}`,
+			expt: []Problem{{"", "no IP addresses configured: neither 'ip', 'podIP', 'ipConfig' nor 'ipam' yield an address"}},
+		},
+		{
+			desc: "interface problems",
+			conf: `{"interfaceType": "ipvlan", "interfaceArgs": {"mode": "bridge", "mtu": "-1"}, "ip": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1"}}`,
+			expt: []Problem{
+				{"/interfaceArgs/mode", `unknown ipvlan mode: "bridge"`},
+				{"/interfaceArgs/mtu", `MTU "-1" is not a positive integer`},
+			},
+		},
+		{
+			desc: "unsupported interface type and mode",
+			conf: `{"interfaceType": "veth", "mode": "socks", "ip": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1", "destinations": ["80 tcp 10.100.3.1"]}}`,
+			expt: []Problem{
+				{"/interfaceType", `unsupported interfaceType "veth"`},
+				{"/mode", `unsupported mode "socks"`},
+			},
+		},
+		{
+			desc: "address and gateway problems",
+			conf: `{"ip": {"addresses": ["192.168.3.300/24", "192.168.3.10/24", "fd00::10/64"], "gateway": "192.168.4.1", "gateways": ["10.0.0.1", "gw"]}}`,
+			expt: []Problem{
+				{"/ip/gateways/0", "more than one IPv4 gateway configured"},
+				{"/ip/gateways/1", `invalid gateway "gw"`},
+				{"/ip/addresses/0", `unable to parse IP address "192.168.3.300/24": invalid CIDR address: 192.168.3.300/24`},
+				{"/ip/addresses/2", `no IPv6 gateway configured for address "fd00::10/64"`},
+				{"/ip/gateway", "gateway 192.168.4.1 is not in the subnet of any IPv4 address"},
+			},
+		},
+		{
+			desc: "gateways outside the subnets of their family",
+			conf: `{"ip": {"addresses": ["192.168.3.10/24", "10.0.0.10/8", "fd00::10/64"], "gateway": "10.1.2.3", "gateways": ["fd00:1::1"]}}`,
+			expt: []Problem{
+				{"/ip/gateways/0", "gateway fd00:1::1 is not in the subnet of any IPv6 address"},
+			},
+		},
+		{
+			desc: "destination problems",
+			conf: `{"ip": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1", "destinations": ["80 tcp 10.100.3.1", "80 tcp 10.100.3.2", "80 icmp 10.100.3.3", {"localPort": 70000, "protocol": "udp", "target": "10.100.3.4"}]}}`,
+			expt: []Problem{
+				{"/ip/destinations/1", `invalid destination "80 tcp 10.100.3.2": local port 80/tcp is already redirected`},
+				{"/ip/destinations/2", `invalid destination "80 icmp 10.100.3.3": unsupported protocol "icmp", must be one of tcp, udp or sctp`},
+				{"/ip/destinations/3", `invalid destination "70000 udp 10.100.3.4": localPort: port 70000 out of range 1-65535`},
+			},
+		},
+		{
+			desc: "pod and override problems",
+			conf: `{"mode": "dns-proxy", "ipConfig": {"name": "egress", "overrides": {"gateway": "192.168.3.1", "destinations": ["53 dns.example.com", "53 other.example.com"]}}, "podIP": {"router/0": {"addresses": ["192.168.3.10/24"]}}}`,
+			expt: []Problem{
+				{"/podIP/router~10/addresses/0", `no IPv4 gateway configured for address "192.168.3.10/24"`},
+				{"/ipConfig/overrides/destinations/1", `invalid destination "53 other.example.com": local port 53 is used more than once`},
+			},
+		},
+		{
+			desc: "http-proxy problems",
+			conf: `{"mode": "http-proxy", "httpProxy": {"port": 99999, "allowlist": ["www.example.com", ""]}, "ip": {"addresses": ["192.168.3.10/24"], "gateway": "192.168.3.1", "destinations": ["10.100.3.1"]}}`,
+			expt: []Problem{
+				{"/httpProxy/allowlist/1", "empty allowlist entry"},
+				{"/httpProxy/port", "port 99999 out of range 1-65535"},
+				{"/ip/destinations", "destinations are not supported in http-proxy mode"},
+			},
+		},
+		{
+			desc: "logging, filter, gateway probe and policy routing problems",
+			conf: `{"log_format": "xml", "log_max_age": -1, "events": {"interval": "often"}, "filter": {"allow": ["10.0.0.0/8", "10.0.0.0/8 icmp 1", "10.1.0.0/16"]}, "gatewayProbe": {"timeout": "0s", "onFailure": "ignore"}, "policyRouting": {"table": 254, "clusterCIDRs": ["10.128.0.0/14", "10.128.0.0"]}, "ipam": {"type": "host-local"}}`,
+			expt: []Problem{
+				{"/log_format", `unsupported log_format "xml"`},
+				{"/log_max_age", "log_max_age must not be negative"},
+				{"/events/interval", `invalid events interval: time: invalid duration "often"`},
+				{"/filter/allow/1", `invalid filter allow entry "10.0.0.0/8 icmp 1": unsupported protocol "icmp", must be one of tcp, udp or sctp`},
+				{"/filter/allow/2", `invalid filter allow entry "10.1.0.0/16": overlaps "10.0.0.0/8"`},
+				{"/gatewayProbe/timeout", "invalid gatewayProbe: timeout 0s is not positive"},
+				{"/gatewayProbe/onFailure", `invalid gatewayProbe: unsupported onFailure "ignore", must be "fail" or "warn"`},
+				{"/policyRouting", "invalid policyRouting: table 254 is reserved"},
+				{"/policyRouting/clusterCIDRs/1", `invalid cluster CIDR "10.128.0.0": invalid CIDR address: 10.128.0.0`},
+			},
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%d:%s", i, tc.desc), func(t *testing.T) {
+			assert.Equal(t, tc.expt, Validate([]byte(tc.conf)))
+		})
+	}
+}
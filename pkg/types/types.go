@@ -1,9 +1,32 @@
 package types
 
 import (
+	"encoding/json"
+	"fmt"
+
 	"github.com/containernetworking/cni/pkg/types"
 )
 
+const (
+	// ModeRedirect redirects traffic received on the cluster interface to the
+	// destinations with DNAT rules
+	ModeRedirect = "redirect"
+	// ModeHTTPProxy leaves egress to the HTTP proxy running in the pod, which
+	// connects to the allowlisted destinations from the egress address
+	ModeHTTPProxy = "http-proxy"
+	// ModeDNSProxy leaves egress to the TCP proxy running in the pod, which
+	// forwards every destination port to the current addresses of a host name
+	ModeDNSProxy = "dns-proxy"
+)
+
+const (
+	// GatewayProbeFail fails ADD when a gateway does not answer the probe
+	GatewayProbeFail = "fail"
+	// GatewayProbeWarn only logs and posts a Warning Event when a gateway does
+	// not answer the probe
+	GatewayProbeWarn = "warn"
+)
+
 // ClusterConf specifies the Cloud Provider in use
 type ClusterConf struct {
 	CloudProvider string `json:"cloudProvider"`
@@ -16,19 +39,113 @@ type NetConf struct {
 	InterfaceType string            `json:"interfaceType"`
 	InterfaceArgs map[string]string `json:"interfaceArgs"`
 
+	// ClusterInterface is the cluster-facing interface of the pod. If empty it
+	// is taken from prevResult or from the default route of the pod
+	ClusterInterface string `json:"clusterInterface,omitempty"`
+
 	IP       *IP           `json:"ip"`
 	PodIP    map[string]IP `json:"podIP"`
 	IPConfig *IPConfig     `json:"ipConfig"`
 
+	// Mode is the egress mode, ModeRedirect if empty
+	Mode string `json:"mode,omitempty"`
+	// HTTPProxy configures the ModeHTTPProxy mode
+	HTTPProxy *HTTPProxy `json:"httpProxy,omitempty"`
+
+	// Filter, when set, restricts the traffic forwarded through the egress
+	// interface to an allowlist
+	Filter *Filter `json:"filter,omitempty"`
+
+	// PolicyRouting, when set, routes egress traffic through a dedicated routing
+	// table instead of replacing the default route of the pod
+	PolicyRouting *PolicyRouting `json:"policyRouting,omitempty"`
+
+	// Events, when set, posts Kubernetes Events against the pod on ADD and DEL
+	Events *Events `json:"events,omitempty"`
+	// GatewayProbe, when set, checks during ADD that the gateways answer ARP or
+	// neighbor discovery on the egress interface
+	GatewayProbe *GatewayProbe `json:"gatewayProbe,omitempty"`
+	// StatusAnnotation, when true, publishes the applied egress configuration in
+	// the StatusAnnotation annotation of the pod
+	StatusAnnotation bool `json:"statusAnnotation,omitempty"`
+
 	LogFile  string `json:"log_file,omitempty"`
 	LogLevel string `json:"log_level.omitempty"`
+	// LogFormat is "text" (the default) or "json"
+	LogFormat string `json:"log_format,omitempty"`
+	// LogMaxSize is the size in megabytes beyond which the log file is rotated
+	LogMaxSize int `json:"log_max_size,omitempty"`
+	// LogMaxAge is the number of days after which the log file is rotated and
+	// rotated log files are deleted
+	LogMaxAge int `json:"log_max_age,omitempty"`
+	// LogMaxBackups is the number of rotated log files kept
+	LogMaxBackups int `json:"log_max_backups,omitempty"`
 }
 
 // IP sets the config for the Egress Router CNI pod
 type IP struct {
-	Addresses    []string `json:"addresses"`
-	Gateway      string   `json:"gateway"`
-	Destinations []string `json:"destinations"`
+	Addresses []string `json:"addresses"`
+	Gateway   string   `json:"gateway"`
+	// Gateways lists additional gateways, at most one per IP family, for
+	// dual-stack configurations
+	Gateways     []string      `json:"gateways,omitempty"`
+	Destinations []Destination `json:"destinations"`
+}
+
+// Destination is a destination to which the egress router redirects traffic. It
+// is given either as a JSON object, or as a string in the legacy
+// "<target>" or "<localPort> <protocol> <target> [<targetPort>]" format, or
+// "<localPort> <target> [<targetPort>]" in ModeDNSProxy
+type Destination struct {
+	// LocalPort is the port on which traffic is received. If zero, all traffic
+	// is redirected to Target
+	LocalPort int `json:"localPort,omitempty"`
+	// Protocol is one of "tcp", "udp" or "sctp". It is required with LocalPort
+	Protocol string `json:"protocol,omitempty"`
+	// Target is the destination IP address, optionally in CIDR notation. In
+	// ModeDNSProxy it may also be a host name
+	Target string `json:"target"`
+	// TargetPort is the destination port. If zero, LocalPort is used
+	TargetPort int `json:"targetPort,omitempty"`
+
+	// Legacy holds the destination as given in the legacy string format. Its
+	// fields are then parsed and validated by the plugin
+	Legacy string `json:"-"`
+}
+
+// destinationFields avoids recursing into the (Un)MarshalJSON methods of Destination
+type destinationFields Destination
+
+// UnmarshalJSON accepts both the object and the legacy string format.
+func (d *Destination) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*d = Destination{}
+		return json.Unmarshal(data, &d.Legacy)
+	}
+	return json.Unmarshal(data, (*destinationFields)(d))
+}
+
+// MarshalJSON preserves the format the destination was given in.
+func (d Destination) MarshalJSON() ([]byte, error) {
+	if d.Legacy != "" {
+		return json.Marshal(d.Legacy)
+	}
+	return json.Marshal(destinationFields(d))
+}
+
+// String returns the destination in the legacy string format.
+func (d Destination) String() string {
+	if d.Legacy != "" {
+		return d.Legacy
+	}
+	if d.LocalPort == 0 && d.Protocol == "" {
+		return d.Target
+	}
+	s := fmt.Sprintf("%d %s %s", d.LocalPort, d.Protocol, d.Target)
+	if d.TargetPort != 0 {
+		s += fmt.Sprintf(" %d", d.TargetPort)
+	}
+	return s
 }
 
 // IPConfig sets additional config for the Egress Router CNI
@@ -37,3 +154,75 @@ type IPConfig struct {
 	Name      string `json:"name"`
 	Overrides *IP    `json:"overrides"`
 }
+
+// HTTPProxy configures the HTTP proxy of the http-proxy mode
+type HTTPProxy struct {
+	// Port is the port the proxy listens on
+	Port int `json:"port,omitempty"`
+	// Allowlist lists the hosts ("www.example.com"), domains ("*.example.com"),
+	// IP addresses and CIDRs the proxy may connect to. "*" allows everything
+	Allowlist []string `json:"allowlist"`
+}
+
+// Filter restricts the traffic forwarded through the egress interface
+type Filter struct {
+	// Allow lists the destinations traffic may be forwarded to, in the
+	// "<cidr>" or "<cidr> <protocol> <port>" format
+	Allow []string `json:"allow"`
+	// Reject rejects the other traffic instead of dropping it
+	Reject bool `json:"reject,omitempty"`
+}
+
+// PolicyRouting sets the dedicated routing table used for egress traffic
+type PolicyRouting struct {
+	// Table is the routing table holding the egress routes
+	Table int `json:"table,omitempty"`
+	// Priority is the priority of the ip rules selecting Table
+	Priority int `json:"priority,omitempty"`
+	// ClusterCIDRs are the cluster and service networks, which are routed via
+	// the cluster interface in Table
+	ClusterCIDRs []string `json:"clusterCIDRs,omitempty"`
+}
+
+// Events configures the Kubernetes Events posted against the pod
+type Events struct {
+	// Interval is the minimum time between two Events of the same reason for a
+	// pod, as a Go duration ("1m" if empty)
+	Interval string `json:"interval,omitempty"`
+}
+
+// GatewayProbe configures the reachability probe of the gateways
+type GatewayProbe struct {
+	// Timeout is how long a gateway has to answer, as a Go duration ("3s" if
+	// empty)
+	Timeout string `json:"timeout,omitempty"`
+	// OnFailure is GatewayProbeFail (the default) or GatewayProbeWarn
+	OnFailure string `json:"onFailure,omitempty"`
+}
+
+// StatusAnnotation is the pod annotation holding the Status of the egress
+// interface
+const StatusAnnotation = "egress-router.openshift.io/status"
+
+// Status is the egress configuration applied to a pod by ADD
+type Status struct {
+	// IP is the effective IP configuration, with the addresses and gateways
+	// actually assigned
+	IP *IP `json:"ip"`
+	// MAC is the hardware address of the egress interface
+	MAC string `json:"mac,omitempty"`
+	// Master is the host interface the egress interface is attached to
+	Master string `json:"master,omitempty"`
+	// RulesetHash is the SHA-256 hash of the egress_cni nftables ruleset, as
+	// "sha256:<hex>"
+	RulesetHash string `json:"rulesetHash"`
+}
+
+// K8sArgs are the Kubernetes specific CNI_ARGS passed by the container runtime
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE          types.UnmarshallableString
+	K8S_POD_NAME               types.UnmarshallableString
+	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+	K8S_POD_UID                types.UnmarshallableString
+}
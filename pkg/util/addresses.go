@@ -0,0 +1,49 @@
+package util
+
+import (
+	"fmt"
+	"net"
+)
+
+// EgressAddresses returns the global unicast addresses configured on the egress
+// interface ifName, which the egress proxies bind outgoing connections to.
+func EgressAddresses(ifName string) ([]net.IP, error) {
+	return globalAddresses("egress", ifName)
+}
+
+// ListenAddresses returns the addresses the egress proxies listen on: address
+// if it is set, or else the global unicast addresses of the cluster interface
+// clusterIfName, so that the proxies are not reachable from the egress network.
+func ListenAddresses(address, clusterIfName string) ([]net.IP, error) {
+	if address != "" {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid listen address %q", address)
+		}
+		return []net.IP{ip}, nil
+	}
+	return globalAddresses("cluster", clusterIfName)
+}
+
+// globalAddresses returns the global unicast addresses configured on ifName,
+// the egress or cluster interface (role) of the pod.
+func globalAddresses(role, ifName string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %s interface %q: %v", role, ifName, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %q: %v", ifName, err)
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no %s address on %q", role, ifName)
+	}
+	return ips, nil
+}